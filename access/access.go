@@ -0,0 +1,345 @@
+// Package access decides who may send webhooks: by the shared secret, the
+// address they come from, how often they got the secret wrong lately, and
+// whether the webhook is fresh.
+package access
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretMatches reports whether the given secret is one of the accepted
+// ones. Every one is compared, by their hashes, so neither which one
+// matched nor their length or content leaks through timing. Empty secrets
+// never match.
+func SecretMatches(given string, accepted ...string) bool {
+	hash := sha256.Sum256([]byte(given))
+
+	match := 0
+	for _, secret := range accepted {
+		h := sha256.Sum256([]byte(secret))
+		match |= subtle.ConstantTimeCompare(hash[:], h[:]) & nonEmpty(secret)
+	}
+
+	return match == 1
+}
+
+func nonEmpty(s string) int {
+	if s == "" {
+		return 0
+	}
+	return 1
+}
+
+// ParsePrefixes parses a comma separated list of IP addresses and CIDR
+// ranges, like `10.0.0.0/8, 192.168.1.5`.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		prefix, err := parsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("`%v` is not an IP address or CIDR range", s)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("`%v` is not an IP address or CIDR range", s)
+	}
+
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address the request came from. When that's one of
+// the trusted proxies, it's taken from X-Forwarded-For instead: the last
+// address in it that isn't a trusted proxy itself, as anything before that
+// could have been made up by the client.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(hops) - 1; i >= 0 && contains(trustedProxies, addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+
+	return addr
+}
+
+// Allowlist holds the addresses webhooks are accepted from. An entry can be
+// for one controller only, like `Home=10.0.0.0/24`; a controller with such
+// entries is only accepted from those, every other controller from the
+// entries without one. A nil *Allowlist allows every address.
+type Allowlist struct {
+	any         []netip.Prefix
+	controllers map[string][]netip.Prefix
+}
+
+// ParseAllowlist parses a comma separated list of IP addresses and CIDR
+// ranges, each optionally preceded by the controller it's for, like
+// `192.168.1.0/24, Office=203.0.113.7`. It returns nil for an empty list.
+func ParseAllowlist(s string) (*Allowlist, error) {
+	l := &Allowlist{controllers: map[string][]netip.Prefix{}}
+	empty := true
+
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		empty = false
+
+		controller, addr, named := strings.Cut(item, "=")
+		if !named {
+			addr = controller
+		}
+
+		prefix, err := parsePrefix(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, err
+		}
+
+		if named {
+			controller = strings.TrimSpace(controller)
+			l.controllers[controller] = append(l.controllers[controller], prefix)
+		} else {
+			l.any = append(l.any, prefix)
+		}
+	}
+
+	if empty {
+		return nil, nil
+	}
+
+	return l, nil
+}
+
+// Allows reports whether webhooks are accepted from the address at all,
+// before knowing which controller it's from.
+func (l *Allowlist) Allows(addr netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	if contains(l.any, addr) {
+		return true
+	}
+
+	for _, prefixes := range l.controllers {
+		if contains(prefixes, addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsController reports whether webhooks of the controller are accepted
+// from the address.
+func (l *Allowlist) AllowsController(controller string, addr netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	if prefixes, ok := l.controllers[controller]; ok {
+		return contains(prefixes, addr)
+	}
+
+	return contains(l.any, addr)
+}
+
+// Lockout refuses every request from an address for Duration once Failures
+// attempts from it failed within Window. A nil *Lockout locks out nobody.
+type Lockout struct {
+	Failures int
+	Window   time.Duration
+	Duration time.Duration
+
+	mu    sync.Mutex
+	addrs map[netip.Addr]*attempts
+}
+
+type attempts struct {
+	failures int
+	since    time.Time // The first failure in the window
+	until    time.Time // Locked out until then
+}
+
+// Locked reports whether the address is locked out at the given time.
+func (l *Lockout) Locked(addr netip.Addr, now time.Time) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.addrs[addr]
+	return ok && now.Before(a.until)
+}
+
+// Fail records a failed attempt from the address, and reports whether that
+// locks it out.
+func (l *Lockout) Fail(addr netip.Addr, now time.Time) bool {
+	if l == nil || l.Failures <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.addrs == nil {
+		l.addrs = map[netip.Addr]*attempts{}
+	}
+
+	// Forget what's no longer relevant now and then, so guessing from many
+	// addresses doesn't fill up memory
+	if len(l.addrs) >= 1000 {
+		for a, at := range l.addrs {
+			if now.Sub(at.since) > l.Window && now.After(at.until) {
+				delete(l.addrs, a)
+			}
+		}
+	}
+
+	a, ok := l.addrs[addr]
+	if !ok || now.Sub(a.since) > l.Window {
+		a = &attempts{since: now}
+		l.addrs[addr] = a
+	}
+
+	a.failures++
+	if a.failures < l.Failures {
+		return false
+	}
+
+	a.failures, a.since, a.until = 0, now, now.Add(l.Duration)
+	return true
+}
+
+// Succeed forgets the failed attempts from the address.
+func (l *Lockout) Succeed(addr netip.Addr) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.addrs, addr)
+}
+
+// ErrStale and ErrReplayed are returned by ReplayGuard.Check.
+var (
+	ErrStale    = errors.New("timestamp outside the accepted window")
+	ErrReplayed = errors.New("received before")
+)
+
+// ReplayGuard rejects webhooks sent more than MaxSkew ago (or ahead, going
+// by the clock of the controller), and those received before within that
+// time. A nil *ReplayGuard accepts everything.
+type ReplayGuard struct {
+	MaxSkew time.Duration
+
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]time.Time // Until when each body is remembered
+}
+
+// Check checks the body of a webhook, sent at the given time, and remembers
+// it. Without a time to go by (zero) nothing is checked. A webhook that then
+// can't be delivered should be forgotten again, so it's delivered when the
+// controller tries again.
+func (g *ReplayGuard) Check(body []byte, sent, now time.Time) error {
+	if g == nil || sent.IsZero() {
+		return nil
+	}
+
+	if now.Sub(sent) > g.MaxSkew || sent.Sub(now) > g.MaxSkew {
+		return ErrStale
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Once a body is stale it doesn't need remembering any more
+	for hash, until := range g.seen {
+		if now.After(until) {
+			delete(g.seen, hash)
+		}
+	}
+
+	hash := sha256.Sum256(body)
+	if _, ok := g.seen[hash]; ok {
+		return ErrReplayed
+	}
+
+	if g.seen == nil {
+		g.seen = map[[sha256.Size]byte]time.Time{}
+	}
+	g.seen[hash] = sent.Add(g.MaxSkew)
+
+	return nil
+}
+
+// Forget forgets the body of a webhook, so it's accepted again.
+func (g *ReplayGuard) Forget(body []byte) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.seen, sha256.Sum256(body))
+}
+
+// EOF
@@ -0,0 +1,183 @@
+package access_test
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/access"
+)
+
+func TestSecretMatches(t *testing.T) {
+	tests := []struct {
+		given    string
+		accepted []string
+		want     bool
+	}{
+		{"current", []string{"current", "previous"}, true},
+		{"previous", []string{"current", "previous"}, true},
+		{"Current", []string{"current", "previous"}, false},
+		{"", []string{"current", ""}, false},
+		{"current", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := access.SecretMatches(tt.given, tt.accepted...); got != tt.want {
+			t.Errorf("SecretMatches(%q, %q) = %v, want %v", tt.given, tt.accepted, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := access.ParsePrefixes("10.0.0.0/8, 192.168.1.2")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"Direct", "203.0.113.7:51234", nil, "203.0.113.7"},
+		{"Not believed from an untrusted address", "203.0.113.7:51234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"Behind a trusted proxy", "192.168.1.2:51234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"Behind several trusted proxies", "192.168.1.2:51234", []string{"6.6.6.6, 198.51.100.1", "10.1.2.3"}, "198.51.100.1"},
+		{"Trusted proxy without the header", "192.168.1.2:51234", nil, "192.168.1.2"},
+		{"IPv4 mapped IPv6", "[::ffff:203.0.113.7]:51234", nil, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			if got := access.ClientIP(r, trusted); got.String() != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	l, err := access.ParseAllowlist("192.168.1.0/24, Office=203.0.113.7, Office=2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := netip.MustParseAddr
+
+	if !l.Allows(addr("192.168.1.20")) || !l.Allows(addr("203.0.113.7")) || !l.Allows(addr("2001:db8::1")) {
+		t.Errorf("Expected every listed address to be allowed")
+	}
+	if l.Allows(addr("198.51.100.1")) {
+		t.Errorf("Expected an address that isn't listed not to be allowed")
+	}
+
+	if !l.AllowsController("Home", addr("192.168.1.20")) || l.AllowsController("Home", addr("203.0.113.7")) {
+		t.Errorf("Expected other controllers to be allowed from the addresses without a controller only")
+	}
+	if !l.AllowsController("Office", addr("203.0.113.7")) || l.AllowsController("Office", addr("192.168.1.20")) {
+		t.Errorf("Expected the controller to be allowed from its own addresses only")
+	}
+
+	if l, err := access.ParseAllowlist(" "); l != nil || err != nil {
+		t.Errorf("Expected nil for an empty list, got %v, %v", l, err)
+	}
+	if _, err := access.ParseAllowlist("Home=192.168.1"); err == nil {
+		t.Errorf("Expected an error for an invalid address")
+	}
+
+	var none *access.Allowlist
+	if !none.Allows(addr("198.51.100.1")) || !none.AllowsController("Home", addr("198.51.100.1")) {
+		t.Errorf("Expected a nil allowlist to allow every address")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := &access.Lockout{Failures: 3, Window: time.Minute, Duration: 10 * time.Minute}
+	addr, other := netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("198.51.100.1")
+	now := time.Now()
+
+	l.Fail(addr, now)
+	l.Fail(addr, now.Add(10*time.Second))
+	if l.Locked(addr, now.Add(20*time.Second)) {
+		t.Fatalf("Locked out before 3 failures")
+	}
+
+	// Failures outside the window don't count
+	if l.Fail(addr, now.Add(2*time.Minute)) {
+		t.Fatalf("Locked out by failures outside the window")
+	}
+
+	l.Fail(addr, now.Add(2*time.Minute+time.Second))
+	if !l.Fail(addr, now.Add(2*time.Minute+2*time.Second)) || !l.Locked(addr, now.Add(3*time.Minute)) {
+		t.Fatalf("Expected 3 failures within the window to lock out")
+	}
+	if l.Locked(other, now.Add(3*time.Minute)) {
+		t.Errorf("Expected other addresses not to be locked out")
+	}
+	if l.Locked(addr, now.Add(13*time.Minute)) {
+		t.Errorf("Expected the lockout to end after its duration")
+	}
+
+	l.Fail(other, now)
+	l.Fail(other, now)
+	l.Succeed(other)
+	if l.Fail(other, now) {
+		t.Errorf("Expected a success to forget the failures before it")
+	}
+
+	var none *access.Lockout
+	if none.Fail(addr, now) || none.Locked(addr, now) {
+		t.Errorf("Expected a nil lockout to lock out nobody")
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	g := &access.ReplayGuard{MaxSkew: 5 * time.Minute}
+	now := time.Now()
+	body := []byte(`{"timestamp":1}`)
+
+	if err := g.Check(body, now.Add(-time.Minute), now); err != nil {
+		t.Fatalf("Expected a fresh webhook to be accepted, got %v", err)
+	}
+	if err := g.Check(body, now.Add(-time.Minute), now.Add(time.Second)); !errors.Is(err, access.ErrReplayed) {
+		t.Errorf("Expected the same webhook again to be a replay, got %v", err)
+	}
+	if err := g.Check([]byte(`{"timestamp":2}`), now.Add(-time.Minute), now); err != nil {
+		t.Errorf("Expected another webhook to be accepted, got %v", err)
+	}
+
+	if err := g.Check([]byte(`{}`), now.Add(-6*time.Minute), now); !errors.Is(err, access.ErrStale) {
+		t.Errorf("Expected an old webhook to be stale, got %v", err)
+	}
+	if err := g.Check([]byte(`{}`), now.Add(6*time.Minute), now); !errors.Is(err, access.ErrStale) {
+		t.Errorf("Expected a webhook from the future to be stale, got %v", err)
+	}
+
+	g.Forget(body)
+	if err := g.Check(body, now.Add(-time.Minute), now.Add(2*time.Second)); err != nil {
+		t.Errorf("Expected a forgotten webhook to be accepted again, got %v", err)
+	}
+
+	// Once it would be stale anyway, it's forgotten
+	if err := g.Check(body, now.Add(-time.Minute), now.Add(5*time.Minute)); !errors.Is(err, access.ErrStale) {
+		t.Errorf("Expected the webhook to be stale by now, got %v", err)
+	}
+
+	if err := g.Check(body, time.Time{}, now); err != nil {
+		t.Errorf("Expected a webhook without a time not to be checked, got %v", err)
+	}
+
+	var none *access.ReplayGuard
+	if err := none.Check(body, now.Add(-time.Hour), now); err != nil {
+		t.Errorf("Expected a nil guard to accept everything, got %v", err)
+	}
+	none.Forget(body)
+}
+
+// EOF
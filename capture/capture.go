@@ -0,0 +1,228 @@
+// Package capture records the webhook requests the bridge receives to a
+// JSONL file, one request per line, so real Omada payloads can be collected
+// for adding new event types. Secrets are left out: headers that carry them
+// aren't recorded and the `shardSecret` in the body is masked.
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// Defaults for rotating the capture file.
+const (
+	DefaultMaxSize  = 10 << 20 // 10 MiB
+	DefaultMaxFiles = 5
+)
+
+// Record is a single captured request.
+type Record struct {
+	Time           time.Time         `json:"time"`
+	RequestID      string            `json:"request_id,omitempty"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"` // With the query, like `/?controller=Home`
+	Headers        map[string]string `json:"headers"`
+	Body           json.RawMessage   `json:"body"`
+	Classification *Classification   `json:"classification,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// Classification is what the bridge made of a captured request.
+type Classification struct {
+	Type       string `json:"type"`
+	Priority   int    `json:"priority"`
+	Controller string `json:"controller"`
+	Site       string `json:"site"`
+	Device     string `json:"device,omitempty"`
+	Interface  string `json:"interface,omitempty"`
+}
+
+// secretHeaders are left out of the captured headers, as are all headers
+// with a name containing one of secretWords.
+var (
+	secretHeaders = []string{"Access_token", "Cookie", "Set-Cookie"}
+	secretWords   = []string{"auth", "token", "secret", "password", "key", "signature"}
+)
+
+// NewRecord captures a request with its (unparsed) body and the message it
+// was parsed into; payload is nil when it couldn't be parsed, with the error
+// in parseErr.
+func NewRecord(r *http.Request, requestID string, body []byte, payload *omada.OmadaMessage, parseErr error) Record {
+	rec := Record{
+		Time:      time.Now(),
+		RequestID: requestID,
+		Method:    r.Method,
+		Path:      r.URL.RequestURI(),
+		Headers:   map[string]string{},
+	}
+
+	for name, values := range r.Header {
+		if isSecretHeader(name) {
+			continue
+		}
+		rec.Headers[name] = strings.Join(values, ", ")
+	}
+
+	masked := omada.MaskSecrets(body)
+	if json.Valid(masked) {
+		rec.Body = masked
+	} else {
+		// Keep whatever it was, as a JSON string
+		rec.Body, _ = json.Marshal(string(masked))
+	}
+
+	if parseErr != nil {
+		rec.Error = parseErr.Error()
+	}
+
+	if payload != nil && parseErr == nil {
+		rec.Classification = &Classification{
+			Type:       payload.Type().String(),
+			Priority:   payload.Priority(),
+			Controller: payload.Controller,
+			Site:       payload.Site,
+			Device:     payload.Device(),
+			Interface:  payload.Interface(),
+		}
+	}
+
+	return rec
+}
+
+func isSecretHeader(name string) bool {
+	for _, h := range secretHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+
+	lower := strings.ToLower(name)
+	for _, w := range secretWords {
+		if strings.Contains(lower, w) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Recorder appends records to the JSONL file at Path. When the file would
+// grow beyond MaxSize it's rotated: renamed to Path.1 (Path.1 to Path.2 and
+// so on), keeping MaxFiles of those. A nil *Recorder records nothing.
+type Recorder struct {
+	Path     string
+	MaxSize  int64 // Defaults to DefaultMaxSize
+	MaxFiles int   // Defaults to DefaultMaxFiles
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Record appends the record to the capture file.
+func (c *Recorder) Record(rec Record) error {
+	if c == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	if c.size > 0 && c.size+int64(len(line)) > maxSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+
+	return err
+}
+
+// open opens the capture file for appending. Captures can hold information
+// about the network, so only the owner may read them.
+func (c *Recorder) open() error {
+	f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open capture file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	c.file, c.size = f, info.Size()
+
+	return nil
+}
+
+func (c *Recorder) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	c.file = nil
+
+	maxFiles := c.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	os.Remove(fmt.Sprintf("%v.%d", c.Path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", c.Path, i), fmt.Sprintf("%v.%d", c.Path, i+1))
+	}
+
+	if err := os.Rename(c.Path, c.Path+".1"); err != nil {
+		return fmt.Errorf("could not rotate capture file: %w", err)
+	}
+
+	return c.open()
+}
+
+// Close closes the capture file.
+func (c *Recorder) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.file.Close()
+	c.file = nil
+
+	return err
+}
+
+// EOF
@@ -0,0 +1,124 @@
+package capture_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/capture"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+func TestNewRecord(t *testing.T) {
+	body := []byte(`{"Controller":"Home","Site":"Default","shardSecret":"secret123","text":["[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline."]}`)
+
+	r := httptest.NewRequest("POST", "/omada?controller=Home", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header["Access_token"] = []string{"secret123"}
+	r.Header.Set("Authorization", "Bearer secret123")
+	r.Header.Set("X-Api-Key", "secret123")
+
+	payload := &omada.OmadaMessage{}
+	json.Unmarshal(body, payload)
+
+	rec := capture.NewRecord(r, "abc123", body, payload, nil)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("Record can't be encoded: %v", err)
+	}
+
+	if strings.Contains(string(line), "secret123") {
+		t.Errorf("Record contains a secret: %s", line)
+	}
+
+	if rec.Path != "/omada?controller=Home" {
+		t.Errorf("Expected the path to be recorded with its query, got `%v`", rec.Path)
+	}
+
+	if rec.Headers["Content-Type"] != "application/json" || len(rec.Headers) != 1 {
+		t.Errorf("Unexpected headers recorded: %v", rec.Headers)
+	}
+
+	c := rec.Classification
+	if c == nil || c.Type != "offline" || c.Priority != 10 || c.Controller != "Home" || c.Device != "gateway:98-03-8E-3A-8D-53" || c.Interface != "2.5G WAN1" {
+		t.Errorf("Unexpected classification: %#v", c)
+	}
+
+	t.Run("Unparseable requests are recorded with the error", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("not json"))
+
+		rec := capture.NewRecord(r, "", []byte("not json"), nil, errors.New("invalid character"))
+		if rec.Classification != nil || rec.Error != "invalid character" || string(rec.Body) != `"not json"` {
+			t.Errorf("Unexpected record: %#v", rec)
+		}
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	// Every record is about 150 bytes, so each file holds two of them
+	c := &capture.Recorder{Path: path, MaxSize: 400, MaxFiles: 2}
+	defer c.Close()
+
+	for i := range 7 {
+		r := httptest.NewRequest("POST", "/", nil)
+		rec := capture.NewRecord(r, strings.Repeat("x", 40)+string(rune('0'+i)), []byte(`{}`), nil, nil)
+
+		if err := c.Record(rec); err != nil {
+			t.Fatalf("Record() returned an unexpected error: %v", err)
+		}
+	}
+
+	ids := func(name string) []string {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		var ids []string
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			var rec capture.Record
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatalf("%v has an invalid line: %v", name, err)
+			}
+			ids = append(ids, rec.RequestID[40:])
+		}
+		return ids
+	}
+
+	got := [][]string{ids(path + ".2"), ids(path + ".1"), ids(path)}
+	want := `[[2 3] [4 5] [6]]`
+
+	if s := fmtIDs(got); s != want {
+		t.Errorf("Unexpected records after rotating: %v, want %v", s, want)
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("More rotated files kept than MaxFiles")
+	}
+
+	t.Run("A nil recorder records nothing", func(t *testing.T) {
+		var c *capture.Recorder
+		if err := c.Record(capture.Record{}); err != nil {
+			t.Errorf("Record() on nil returned an error: %v", err)
+		}
+	})
+}
+
+func fmtIDs(files [][]string) string {
+	parts := make([]string, len(files))
+	for i, ids := range files {
+		parts[i] = "[" + strings.Join(ids, " ") + "]"
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// EOF
@@ -0,0 +1,210 @@
+// Package certs serves the webhook over TLS with a certificate from files,
+// picking up a renewed certificate without a restart, and can generate a
+// self-signed one to start with.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How often the files are checked for changes, at most.
+var CheckInterval = 10 * time.Second
+
+// Reloader loads the certificate and key from CertFile and KeyFile, and when
+// ClientCAFile is set, the CAs that client certificates are verified with.
+// Whenever one of the files changes it's loaded again; when that fails the
+// files loaded before are kept.
+type Reloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // Optional
+	SelfSigned   bool   // Generate a self-signed certificate when there is none
+	Logger       *slog.Logger
+
+	mu       sync.Mutex
+	config   *tls.Config
+	modified []time.Time
+	checked  time.Time
+}
+
+// Load loads the files, after generating a self-signed certificate first
+// when that's asked for and there isn't one yet.
+func (r *Reloader) Load() error {
+	if r.SelfSigned {
+		if _, err := os.Stat(r.CertFile); errors.Is(err, fs.ErrNotExist) {
+			hostname, _ := os.Hostname()
+			if err := GenerateSelfSigned(r.CertFile, r.KeyFile, []string{hostname, "localhost", "127.0.0.1", "::1"}); err != nil {
+				return err
+			}
+			r.Logger.Warn("Generated a self-signed certificate", "cert_file", r.CertFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.load(time.Now())
+}
+
+// TLSConfig returns the configuration for the server, which always uses the
+// files last loaded. Client certificates are verified when they're given,
+// see RequireClientCert to require them.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// current returns the configuration for the files, loading them again when
+// they changed.
+func (r *Reloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) < CheckInterval {
+		return r.config
+	}
+	r.checked = now
+
+	if slices.Equal(r.modTimes(), r.modified) {
+		return r.config
+	}
+
+	if err := r.load(now); err != nil {
+		r.Logger.Error("Could not reload the TLS certificate, keeping the one loaded before", "error", err)
+	} else {
+		r.Logger.Info("TLS certificate reloaded", "cert_file", r.CertFile)
+	}
+
+	return r.config
+}
+
+func (r *Reloader) load(now time.Time) error {
+	// Taken before reading, so a change while reading is noticed next time
+	modified := r.modTimes()
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.ClientCAFile != "" {
+		data, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("TLS client CA: %w", err)
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("TLS client CA: no certificates found in %v", r.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	r.config, r.modified, r.checked = config, modified, now
+	return nil
+}
+
+func (r *Reloader) modTimes() []time.Time {
+	var times []time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		var t time.Time
+		if info, err := os.Stat(path); err == nil {
+			t = info.ModTime()
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+// RequireClientCert only lets requests through with a verified client
+// certificate, except for the exempt paths, such as the health checks that
+// Docker makes without one.
+func RequireClientCert(next http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(exempt, r.URL.Path) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GenerateSelfSigned writes a new self-signed certificate for the hosts
+// (names or IP addresses), valid for 5 years, and its key.
+func GenerateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "omada-to-ntfy"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// The key first, so there's never a certificate without one
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// EOF
@@ -0,0 +1,185 @@
+package certs_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/certs"
+)
+
+// serve serves ok over TLS with the reloader's configuration, requiring
+// client certificates except on /healthz.
+func serve(t *testing.T, r *certs.Reloader) *httptest.Server {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	server := httptest.NewUnstartedServer(certs.RequireClientCert(ok, "/healthz"))
+	server.TLS = r.TLSConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// client trusts the certificate in the file, and presents the client
+// certificate when one is given.
+func client(t *testing.T, certFile string, clientCert ...tls.Certificate) *http.Client {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: clientCert},
+	}}
+}
+
+func get(c *http.Client, url string) (int, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	r := &certs.Reloader{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+		Logger:     logger,
+	}
+
+	if err := r.Load(); err != nil {
+		t.Fatalf("Load() returned an error: %v", err)
+	}
+
+	if info, err := os.Stat(r.KeyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected a private key file, got %v, %v", info, err)
+	}
+
+	server := serve(t, r)
+	first := client(t, r.CertFile)
+
+	if code, err := get(first, server.URL+"/healthz"); err != nil || code != http.StatusOK {
+		t.Fatalf("Expected the self-signed certificate to be served; got %v, %v", code, err)
+	}
+
+	// Without client CAs no client certificate is verified, so only the
+	// exempt paths are let through
+	if code, _ := get(first, server.URL+"/"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a client certificate to be required, got %v", code)
+	}
+
+	t.Run("Picks up a new certificate", func(t *testing.T) {
+		defer func(interval time.Duration) { certs.CheckInterval = interval }(certs.CheckInterval)
+		certs.CheckInterval = 0
+
+		if err := certs.GenerateSelfSigned(r.CertFile, r.KeyFile, []string{"127.0.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(r.CertFile, later, later)
+
+		second := client(t, r.CertFile)
+		if code, err := get(second, server.URL+"/healthz"); err != nil || code != http.StatusOK {
+			t.Fatalf("Expected the new certificate to be served; got %v, %v", code, err)
+		}
+	})
+
+	t.Run("Keeps the certificate when the new one is broken", func(t *testing.T) {
+		defer func(interval time.Duration) { certs.CheckInterval = interval }(certs.CheckInterval)
+		certs.CheckInterval = 0
+
+		current := client(t, r.CertFile)
+		os.WriteFile(r.KeyFile, []byte("not a key"), 0o600)
+
+		if code, err := get(current, server.URL+"/healthz"); err != nil || code != http.StatusOK {
+			t.Fatalf("Expected the certificate loaded before to be kept; got %v, %v", code, err)
+		}
+	})
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	clientCertFile, clientKeyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := certs.GenerateSelfSigned(clientCertFile, clientKeyFile, []string{"omada"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &certs.Reloader{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: clientCertFile,
+		SelfSigned:   true,
+		Logger:       logger,
+	}
+
+	if err := r.Load(); err != nil {
+		t.Fatalf("Load() returned an error: %v", err)
+	}
+
+	server := serve(t, r)
+
+	if code, err := get(client(t, r.CertFile, clientCert), server.URL+"/"); err != nil || code != http.StatusOK {
+		t.Errorf("Expected a request with a client certificate to be let through; got %v, %v", code, err)
+	}
+
+	anonymous := client(t, r.CertFile)
+	if code, err := get(anonymous, server.URL+"/"); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without a client certificate to be refused; got %v, %v", code, err)
+	}
+
+	if code, err := get(anonymous, server.URL+"/healthz"); err != nil || code != http.StatusOK {
+		t.Errorf("Expected the health check to work without a client certificate; got %v, %v", code, err)
+	}
+
+	// A client certificate that isn't trusted fails the handshake
+	otherCertFile, otherKeyFile := filepath.Join(dir, "other.pem"), filepath.Join(dir, "other-key.pem")
+	certs.GenerateSelfSigned(otherCertFile, otherKeyFile, []string{"someone"})
+	other, _ := tls.LoadX509KeyPair(otherCertFile, otherKeyFile)
+
+	if _, err := get(client(t, r.CertFile, other), server.URL+"/"); err == nil {
+		t.Errorf("Expected a request with an untrusted client certificate to fail")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	r := &certs.Reloader{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	if err := r.Load(); err == nil {
+		t.Errorf("Expected an error without a certificate")
+	}
+
+	certs.GenerateSelfSigned(r.CertFile, r.KeyFile, []string{"localhost"})
+	os.WriteFile(filepath.Join(dir, "ca.pem"), []byte("no certificates"), 0o644)
+
+	r.ClientCAFile = filepath.Join(dir, "ca.pem")
+	if err := r.Load(); err == nil {
+		t.Errorf("Expected an error for a client CA file without certificates")
+	}
+}
+
+// EOF
@@ -0,0 +1,117 @@
+// Package chat delivers Omada messages to the incoming webhooks offered by
+// chat platforms: Slack, Discord, Mattermost and Microsoft Teams.
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// Color returns the colour used to highlight a message of the given Omada
+// priority (0-10), as a hex RGB string.
+//
+// 10 -> red
+// 7  -> orange
+// 4  -> blue
+// 0  -> grey
+func Color(omadaPriority int) string {
+	switch {
+	case omadaPriority >= 10:
+		return "#D32F2F"
+	case omadaPriority >= 7:
+		return "#F57C00"
+	case omadaPriority >= 4:
+		return "#1976D2"
+	default:
+		return "#9E9E9E"
+	}
+}
+
+// A named value shown alongside the message, like the site it came from.
+type field struct {
+	Name  string
+	Value string
+}
+
+// fields returns the controller, site and device the message is about,
+// leaving out any of them that are unknown.
+func fields(payload *omada.OmadaMessage) []field {
+	var fields []field
+
+	for _, f := range []field{
+		{"Controller", payload.Controller},
+		{"Site", payload.Site},
+		{"Device", payload.Device()},
+		{"Interface", payload.Interface()},
+	} {
+		if f.Value != "" {
+			fields = append(fields, f)
+		}
+	}
+
+	return fields
+}
+
+// The message text without the timestamp line Body() appends, as the chat
+// platforms show the timestamp themselves.
+func text(payload *omada.OmadaMessage) string {
+	messages := payload.Text
+	if len(messages) == 0 && payload.Type() == omada.OmadaTestMessage {
+		messages = []string{payload.Description}
+	}
+
+	lines := make([]string, len(messages))
+	for i, line := range messages {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// post sends the JSON encoded payload to an incoming webhook URL, with the
+// platform name used in the log and error messages. A nil client means an
+// http.Client with a 30 second timeout is used.
+func post(ctx context.Context, logger *slog.Logger, client *http.Client, platform string, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.ErrorContext(ctx, "Could not encode chat message", "platform", platform, "error", err)
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		logger.ErrorContext(ctx, "Could not create chat request", "platform", platform, "error", err)
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.ErrorContext(ctx, "Could not send message to chat", "platform", platform, "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logger.ErrorContext(ctx, "Chat returned non-success status code", "platform", platform, "status", resp.StatusCode)
+		return fmt.Errorf("%s returned status code %d", strings.ToLower(platform), resp.StatusCode)
+	}
+
+	logger.InfoContext(ctx, "Message sent to chat", "platform", platform)
+	return nil
+}
+
+// EOF
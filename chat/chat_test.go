@@ -0,0 +1,129 @@
+package chat_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/chat"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+func TestColor(t *testing.T) {
+	tests := []struct {
+		omadaPriority int
+		expected      string
+	}{
+		{10, "#D32F2F"},
+		{7, "#F57C00"},
+		{4, "#1976D2"},
+		{0, "#9E9E9E"},
+	}
+
+	for _, tt := range tests {
+		if got := chat.Color(tt.omadaPriority); got != tt.expected {
+			t.Errorf("Color(%d) = %s; want %s", tt.omadaPriority, got, tt.expected)
+		}
+	}
+}
+
+func TestChatClients(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	msg := &omada.OmadaMessage{
+		Controller: "Omada_Controller",
+		Site:       "Offline Site",
+		Text: []string{
+			"[2.5G WAN1] of [gateway:98-03-8E-3A-8D-53] is down.\r",
+			"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r",
+		},
+		Timestamp: 1758852904877,
+	}
+
+	var received string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		received = string(raw)
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", r.Header.Get("Content-Type"))
+		}
+
+		if r.URL.Path == "/fail" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		client   notifier.Notifier
+		contains []string
+	}{
+		{
+			name:     "Slack",
+			client:   &chat.SlackClient{WebhookURL: server.URL, Logger: logger},
+			contains: []string{`"color":"#D32F2F"`, `"title":"Device","value":"gateway:98-03-8E-3A-8D-53"`, `"ts":1758852904`},
+		},
+		{
+			name:     "Mattermost",
+			client:   &chat.MattermostClient{WebhookURL: server.URL, Logger: logger},
+			contains: []string{`"color":"#D32F2F"`, `"title":"Site","value":"Offline Site"`},
+		},
+		{
+			name:     "Discord",
+			client:   &chat.DiscordClient{WebhookURL: server.URL, Logger: logger},
+			contains: []string{`"color":13840175`, `"name":"Controller","value":"Omada_Controller"`, `"timestamp":"2025-09-26T02:15:04Z"`},
+		},
+		{
+			name:     "Teams",
+			client:   &chat.TeamsClient{WebhookURL: server.URL, Logger: logger},
+			contains: []string{`"application/vnd.microsoft.card.adaptive"`, `"color":"attention"`, `"title":"Interface","value":"2.5G WAN1"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+
+			if err := tt.client.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Send() returned an unexpected error: %v", err)
+			}
+
+			if !json.Valid([]byte(received)) {
+				t.Fatalf("Posted body is not valid JSON: %s", received)
+			}
+
+			if strings.Contains(received, "Timestamp:") {
+				t.Errorf("The timestamp line should be left out of the text: %s", received)
+			}
+
+			for _, want := range tt.contains {
+				if !strings.Contains(received, want) {
+					t.Errorf("Posted body does not contain %s: %s", want, received)
+				}
+			}
+		})
+	}
+
+	t.Run("Returns an error on a non-success status code", func(t *testing.T) {
+		client := chat.DiscordClient{WebhookURL: server.URL + "/fail", Logger: logger}
+
+		if err := client.Send(context.Background(), msg); err == nil {
+			t.Error("Send() should fail when the webhook is rejected")
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// DiscordClient posts messages to a Discord channel webhook, see
+// https://discord.com/developers/docs/resources/webhook#execute-webhook
+type DiscordClient struct {
+	WebhookURL string
+	Client     *http.Client // Optional; defaults to an http.Client with a 30 second timeout
+	Logger     *slog.Logger
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Timestamp   string         `json:"timestamp"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+func newDiscordMessage(payload *omada.OmadaMessage) discordMessage {
+	var df []discordField
+	for _, f := range fields(payload) {
+		df = append(df, discordField{Name: f.Name, Value: f.Value, Inline: true})
+	}
+
+	// Discord wants the colour as a decimal number rather than a hex string
+	color, _ := strconv.ParseInt(strings.TrimPrefix(Color(payload.Priority()), "#"), 16, 32)
+
+	return discordMessage{
+		Embeds: []discordEmbed{{
+			Title:       payload.Title(),
+			Description: text(payload),
+			Color:       int(color),
+			Fields:      df,
+			Timestamp:   payload.Date().UTC().Format(time.RFC3339),
+		}},
+	}
+}
+
+// Send sends a message to Discord using the provided payload
+func (dc *DiscordClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return post(ctx, dc.Logger, dc.Client, "Discord", dc.WebhookURL, newDiscordMessage(payload))
+}
+
+// EOF
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// SlackClient posts messages to a Slack incoming webhook, see
+// https://api.slack.com/messaging/webhooks
+type SlackClient struct {
+	WebhookURL string
+	Client     *http.Client // Optional; defaults to an http.Client with a 30 second timeout
+	Logger     *slog.Logger
+}
+
+// MattermostClient posts messages to a Mattermost incoming webhook. These
+// accept the same message attachments as Slack, see
+// https://developers.mattermost.com/integrate/reference/message-attachments/
+type MattermostClient struct {
+	WebhookURL string
+	Client     *http.Client // Optional; defaults to an http.Client with a 30 second timeout
+	Logger     *slog.Logger
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields,omitempty"`
+	Footer   string       `json:"footer"`
+	Ts       int64        `json:"ts"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func newSlackMessage(payload *omada.OmadaMessage) slackMessage {
+	var sf []slackField
+	for _, f := range fields(payload) {
+		sf = append(sf, slackField{Title: f.Name, Value: f.Value, Short: true})
+	}
+
+	return slackMessage{
+		Text: payload.Title(),
+		Attachments: []slackAttachment{{
+			Fallback: payload.Title() + "\n" + text(payload),
+			Color:    Color(payload.Priority()),
+			Title:    payload.Type().String(),
+			Text:     text(payload),
+			Fields:   sf,
+			Footer:   "omada-to-ntfy",
+			Ts:       payload.Date().Unix(),
+		}},
+	}
+}
+
+// Send sends a message to Slack using the provided payload
+func (sc *SlackClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return post(ctx, sc.Logger, sc.Client, "Slack", sc.WebhookURL, newSlackMessage(payload))
+}
+
+// Send sends a message to Mattermost using the provided payload
+func (mc *MattermostClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return post(ctx, mc.Logger, mc.Client, "Mattermost", mc.WebhookURL, newSlackMessage(payload))
+}
+
+// EOF
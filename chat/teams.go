@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// TeamsClient posts messages as an Adaptive Card to a Microsoft Teams
+// incoming webhook (set up through the Workflows app), see
+// https://learn.microsoft.com/en-us/connectors/teams/#microsoft-teams-webhook
+type TeamsClient struct {
+	WebhookURL string
+	Client     *http.Client // Optional; defaults to an http.Client with a 30 second timeout
+	Logger     *slog.Logger
+}
+
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string `json:"contentType"`
+	Content     any    `json:"content"`
+}
+
+// Adaptive Cards only know a handful of named colours, so the priority is
+// mapped onto those instead of the hex colours the other platforms use.
+func teamsColor(omadaPriority int) string {
+	switch {
+	case omadaPriority >= 10:
+		return "attention"
+	case omadaPriority >= 7:
+		return "warning"
+	case omadaPriority >= 4:
+		return "accent"
+	default:
+		return "default"
+	}
+}
+
+func newTeamsMessage(payload *omada.OmadaMessage) teamsMessage {
+	facts := []map[string]string{}
+	for _, f := range fields(payload) {
+		facts = append(facts, map[string]string{"title": f.Name, "value": f.Value})
+	}
+
+	facts = append(facts, map[string]string{
+		"title": "Time",
+		"value": payload.Date().UTC().Format(time.RFC3339),
+	})
+
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []map[string]any{
+			{
+				"type":   "TextBlock",
+				"text":   payload.Title(),
+				"weight": "bolder",
+				"size":   "medium",
+				"color":  teamsColor(payload.Priority()),
+				"wrap":   true,
+			},
+			{
+				"type": "TextBlock",
+				"text": text(payload),
+				"wrap": true,
+			},
+			{
+				"type":  "FactSet",
+				"facts": facts,
+			},
+		},
+	}
+
+	return teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content:     card,
+		}},
+	}
+}
+
+// Send sends a message to Microsoft Teams using the provided payload
+func (tc *TeamsClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return post(ctx, tc.Logger, tc.Client, "Teams", tc.WebhookURL, newTeamsMessage(payload))
+}
+
+// EOF
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httputil"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/config"
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/webhook"
+)
+
+// The subcommands of the binary; without one it runs the server.
+var commands = map[string]func(args []string) int{
+	"healthcheck":     Healthcheck,
+	"send-test":       func(args []string) int { return SendTest(args, os.Stdout) },
+	"validate-config": func(args []string) int { return ValidateConfig(args, os.Stdout) },
+	"classify":        func(args []string) int { return Classify(args, os.Stdin, os.Stdout) },
+	"replay":          func(args []string) int { return Replay(args, os.Stdin, os.Stdout) },
+	"version":         func(args []string) int { return Version(args, os.Stdout) },
+}
+
+// sampleMessages are sent by send-test, looking like what Omada sends.
+var sampleMessages = map[omada.OmadaMessageType]omada.OmadaMessage{
+	omada.OmadaTestMessage: {
+		Site:        "omada-to-ntfy",
+		Description: "This is a webhook test message. Please ignore this",
+	},
+	omada.OmadaOfflineMessage: {
+		Controller: "omada-to-ntfy",
+		Site:       "Test",
+		Text:       []string{"[gateway:00-00-5E-00-53-01]: The online detection result of [WAN1] was offline."},
+	},
+	omada.OmadaOnlineMessage: {
+		Controller: "omada-to-ntfy",
+		Site:       "Test",
+		Text:       []string{"[gateway:00-00-5E-00-53-01]: The online detection result of [WAN1] was online."},
+	},
+}
+
+// configFlag adds the -config flag to the subcommand, which stands in for
+// the CONFIG_FILE environment variable.
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv("CONFIG_FILE"), "the config file to use (default $CONFIG_FILE)")
+}
+
+// commandLogger logs to stderr as configured, falling back to warnings only
+// in the text format when the configuration can't be loaded.
+func commandLogger(path string) *slog.Logger {
+	cfg, _ := config.Load(path)
+
+	logger, err := logging.New(os.Stderr, cfg.Getenv("LOG_FORMAT"), cfg.Getenv("LOG_LEVEL"))
+	if err != nil {
+		logger, _ = logging.New(os.Stderr, "text", "warn")
+	}
+
+	if r, _ := redactorFromEnv(cfg.Getenv, "REDACT_LOGS"); r != nil {
+		logger = slog.New(r.Handler(logger.Handler()))
+	}
+
+	return logger
+}
+
+// SendTest sends a sample message through every configured destination and
+// reports how each delivery went, so the configuration can be tried out
+// without waiting for Omada.
+func SendTest(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("send-test", flag.ContinueOnError)
+	path := configFlag(fs)
+	messageType := fs.String("type", "test", "the type of message to send: test, offline or online")
+	all := fs.Bool("all", false, "send to every destination, ignoring the routing rules")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the deliveries")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	t, err := omada.ParseMessageType(*messageType)
+	sample, ok := sampleMessages[t]
+	if err != nil || !ok {
+		fmt.Fprintf(os.Stderr, "Can't send a message of type `%v`; use test, offline or online\n", *messageType)
+		return 2
+	}
+	sample.Timestamp = time.Now().UnixMilli()
+
+	logger := commandLogger(*path)
+
+	cfg, err := config.Load(*path)
+	var notifiers notifier.Multi
+	if err == nil {
+		notifiers, _, _, err = checkConfig(cfg, logger)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(logging.WithRequestID(context.Background(), "send-test"), *timeout)
+	defer cancel()
+
+	failed := false
+	for _, n := range notifiers {
+		name := notifier.Name(n)
+
+		if r, ok := n.(notifier.Route); ok {
+			if !*all && !r.Matches(&sample) {
+				fmt.Fprintf(stdout, "%v: skipped by its routing rules\n", name)
+				continue
+			}
+			n = r.Notifier
+		}
+
+		if err := n.Send(ctx, &sample); err != nil {
+			fmt.Fprintf(stdout, "%v: failed: %v\n", name, err)
+			failed = true
+			continue
+		}
+
+		fmt.Fprintf(stdout, "%v: sent\n", name)
+	}
+
+	if failed {
+		return 1
+	}
+
+	return 0
+}
+
+// ValidateConfig checks the configuration, including the templates in it,
+// the same way the server does at startup, and lists the destinations.
+func ValidateConfig(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	path := configFlag(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*path)
+	if err == nil {
+		_, err = logging.New(io.Discard, cfg.Getenv("LOG_FORMAT"), cfg.Getenv("LOG_LEVEL"))
+	}
+
+	var (
+		notifiers notifier.Multi
+		server    *webhook.WebhookServer
+	)
+	if err == nil {
+		notifiers, server, _, err = checkConfig(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, "Configuration is valid, with destinations:")
+	for _, n := range notifiers {
+		fmt.Fprintf(stdout, "  %v\n", notifier.Name(n))
+	}
+
+	if server.Watchdog != nil {
+		fmt.Fprintln(stdout, "Delivery failures are reported through:")
+		for _, n := range server.Watchdog.Fallback.(notifier.Multi) {
+			fmt.Fprintf(stdout, "  %v\n", notifier.Name(n))
+		}
+	}
+
+	return 0
+}
+
+// Classify reads an Omada webhook payload from a file, or stdin when there
+// isn't one, and shows what the bridge makes of it: the detected type,
+// priority and tags, and the request that would be sent to ntfy.
+func Classify(args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("classify", flag.ContinueOnError)
+	path := configFlag(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	input := stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		input = f
+	}
+
+	body, err := io.ReadAll(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	msg, err := omada.ParseOmadaMessage(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), body, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not an Omada webhook payload: %v\n", err)
+		return 1
+	}
+
+	// Shown redacted as it would be sent
+	cfg, _ := config.Load(*path)
+	redactor, err := redactorFromEnv(cfg.Getenv, "REDACT_NOTIFICATIONS")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sent := redactor.Message(msg)
+
+	fmt.Fprintf(stdout, "Type:          %v\n", sent.Type())
+	fmt.Fprintf(stdout, "Priority:      %v (ntfy %v)\n", sent.Priority(), ntfy.MapPriority(sent.Priority()))
+	fmt.Fprintf(stdout, "Tags:          %v\n", strings.Join(ntfy.GetTagsForMessageType(sent.Type()), ","))
+	if device := sent.Device(); device != "" {
+		fmt.Fprintf(stdout, "Device:        %v\n", device)
+	}
+	if iface := sent.Interface(); iface != "" {
+		fmt.Fprintf(stdout, "Interface:     %v\n", iface)
+	}
+
+	// Render the request for the configured ntfy server, or an example one
+	client := &ntfy.NtfyClient{NtfyURL: "https://ntfy.sh", Topic: "omada_alerts"}
+	if url := cfg.Getenv("NTFY_URL"); url != "" {
+		client.NtfyURL, client.Topic = url, cfg.Getenv("NTFY_TOPIC")
+	}
+
+	req, err := client.NewRequest(context.Background(), sent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create the ntfy request: %v\n", err)
+		return 1
+	}
+
+	dump, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not render the ntfy request: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "\nntfy request:\n%s\n", strings.ReplaceAll(string(dump), "\r\n", "\n"))
+
+	return 0
+}
+
+// Version prints the version of the build, and the Go version and build
+// settings it was built with.
+func Version(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	fmt.Fprintf(stdout, "omada-to-ntfy %v\n", version)
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "go\t%v\n", info.GoVersion)
+	fmt.Fprintf(stdout, "mod\t%v\t%v\n", info.Main.Path, info.Main.Version)
+	for _, s := range info.Settings {
+		fmt.Fprintf(stdout, "build\t%v=%v\n", s.Key, s.Value)
+	}
+
+	return 0
+}
+
+// EOF
@@ -0,0 +1,403 @@
+// Package config reads the configuration file of the bridge. The file uses a
+// small subset of TOML and sets the same things as the environment variables
+// do, each key being named after its environment variable: a `topic` key in
+// the `[ntfy]` table sets `NTFY_TOPIC`, a top level `port` key sets `PORT`.
+//
+//	omada_shared_secret = "${OMADA_SECRET}"
+//
+//	[ntfy]
+//	url = "https://ntfy.sh"
+//	topic = "my_omada_alerts"
+//	types = ["offline", "online"]
+//
+// Supported are tables (dotted names join with underscores), basic and
+// literal strings (also multi-line), integers, floats, booleans and arrays
+// of those, which are joined with commas. In basic strings `${VAR}` is
+// replaced by the environment variable VAR and `${VAR:-default}` falls back
+// to the default when VAR is empty; `$$` is a literal `$`. Literal strings
+// are taken as they are, as in TOML.
+//
+// Secrets can be kept in files of their own instead, such as Docker secrets
+// or Kubernetes secret volumes: `NTFY_PASSWORD_FILE` (or `password_file` in
+// the `[ntfy]` table) names the file to read `NTFY_PASSWORD` from.
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings from a configuration file, keyed by the name of
+// the environment variable with the same meaning.
+type Config map[string]string
+
+// Getenv returns the setting for the environment variable name; taken from
+// the environment when it's set (and not empty) there, so the environment
+// overrides the file.
+func (c Config) Getenv(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return c[key]
+}
+
+// Load reads and parses the configuration file at path, and the secret
+// files it or the environment refer to. An empty path gives an empty
+// configuration, leaving everything to the environment.
+func Load(path string) (Config, error) {
+	c := Config{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+
+		if c, err = Parse(string(data), os.Getenv); err != nil {
+			return nil, fmt.Errorf("config file %v: %w", path, err)
+		}
+	}
+
+	if err := c.readSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// IsSecret reports whether the setting is a secret, which can be read from
+// the file named by the setting with `_FILE` appended.
+func IsSecret(key string) bool {
+	for _, suffix := range []string{"_PASSWORD", "_SECRET", "_SECRETS", "_TOKEN", "_WEBHOOK_URL", "_HEADERS"} {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretFiles returns the settings naming a secret file, in the environment
+// or the configuration, with the path of each.
+func (c Config) SecretFiles() map[string]string {
+	keys := map[string]bool{}
+	for key := range c {
+		keys[key] = true
+	}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		keys[key] = true
+	}
+
+	files := map[string]string{}
+	for key := range keys {
+		name, ok := strings.CutSuffix(key, "_FILE")
+		if ok && IsSecret(name) {
+			if path := c.Getenv(key); path != "" {
+				files[key] = path
+			}
+		}
+	}
+
+	return files
+}
+
+// readSecretFiles sets every secret that has a file to the content of the
+// file, without the line break at the end. The environment still takes
+// precedence.
+func (c Config) readSecretFiles() error {
+	for key, path := range c.SecretFiles() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%v: %w", key, err)
+		}
+
+		c[strings.TrimSuffix(key, "_FILE")] = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return nil
+}
+
+var (
+	tableRe = regexp.MustCompile(`^\[\s*([A-Za-z0-9_-]+(?:\s*\.\s*[A-Za-z0-9_-]+)*)\s*\]$`)
+	keyRe   = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*`)
+	varRe   = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+)
+
+// Parse parses a configuration, looking up the variables it refers to with
+// getenv.
+func Parse(data string, getenv func(string) string) (Config, error) {
+	c := Config{}
+	p := &parser{rest: data, getenv: getenv}
+	prefix := ""
+
+	for p.rest != "" {
+		p.line++
+		line, _ := p.next()
+
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if m := tableRe.FindStringSubmatch(line); m != nil {
+			prefix = ""
+			for part := range strings.SplitSeq(m[1], ".") {
+				prefix += envName(strings.TrimSpace(part)) + "_"
+			}
+			continue
+		}
+
+		m := keyRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, p.errorf("expected a `key = value` or a `[table]`")
+		}
+
+		key := prefix + envName(m[1])
+		if _, ok := c[key]; ok {
+			return nil, p.errorf("%v is set twice", key)
+		}
+
+		value, err := p.value(strings.TrimSpace(line[len(m[0]):]))
+		if err != nil {
+			return nil, err
+		}
+
+		c[key] = value
+	}
+
+	return c, nil
+}
+
+func envName(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+type parser struct {
+	rest   string
+	line   int
+	getenv func(string) string
+}
+
+// next takes the next line off the input.
+func (p *parser) next() (string, bool) {
+	line, rest, ok := strings.Cut(p.rest, "\n")
+	p.rest = rest
+	return strings.TrimSuffix(line, "\r"), ok
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %v", p.line, fmt.Sprintf(format, args...))
+}
+
+// value parses the value of a key, reading on for multi-line strings.
+func (p *parser) value(s string) (string, error) {
+	for _, quotes := range []string{`"""`, `'''`} {
+		if !strings.HasPrefix(s, quotes) {
+			continue
+		}
+
+		// A newline right after the opening quotes isn't part of the string
+		text := s[3:]
+		skipNewline := text == ""
+		start := p.line
+
+		for !strings.Contains(text, quotes) {
+			if p.rest == "" {
+				return "", fmt.Errorf("line %d: multi-line string is not closed", start)
+			}
+
+			line, _ := p.next()
+			p.line++
+
+			if skipNewline {
+				text, skipNewline = line, false
+			} else {
+				text += "\n" + line
+			}
+		}
+
+		end := strings.Index(text, quotes)
+		if rest := strings.TrimSpace(stripComment(text[end+3:])); rest != "" {
+			return "", p.errorf("unexpected `%v` after the string", rest)
+		}
+
+		// Literal strings are taken as they are
+		text = text[:end]
+		if quotes == `'''` {
+			return text, nil
+		}
+
+		unquoted, err := unescape(text)
+		if err != nil {
+			return "", p.errorf("%v", err)
+		}
+
+		return p.interpolate(unquoted)
+	}
+
+	s = strings.TrimSpace(stripComment(s))
+
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return "", p.errorf("arrays must be on one line")
+		}
+
+		var items []string
+		for rest := strings.TrimSpace(s[1 : len(s)-1]); rest != ""; {
+			item, after, err := p.scalar(rest)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+
+			rest = strings.TrimSpace(after)
+			if rest != "" {
+				if rest[0] != ',' {
+					return "", p.errorf("expected a `,` between array items")
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+
+		return strings.Join(items, ","), nil
+	}
+
+	value, rest, err := p.scalar(s)
+	if err != nil {
+		return "", err
+	}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		return "", p.errorf("unexpected `%v` after the value", rest)
+	}
+
+	return value, nil
+}
+
+var bareRe = regexp.MustCompile(`^[^\s,\]]+`)
+
+// scalar parses the single-line value at the start of s, returning it and
+// whatever comes after it.
+func (p *parser) scalar(s string) (string, string, error) {
+	switch {
+	case s == "":
+		return "", "", p.errorf("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				text, err := unescape(s[1:i])
+				if err != nil {
+					return "", "", p.errorf("%v", err)
+				}
+				text, err = p.interpolate(text)
+				return text, s[i+1:], err
+			}
+		}
+		return "", "", p.errorf("string is not closed")
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", p.errorf("string is not closed")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	bare := bareRe.FindString(s)
+	rest := s[len(bare):]
+
+	if bare == "true" || bare == "false" {
+		return bare, rest, nil
+	}
+
+	number := strings.ReplaceAll(bare, "_", "")
+	if _, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return number, rest, nil
+	}
+	if _, err := strconv.ParseFloat(number, 64); err == nil {
+		return number, rest, nil
+	}
+
+	return "", "", p.errorf("invalid value `%v`; strings need quotes", bare)
+}
+
+// interpolate replaces the environment variables referred to in s.
+func (p *parser) interpolate(s string) (string, error) {
+	var err error
+
+	s = varRe.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+
+		m := varRe.FindStringSubmatch(ref)
+		if v := p.getenv(m[1]); v != "" {
+			return v
+		}
+		if strings.Contains(ref, ":-") {
+			return m[2]
+		}
+
+		err = p.errorf("environment variable %v is not set", m[1])
+		return ""
+	})
+
+	return s, err
+}
+
+// unescape handles the escapes of a basic string, which are the same as in
+// Go apart from TOML not having octal and \x escapes.
+func unescape(s string) (string, error) {
+	var quoted strings.Builder
+
+	quoted.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			quoted.WriteByte(c)
+			if i+1 < len(s) {
+				i++
+				quoted.WriteByte(s[i])
+			}
+		case '"':
+			quoted.WriteString(`\"`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+
+	out, err := strconv.Unquote(quoted.String())
+	if err != nil {
+		return "", fmt.Errorf("invalid escape in string `%v`", s)
+	}
+	return out, nil
+}
+
+// stripComment cuts a `#` comment off the line, unless it's within a string.
+func stripComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// EOF
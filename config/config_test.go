@@ -0,0 +1,162 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/zimmra/omada-to-ntfy/config"
+)
+
+func TestParse(t *testing.T) {
+	env := map[string]string{"OMADA_SECRET": "s3cret", "NTFY_HOST": "ntfy.example.com"}
+	getenv := func(key string) string { return env[key] }
+
+	data := `# The bridge configuration
+omada_shared_secret = "${OMADA_SECRET}"
+port = 8_080
+log-payloads = false  # Keep them out of the logs
+
+[ntfy]
+url = "https://${NTFY_HOST}/path#not-a-comment"
+topic = "omada ${TOPIC:-alerts}"
+password = 'pa$${taken}${as-is}'
+min_priority = 7
+types = [ "offline", 'online' ]
+
+[generic_webhook]
+headers = "{\"Authorization\": \"Bearer $$TOKEN\"}"
+body = """
+{"title": {{json .Title}},
+ "line": "one\ttwo"}"""
+
+[mqtt.discovery]
+prefix = '''
+home${assistant}'''
+`
+
+	want := config.Config{
+		"OMADA_SHARED_SECRET":     "s3cret",
+		"PORT":                    "8080",
+		"LOG_PAYLOADS":            "false",
+		"NTFY_URL":                "https://ntfy.example.com/path#not-a-comment",
+		"NTFY_TOPIC":              "omada alerts",
+		"NTFY_PASSWORD":           "pa$${taken}${as-is}",
+		"NTFY_MIN_PRIORITY":       "7",
+		"NTFY_TYPES":              "offline,online",
+		"GENERIC_WEBHOOK_HEADERS": `{"Authorization": "Bearer $TOKEN"}`,
+		"GENERIC_WEBHOOK_BODY":    "{\"title\": {{json .Title}},\n \"line\": \"one\ttwo\"}",
+		"MQTT_DISCOVERY_PREFIX":   "home${assistant}",
+	}
+
+	got, err := config.Parse(data, getenv)
+	if err != nil {
+		t.Fatalf("Parse() returned an unexpected error: %v", err)
+	}
+
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		err  string
+	}{
+		"Unquoted string":       {"topic = alerts", "line 1: invalid value `alerts`; strings need quotes"},
+		"Set twice":             {"[ntfy]\ntopic = 'a'\n\ntopic = 'b'", "line 4: NTFY_TOPIC is set twice"},
+		"Not a key":             {"port 8080", "line 1: expected a `key = value` or a `[table]`"},
+		"Unclosed string":       {`topic = "alerts`, "line 1: string is not closed"},
+		"Unclosed multi-line":   {"\nbody = \"\"\"\n{}\n", "line 2: multi-line string is not closed"},
+		"Junk after value":      {"port = 8080 8081", "line 1: unexpected `8081` after the value"},
+		"Missing variable":      {`secret = "${NOT_SET}"`, "line 1: environment variable NOT_SET is not set"},
+		"Multi-line array":      {"types = [\n'offline']", "line 1: arrays must be on one line"},
+		"Array without a comma": {"types = ['a' 'b']", "line 1: expected a `,` between array items"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := config.Parse(test.data, func(string) string { return "" })
+			if err == nil || err.Error() != test.err {
+				t.Errorf("Expected error `%v`, got `%v`", test.err, err)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("No file configures nothing", func(t *testing.T) {
+		c, err := config.Load("")
+		if err != nil || len(c) != 0 {
+			t.Errorf("Expected an empty config, got %v, %v", c, err)
+		}
+	})
+
+	t.Run("Environment overrides the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		os.WriteFile(path, []byte("port = 8080\n[ntfy]\ntopic = 'from-file'\n"), 0o600)
+
+		t.Setenv("NTFY_TOPIC", "from-env")
+
+		c, err := config.Load(path)
+		if err != nil {
+			t.Fatalf("Load() returned an unexpected error: %v", err)
+		}
+
+		if c.Getenv("NTFY_TOPIC") != "from-env" || c.Getenv("PORT") != "8080" {
+			t.Errorf("Unexpected settings: NTFY_TOPIC=%v PORT=%v", c.Getenv("NTFY_TOPIC"), c.Getenv("PORT"))
+		}
+	})
+
+	t.Run("Secrets are read from files", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "ntfy"), []byte("from-secret-file\n"), 0o600)
+		os.WriteFile(filepath.Join(dir, "omada"), []byte("omada-secret"), 0o600)
+		os.WriteFile(filepath.Join(dir, "history"), []byte("not a secret"), 0o600)
+
+		path := filepath.Join(dir, "config.toml")
+		os.WriteFile(path, []byte("history_file = '"+filepath.Join(dir, "history")+"'\n[ntfy]\npassword = 'from-file'\npassword_file = '"+filepath.Join(dir, "ntfy")+"'\n"), 0o600)
+
+		t.Setenv("OMADA_SHARED_SECRET_FILE", filepath.Join(dir, "omada"))
+
+		c, err := config.Load(path)
+		if err != nil {
+			t.Fatalf("Load() returned an unexpected error: %v", err)
+		}
+
+		if got := c.Getenv("NTFY_PASSWORD"); got != "from-secret-file" {
+			t.Errorf("NTFY_PASSWORD = %q, want the content of its file", got)
+		}
+		if got := c.Getenv("OMADA_SHARED_SECRET"); got != "omada-secret" {
+			t.Errorf("OMADA_SHARED_SECRET = %q, want the content of the file named in the environment", got)
+		}
+		if got := c.Getenv("HISTORY"); got != "" {
+			t.Errorf("HISTORY = %q, want only secrets read from files", got)
+		}
+
+		t.Setenv("NTFY_PASSWORD", "from-env")
+		if got := c.Getenv("NTFY_PASSWORD"); got != "from-env" {
+			t.Errorf("NTFY_PASSWORD = %q, want the environment to take precedence", got)
+		}
+
+		t.Setenv("OMADA_SHARED_SECRET_FILE", filepath.Join(dir, "missing"))
+		if _, err := config.Load(path); err == nil || !strings.HasPrefix(err.Error(), "OMADA_SHARED_SECRET_FILE: ") {
+			t.Errorf("Expected an error naming the setting for a missing secret file, got %v", err)
+		}
+	})
+
+	t.Run("Errors name the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		os.WriteFile(path, []byte("port = eighty"), 0o600)
+
+		_, err := config.Load(path)
+		if err == nil || !strings.HasPrefix(err.Error(), "config file "+path+": line 1") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,54 @@
+// Package dashboard serves a small web UI, embedded in the binary, showing
+// the recent events, the state of devices and failed deliveries, so they can
+// be followed without access to ntfy.
+package dashboard
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard. It gets its data from the `/api` endpoints,
+// relative to the path the dashboard is served at, e.g. `/dashboard/`.
+func Handler() http.Handler {
+	files, _ := fs.Sub(static, "static")
+	return http.FileServerFS(files)
+}
+
+// Auth requires the admin credentials (HTTP basic authentication) for every
+// request before handing it on to Next.
+type Auth struct {
+	Username string
+	Password string
+	Next     http.Handler
+}
+
+func (a *Auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+
+	// Compare hashes so neither the length nor the content leaks through timing
+	hash := func(s string) []byte {
+		sum := sha256.Sum256([]byte(s))
+		return sum[:]
+	}
+
+	userOK := subtle.ConstantTimeCompare(hash(username), hash(a.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(hash(password), hash(a.Password)) == 1
+
+	if !ok || !userOK || !passOK {
+		w.Header().Set("WWW-Authenticate", `Basic realm="omada-to-ntfy", charset="UTF-8"`)
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("X-Frame-Options", "DENY")
+	a.Next.ServeHTTP(w, r)
+}
+
+// EOF
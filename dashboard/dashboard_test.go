@@ -0,0 +1,71 @@
+package dashboard_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/dashboard"
+)
+
+func TestHandler(t *testing.T) {
+	h := dashboard.Handler()
+
+	for path, want := range map[string]string{
+		"/":          "<title>omada-to-ntfy</title>",
+		"/app.js":    "async function refresh()",
+		"/style.css": "--offline",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("GET %v = %d, missing `%v`", path, w.Code, want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	auth := &dashboard.Auth{
+		Username: "admin",
+		Password: "hunter2",
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("welcome"))
+		}),
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		code     int
+	}{
+		{"No credentials", "", "", http.StatusUnauthorized},
+		{"Wrong password", "admin", "hunter3", http.StatusUnauthorized},
+		{"Wrong username", "root", "hunter2", http.StatusUnauthorized},
+		{"Right credentials", "admin", "hunter2", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.username != "" {
+				r.SetBasicAuth(tt.username, tt.password)
+			}
+
+			w := httptest.NewRecorder()
+			auth.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, w.Code)
+			}
+
+			if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("Expected a basic authentication challenge, got `%v`", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// EOF
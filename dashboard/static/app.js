@@ -0,0 +1,155 @@
+"use strict";
+
+// How often the dashboard is refreshed, in milliseconds
+const refreshInterval = 10000;
+
+const api = "../api";
+
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text ?? "";
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function fill(id, rows) {
+  const table = document.getElementById(id);
+  const tbody = table.querySelector("tbody");
+
+  tbody.replaceChildren(...rows.map((cells) => {
+    const tr = document.createElement("tr");
+    tr.append(...cells);
+    return tr;
+  }));
+
+  table.hidden = rows.length === 0;
+  table.parentElement.querySelector(".empty").hidden = rows.length !== 0;
+}
+
+function formatTime(time) {
+  return new Date(time).toLocaleString();
+}
+
+function formatDuration(since, until = Date.now()) {
+  let seconds = Math.max(0, Math.floor((new Date(until) - new Date(since)) / 1000));
+  const parts = [];
+
+  for (const [unit, size] of [["d", 86400], ["h", 3600], ["m", 60]]) {
+    if (seconds >= size) {
+      parts.push(Math.floor(seconds / size) + unit);
+      seconds %= size;
+    }
+  }
+
+  return parts.length ? parts.slice(0, 2).join(" ") : "just now";
+}
+
+async function get(path) {
+  const response = await fetch(api + path, { cache: "no-store" });
+  if (!response.ok) {
+    throw new Error(`${path}: ${response.status} ${response.statusText}`);
+  }
+  return response.json();
+}
+
+// A cell with the button to acknowledge an outage, which stops reminders
+function acknowledgeCell(s) {
+  if (s.acknowledged) {
+    return cell("Acknowledged " + formatTime(s.acknowledged), "time");
+  }
+
+  const button = document.createElement("button");
+  button.textContent = "Acknowledge";
+  button.addEventListener("click", async () => {
+    // By its ID, as the device may be redacted beyond recognition
+    const params = new URLSearchParams({ id: s.id });
+
+    button.disabled = true;
+    try {
+      const response = await fetch(`${api}/state/ack?${params}`, { method: "POST" });
+      if (!response.ok) {
+        throw new Error(`${response.status} ${(await response.text()).trim() || response.statusText}`);
+      }
+      refresh();
+    } catch (err) {
+      button.disabled = false;
+      button.title = err.message;
+      document.getElementById("updated").textContent = "Could not acknowledge: " + err.message;
+    }
+  });
+
+  const td = cell();
+  td.append(button);
+  return td;
+}
+
+function where(e) {
+  return e.site ? `${e.controller} / ${e.site}` : e.controller;
+}
+
+async function refresh() {
+  try {
+    const [recent, failures, states, heartbeats] = await Promise.all([
+      get("/events?limit=50"),
+      get("/events?status=failed&limit=20"),
+      get("/state"),
+      get("/heartbeats"),
+    ]);
+
+    fill("outages", states.states.filter((s) => s.state === "offline").map((s) => [
+      cell(s.device),
+      cell(s.interface),
+      cell(where(s)),
+      cell(formatTime(s.since), "time"),
+      cell(formatDuration(s.since), "offline"),
+      acknowledgeCell(s),
+    ]));
+
+    fill("devices", states.states.map((s) => [
+      cell(s.device),
+      cell(s.interface),
+      cell(where(s)),
+      cell(s.state, s.state),
+      cell(formatTime(s.since), "time"),
+    ]));
+
+    fill("controllers", heartbeats.controllers.map((c) => [
+      cell(c.controller),
+      cell(c.last_seen ? formatTime(c.last_seen) : "Never", "time"),
+      cell(c.interval),
+      c.silent ? cell("silent", "offline") : cell("ok", "online"),
+      cell(c.silent ? formatDuration(c.since) : ""),
+    ]));
+
+    fill("silences", heartbeats.silences.map((s) => [
+      cell(s.controller),
+      cell(formatTime(s.from), "time"),
+      cell(formatTime(s.to), "time"),
+      cell(formatDuration(s.from, s.to)),
+    ]));
+
+    fill("failures", failures.events.map((e) => [
+      cell(formatTime(e.received), "time"),
+      cell(e.title),
+      cell(e.type, e.type),
+      cell(e.error, "failed"),
+    ]));
+
+    fill("events", recent.events.map((e) => [
+      cell(formatTime(e.received), "time"),
+      cell(e.type, e.type),
+      cell(e.title),
+      cell((e.text?.length ? e.text : [e.description]).join("\n"), "message"),
+      cell(e.status, e.status),
+    ]));
+
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  } catch (err) {
+    document.getElementById("updated").textContent = "Could not update: " + err.message;
+  }
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,237 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// The ways of securing the connection to the SMTP server.
+const (
+	SecuritySTARTTLS = "starttls" // Upgrade a plaintext connection, usually on port 587
+	SecurityTLS      = "tls"      // Implicit TLS from the start, usually on port 465
+	SecurityNone     = "none"     // No encryption at all, only sensible for a local relay
+)
+
+type EmailClient struct {
+	Host      string
+	Port      string
+	Username  string
+	Password  string
+	From      string
+	To        []string
+	Security  string      // One of the Security* constants, defaults to STARTTLS
+	TLSConfig *tls.Config // Optional; when nil the system roots verify Host
+	Logger    *slog.Logger
+}
+
+// Subject derives the email subject from the message title, without the
+// dangling separator a title gets when the site is unknown.
+func Subject(payload *omada.OmadaMessage) string {
+	return strings.TrimSuffix(strings.TrimSpace(payload.Title()), ":")
+}
+
+var htmlBody = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+<h2>{{.Subject}}</h2>
+{{range .Lines}}<p>{{.}}</p>
+{{end}}<table cellpadding="4">
+{{range .Fields}}<tr><th align="left">{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// render builds the complete email, with headers and the message as both a
+// plain text and an HTML alternative.
+func (ec *EmailClient) render(payload *omada.OmadaMessage) ([]byte, error) {
+	var msg bytes.Buffer
+
+	mw := multipart.NewWriter(&msg)
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", ec.From)
+	header.Set("To", strings.Join(ec.To, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", Subject(payload)))
+	header.Set("Date", payload.Date().Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+
+	for _, key := range []string{"From", "To", "Subject", "Date", "MIME-Version", "Content-Type"} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, header.Get(key))
+	}
+	msg.WriteString("\r\n")
+
+	lines := strings.Split(strings.ReplaceAll(payload.Body(), "\r", ""), "\n")
+
+	var html bytes.Buffer
+	err := htmlBody.Execute(&html, map[string]any{
+		"Subject": Subject(payload),
+		"Lines":   lines,
+		"Fields": [][2]string{
+			{"Controller", payload.Controller},
+			{"Site", payload.Site},
+			{"Device", payload.Device()},
+			{"Type", payload.Type().String()},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", strings.Join(lines, "\n")},
+		{"text/html; charset=utf-8", html.String()},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		qw.Close()
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+// Send emails the message to all recipients using the provided payload
+func (ec *EmailClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	if len(ec.To) == 0 {
+		return errors.New("email has no recipients")
+	}
+
+	msg, err := ec.render(payload)
+	if err != nil {
+		ec.Logger.ErrorContext(ctx, "Could not render email", "error", err)
+		return err
+	}
+
+	if err := ec.deliver(ctx, msg); err != nil {
+		ec.Logger.ErrorContext(ctx, "Could not send email", "error", err)
+		return err
+	}
+
+	ec.Logger.InfoContext(ctx, "Email sent", "recipients", len(ec.To))
+	return nil
+}
+
+// conversationTimeout limits the SMTP conversation when the context doesn't.
+const conversationTimeout = time.Minute
+
+// deadline returns the deadline of the context, or the fallback when it has
+// none or a later one.
+func deadline(ctx context.Context, fallback time.Time) time.Time {
+	if d, ok := ctx.Deadline(); ok && d.Before(fallback) {
+		return d
+	}
+	return fallback
+}
+
+// deliver hands the rendered email to the SMTP server.
+func (ec *EmailClient) deliver(ctx context.Context, msg []byte) error {
+	addr := net.JoinHostPort(ec.Host, ec.Port)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	tlsConfig := ec.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: ec.Host}
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if ec.Security == SecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The whole conversation, so a server that stops answering can't hold
+	// up the delivery
+	conn.SetDeadline(deadline(ctx, time.Now().Add(conversationTimeout)))
+
+	c, err := smtp.NewClient(conn, ec.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ec.Security == "" || ec.Security == SecuritySTARTTLS {
+		// Never fall back to plaintext when STARTTLS was asked for
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if ec.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", ec.Username, ec.Password, ec.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(ec.From); err != nil {
+		return err
+	}
+
+	for _, to := range ec.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// EOF
@@ -0,0 +1,240 @@
+package email_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/email"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// smtpStandIn is a minimal SMTP server, just capable enough to receive a
+// single email from net/smtp and record what it was told.
+type smtpStandIn struct {
+	listener   net.Listener
+	recipients []string
+	auth       string
+	data       string
+	done       chan struct{}
+}
+
+func newSMTPStandIn(t *testing.T, extensions ...string) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	s := &smtpStandIn{listener: listener, done: make(chan struct{})}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		defer close(s.done)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+		reply("220 localhost ESMTP stand-in")
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			switch verb {
+			case "EHLO":
+				reply("250-localhost")
+				for _, ext := range extensions {
+					reply("250-" + ext)
+				}
+				reply("250 8BITMIME")
+			case "AUTH":
+				s.auth = line
+				reply("235 Authentication successful")
+			case "MAIL":
+				reply("250 OK")
+			case "RCPT":
+				s.recipients = append(s.recipients, line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				s.data = data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *smtpStandIn) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+func TestSubject(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *omada.OmadaMessage
+		want string
+	}{
+		{"Controller and site", &omada.OmadaMessage{Controller: "Controller", Site: "Site"}, "Controller: Site"},
+		{"Test message", &omada.OmadaMessage{Description: "This is a webhook test message. Please ignore this"}, "Omada Webhook Test"},
+	}
+
+	for _, tt := range tests {
+		if got := email.Subject(tt.msg); got != tt.want {
+			t.Errorf("%s: Subject() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEmailClientSend(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	msg := &omada.OmadaMessage{
+		Controller: "Omada_Controller",
+		Site:       "Offline Site",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r"},
+		Timestamp:  1758852904877,
+	}
+
+	t.Run("Delivers a multipart email to every recipient", func(t *testing.T) {
+		server := newSMTPStandIn(t, "AUTH PLAIN")
+
+		client := email.EmailClient{
+			Host:     "127.0.0.1",
+			Port:     server.port(),
+			Username: "user",
+			Password: "pass",
+			From:     "omada@example.com",
+			To:       []string{"noc@example.com", "helpdesk@example.com"},
+			Security: email.SecurityNone,
+			Logger:   logger,
+		}
+
+		if err := client.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v; log is %v", err, buf.String())
+		}
+		<-server.done
+
+		if len(server.recipients) != 2 {
+			t.Errorf("Expected 2 recipients, got %v", server.recipients)
+		}
+
+		if !strings.HasPrefix(server.auth, "AUTH PLAIN") {
+			t.Errorf("Expected PLAIN authentication, got %q", server.auth)
+		}
+
+		parsed, err := mail.ReadMessage(strings.NewReader(server.data))
+		if err != nil {
+			t.Fatalf("Could not parse the email: %v", err)
+		}
+
+		if got := parsed.Header.Get("Subject"); got != "Omada_Controller: Offline Site" {
+			t.Errorf("Subject = %q", got)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("Content-Type = %q, %v", mediaType, err)
+		}
+
+		var types []string
+		mr := multipart.NewReader(parsed.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			content, _ := io.ReadAll(part)
+			if !strings.Contains(string(content), "was offline.") {
+				t.Errorf("Part %s does not contain the message: %s", part.Header.Get("Content-Type"), content)
+			}
+
+			types = append(types, part.Header.Get("Content-Type"))
+		}
+
+		if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+			t.Errorf("Expected a plain text and an HTML part, got %v", types)
+		}
+	})
+
+	t.Run("Refuses to continue without STARTTLS", func(t *testing.T) {
+		server := newSMTPStandIn(t)
+
+		client := email.EmailClient{
+			Host:   "127.0.0.1",
+			Port:   server.port(),
+			From:   "omada@example.com",
+			To:     []string{"noc@example.com"},
+			Logger: logger,
+		}
+
+		if err := client.Send(context.Background(), msg); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+			t.Errorf("Send() error = %v, want a STARTTLS error", err)
+		}
+	})
+
+	t.Run("Gives up on a server that doesn't answer at the deadline", func(t *testing.T) {
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+
+		client := email.EmailClient{
+			Host:     "127.0.0.1",
+			Port:     (&smtpStandIn{listener: silent}).port(),
+			From:     "omada@example.com",
+			To:       []string{"noc@example.com"},
+			Security: email.SecurityNone,
+			Logger:   logger,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if err := client.Send(ctx, msg); err == nil || time.Since(start) > 5*time.Second {
+			t.Errorf("Expected Send() to give up at the deadline, got %v after %v", err, time.Since(start))
+		}
+	})
+}
+
+// EOF
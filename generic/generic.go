@@ -0,0 +1,200 @@
+// Package generic delivers Omada events to any HTTP endpoint, with the
+// request described by Go templates over the normalised omada.Event.
+package generic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// The defaults for the parts of the request left empty.
+const (
+	DefaultMethod          = "POST"
+	DefaultBody            = "{{json .}}"
+	DefaultSignatureHeader = "X-Signature-256"
+)
+
+type WebhookClient struct {
+	Method          string            // Template, defaults to DefaultMethod
+	URL             string            // Template
+	Headers         map[string]string // Header values are templates
+	Body            string            // Template, defaults to DefaultBody
+	Secret          string            // When set the body is signed with HMAC-SHA256
+	SignatureHeader string            // Defaults to DefaultSignatureHeader
+	Client          *http.Client      // Optional; defaults to an http.Client with a 30 second timeout
+	Logger          *slog.Logger
+}
+
+// Functions available in the templates on top of the builtin ones, e.g.
+// `{"text": {{json .Body}}}` to safely embed a string in a JSON body.
+var funcs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// Sign returns the signature of the body as it's put in the signature
+// header: `sha256=` followed by the hex encoded HMAC-SHA256 of the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type templates struct {
+	method  *template.Template
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+func (wc *WebhookClient) parse() (*templates, error) {
+	parse := func(name string, text string, fallback string) (*template.Template, error) {
+		if text == "" {
+			text = fallback
+		}
+
+		t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %w", name, err)
+		}
+
+		return t, nil
+	}
+
+	var (
+		t   = &templates{headers: map[string]*template.Template{}}
+		err error
+	)
+
+	if t.method, err = parse("method", wc.Method, DefaultMethod); err != nil {
+		return nil, err
+	}
+
+	if t.url, err = parse("URL", wc.URL, ""); err != nil {
+		return nil, err
+	}
+
+	if t.body, err = parse("body", wc.Body, DefaultBody); err != nil {
+		return nil, err
+	}
+
+	for name, value := range wc.Headers {
+		if t.headers[name], err = parse("header "+name, value, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// Validate checks that all templates parse, so mistakes are found at
+// startup rather than on the first message.
+func (wc *WebhookClient) Validate() error {
+	_, err := wc.parse()
+	return err
+}
+
+// Render builds the HTTP request for the message by executing the templates,
+// including the signature header when a secret is set.
+func (wc *WebhookClient) Render(ctx context.Context, payload *omada.OmadaMessage) (*http.Request, error) {
+	t, err := wc.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	event := payload.Event()
+
+	execute := func(tmpl *template.Template) (string, error) {
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, event)
+		return buf.String(), err
+	}
+
+	method, err := execute(t.method)
+	if err != nil {
+		return nil, err
+	}
+
+	url, err := execute(t.url)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := execute(t.body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(strings.TrimSpace(method)), strings.TrimSpace(url), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for name, tmpl := range t.headers {
+		value, err := execute(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, value)
+	}
+
+	if wc.Secret != "" {
+		header := wc.SignatureHeader
+		if header == "" {
+			header = DefaultSignatureHeader
+		}
+		req.Header.Set(header, Sign(wc.Secret, []byte(body)))
+	}
+
+	return req, nil
+}
+
+// Send sends a message to the configured endpoint using the provided payload
+func (wc *WebhookClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	req, err := wc.Render(ctx, payload)
+	if err != nil {
+		wc.Logger.ErrorContext(ctx, "Could not render webhook request", "error", err)
+		return err
+	}
+
+	client := wc.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		wc.Logger.ErrorContext(ctx, "Could not send webhook request", "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		wc.Logger.ErrorContext(ctx, "Webhook returned non-success status code", "status", resp.StatusCode)
+		return fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+
+	wc.Logger.InfoContext(ctx, "Message sent to webhook")
+	return nil
+}
+
+// EOF
@@ -0,0 +1,124 @@
+package generic_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/generic"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+func TestSign(t *testing.T) {
+	// Test vector from the GitHub webhook documentation
+	got := generic.Sign("It's a Secret to Everybody", []byte("Hello, World!"))
+	want := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+
+	if got != want {
+		t.Errorf("Sign() = %v, want %v", got, want)
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	msg := &omada.OmadaMessage{
+		Controller: "Omada_Controller",
+		Site:       "Offline \"Site\"",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r"},
+		Timestamp:  1758852904877,
+	}
+
+	t.Run("Defaults to POSTing the event as JSON", func(t *testing.T) {
+		var event omada.Event
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("Method = %v, want POST", r.Method)
+			}
+			raw, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(raw, &event); err != nil {
+				t.Errorf("Body is not the JSON event: %v", err)
+			}
+		}))
+		defer server.Close()
+
+		client := generic.WebhookClient{URL: server.URL, Logger: logger}
+
+		if err := client.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+
+		if event.Type != "offline" || event.DeviceMAC != "98-03-8E-3A-8D-53" {
+			t.Errorf("Unexpected event received: %+v", event)
+		}
+	})
+
+	t.Run("Renders all templates and signs the body", func(t *testing.T) {
+		client := generic.WebhookClient{
+			Method:  "{{if eq .Type \"test\"}}GET{{else}}put{{end}}",
+			URL:     "https://alerts.example.com/{{.Type}}?site={{urlquery .Site}}",
+			Headers: map[string]string{"X-Priority": "{{.Priority}}"},
+			Body:    `{"summary": {{json .Title}}, "lines": {{json .Text}}}`,
+			Secret:  "s3cret",
+			Logger:  logger,
+		}
+
+		req, err := client.Render(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("Render() returned an unexpected error: %v", err)
+		}
+
+		if req.Method != http.MethodPut {
+			t.Errorf("Method = %v, want PUT", req.Method)
+		}
+
+		if req.URL.String() != "https://alerts.example.com/offline?site=Offline+%22Site%22" {
+			t.Errorf("URL = %v", req.URL)
+		}
+
+		if req.Header.Get("X-Priority") != "10" {
+			t.Errorf("X-Priority = %v, want 10", req.Header.Get("X-Priority"))
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		if !json.Valid(body) {
+			t.Errorf("Body is not valid JSON: %s", body)
+		}
+
+		if got, want := req.Header.Get(generic.DefaultSignatureHeader), generic.Sign("s3cret", body); got != want {
+			t.Errorf("Signature = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Rejects invalid templates", func(t *testing.T) {
+		client := generic.WebhookClient{URL: "https://example.com", Body: "{{.Title", Logger: logger}
+
+		if err := client.Validate(); err == nil {
+			t.Error("Validate() should fail on an unterminated template action")
+		}
+	})
+
+	t.Run("Returns an error on a non-success status code", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Nope", http.StatusBadGateway)
+		}))
+		defer server.Close()
+
+		client := generic.WebhookClient{URL: server.URL, Logger: logger}
+
+		if err := client.Send(context.Background(), msg); err == nil {
+			t.Error("Send() should fail when the endpoint rejects the request")
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,119 @@
+package gotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+type GotifyClient struct {
+	GotifyURL string
+	AppToken  string
+	Client    *http.Client // Optional; defaults to an http.Client with a 30 second timeout
+	Logger    *slog.Logger
+}
+
+// The JSON structure Gotify expects on its /message endpoint, see
+// https://gotify.net/api-docs#/message/createMessage
+type gotifyMessage struct {
+	Title    string         `json:"title"`
+	Message  string         `json:"message"`
+	Priority int            `json:"priority"`
+	Extras   map[string]any `json:"extras,omitempty"`
+}
+
+// MarkdownBody renders the message body so it keeps its line breaks when
+// Gotify displays it as Markdown; a plain newline would be folded away.
+func MarkdownBody(payload *omada.OmadaMessage) string {
+	lines := strings.Split(payload.Body(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	return strings.Join(lines, "  \n")
+}
+
+// Send sends a message to Gotify using the provided payload. Omada priorities
+// are already on the Gotify scale (0-10) so they are passed through as-is.
+func (gc *GotifyClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	url := fmt.Sprintf("%s/message", strings.TrimSuffix(gc.GotifyURL, "/"))
+
+	body, err := json.Marshal(gotifyMessage{
+		Title:    payload.Title(),
+		Message:  MarkdownBody(payload),
+		Priority: payload.Priority(),
+		Extras: map[string]any{
+			"client::display": map[string]string{"contentType": "text/markdown"},
+		},
+	})
+	if err != nil {
+		gc.Logger.ErrorContext(ctx, "Could not encode Gotify message", "error", err)
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		gc.Logger.ErrorContext(ctx, "Could not create Gotify request", "error", err)
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", gc.AppToken)
+
+	client := gc.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		gc.Logger.ErrorContext(ctx, "Could not send message to Gotify", "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		gc.Logger.ErrorContext(ctx, "Gotify returned non-success status code", "status", resp.StatusCode)
+		return fmt.Errorf("gotify returned status code %d", resp.StatusCode)
+	}
+
+	gc.Logger.InfoContext(ctx, "Message sent to Gotify")
+	return nil
+}
+
+// Check tells whether the Gotify server is reachable and healthy, using its
+// health endpoint.
+func (gc *GotifyClient) Check(ctx context.Context) error {
+	url := fmt.Sprintf("%s/health", strings.TrimSuffix(gc.GotifyURL, "/"))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := gc.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("gotify health check returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// EOF
@@ -0,0 +1,100 @@
+package gotify_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/gotify"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+func TestMarkdownBody(t *testing.T) {
+	msg := &omada.OmadaMessage{
+		Text: []string{"First line.\r", "Second line.\r"},
+	}
+
+	got := gotify.MarkdownBody(msg)
+	want := "First line.  \nSecond line."
+
+	if got != want {
+		t.Errorf("MarkdownBody() = %q, want %q", got, want)
+	}
+}
+
+func TestGotifyClientSend(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	msg := &omada.OmadaMessage{
+		Controller: "Omada_Controller",
+		Site:       "Offline Site",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r"},
+	}
+
+	t.Run("Delivers the message with token, priority and Markdown extras", func(t *testing.T) {
+		var (
+			gotPath  string
+			gotToken string
+			gotBody  map[string]any
+		)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			gotToken = r.Header.Get("X-Gotify-Key")
+			raw, _ := io.ReadAll(r.Body)
+			_ = json.Unmarshal(raw, &gotBody)
+		}))
+		defer server.Close()
+
+		client := gotify.GotifyClient{GotifyURL: server.URL + "/", AppToken: "app-token", Logger: logger}
+
+		if err := client.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+
+		if gotPath != "/message" {
+			t.Errorf("Posted to %q, want /message", gotPath)
+		}
+
+		if gotToken != "app-token" {
+			t.Errorf("X-Gotify-Key = %q, want app-token", gotToken)
+		}
+
+		if gotBody["title"] != "Omada_Controller: Offline Site" {
+			t.Errorf("title = %v", gotBody["title"])
+		}
+
+		if gotBody["priority"] != float64(10) {
+			t.Errorf("priority = %v, want the native Omada priority 10", gotBody["priority"])
+		}
+
+		extras, _ := gotBody["extras"].(map[string]any)
+		display, _ := extras["client::display"].(map[string]any)
+		if display["contentType"] != "text/markdown" {
+			t.Errorf("extras = %v, want Markdown content type", gotBody["extras"])
+		}
+	})
+
+	t.Run("Returns an error on a non-success status code", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}))
+		defer server.Close()
+
+		client := gotify.GotifyClient{GotifyURL: server.URL, AppToken: "wrong", Logger: logger}
+
+		if err := client.Send(context.Background(), msg); err == nil {
+			t.Error("Send() should fail when Gotify rejects the message")
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,133 @@
+// Package health answers the liveness and readiness probes of Docker and
+// Kubernetes, without needing the shared secret the webhook requires.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/webhook"
+)
+
+// Defaults for the readiness checks.
+const (
+	DefaultTimeout     = 5 * time.Second
+	DefaultMaxInFlight = 20
+)
+
+const statusOK = "ok"
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeResponse(w http.ResponseWriter, code int, res response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Healthz answers that the process is alive; if it can answer at all, it is.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, response{Status: statusOK})
+}
+
+// Readiness answers whether the bridge is ready to take webhooks: it must be
+// configured, every notification service that can be checked must be
+// reachable, and deliveries must not be piling up.
+type Readiness struct {
+	Server      *webhook.WebhookServer
+	Timeout     time.Duration // Defaults to DefaultTimeout
+	MaxInFlight int64         // Defaults to DefaultMaxInFlight
+}
+
+// Check runs all readiness checks, returning the outcome of each and whether
+// all of them passed.
+func (rd *Readiness) Check(ctx context.Context) (map[string]string, bool) {
+	checks := map[string]string{}
+	ready := true
+
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+
+	if rd.Server == nil || rd.Server.Notifier == nil || rd.Server.SharedSecret == "" {
+		fail("config", fmt.Errorf("not configured"))
+		return checks, ready
+	}
+	checks["config"] = statusOK
+
+	maxInFlight := rd.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = DefaultMaxInFlight
+	}
+
+	if inFlight := rd.Server.Metrics.InFlight(); inFlight >= maxInFlight {
+		fail("deliveries", fmt.Errorf("%d deliveries in progress", inFlight))
+	} else {
+		checks["deliveries"] = statusOK
+	}
+
+	notifiers, ok := rd.Server.Notifier.(notifier.Multi)
+	if !ok {
+		notifiers = notifier.Multi{rd.Server.Notifier}
+	}
+
+	timeout := rd.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for _, n := range notifiers {
+		checker, ok := notifier.Unwrap(n).(notifier.Checker)
+		if !ok {
+			continue
+		}
+
+		wg.Go(func() {
+			err := checker.Check(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				fail(notifier.Name(n), err)
+			} else {
+				checks[notifier.Name(n)] = statusOK
+			}
+		})
+	}
+
+	wg.Wait()
+
+	return checks, ready
+}
+
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	checks, ready := rd.Check(r.Context())
+
+	if !ready {
+		writeResponse(w, http.StatusServiceUnavailable, response{Status: "unavailable", Checks: checks})
+		return
+	}
+
+	writeResponse(w, http.StatusOK, response{Status: statusOK, Checks: checks})
+}
+
+// EOF
@@ -0,0 +1,113 @@
+package health_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/health"
+	"github.com/zimmra/omada-to-ntfy/metrics"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/webhook"
+)
+
+type probeResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func probe(t *testing.T, handler http.Handler, path string) (int, probeResponse) {
+	t.Helper()
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var res probeResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Response is not JSON: %v", response.Body.String())
+	}
+
+	return response.Code, res
+}
+
+func TestHealthz(t *testing.T) {
+	code, res := probe(t, http.HandlerFunc(health.Healthz), "/healthz")
+
+	if code != http.StatusOK || res.Status != "ok" {
+		t.Errorf("Healthz answered %d %+v", code, res)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	healthy := true
+	ntfyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health" || !healthy {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"healthy":true}`))
+	}))
+	defer ntfyServer.Close()
+
+	m := metrics.New()
+
+	server := &webhook.WebhookServer{
+		Notifier: notifier.Multi{
+			notifier.Measured{Notifier: &ntfy.NtfyClient{NtfyURL: ntfyServer.URL, Topic: "test", Logger: logger}, Name: "ntfy", Metrics: m},
+		},
+		SharedSecret: "secret",
+		Metrics:      m,
+		Logger:       logger,
+	}
+
+	readiness := &health.Readiness{Server: server, MaxInFlight: 1}
+
+	t.Run("Ready when configured and ntfy is reachable", func(t *testing.T) {
+		code, res := probe(t, readiness, "/readyz")
+
+		if code != http.StatusOK || res.Checks["config"] != "ok" || res.Checks["ntfy"] != "ok" || res.Checks["deliveries"] != "ok" {
+			t.Errorf("Readiness answered %d %+v", code, res)
+		}
+	})
+
+	t.Run("Not ready when ntfy is unhealthy", func(t *testing.T) {
+		healthy = false
+		defer func() { healthy = true }()
+
+		code, res := probe(t, readiness, "/readyz")
+
+		if code != http.StatusServiceUnavailable || res.Checks["ntfy"] == "ok" {
+			t.Errorf("Readiness answered %d %+v", code, res)
+		}
+	})
+
+	t.Run("Not ready when deliveries pile up", func(t *testing.T) {
+		done := m.StartDelivery("ntfy")
+		defer done(nil)
+
+		code, res := probe(t, readiness, "/readyz")
+
+		if code != http.StatusServiceUnavailable || res.Checks["deliveries"] == "ok" {
+			t.Errorf("Readiness answered %d %+v", code, res)
+		}
+	})
+
+	t.Run("Not ready without configuration", func(t *testing.T) {
+		code, res := probe(t, &health.Readiness{}, "/readyz")
+
+		if code != http.StatusServiceUnavailable || res.Checks["config"] == "ok" {
+			t.Errorf("Readiness answered %d %+v", code, res)
+		}
+	})
+}
+
+// EOF
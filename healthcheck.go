@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/config"
+)
+
+// Healthcheck probes the health endpoint of a running server and returns the
+// exit code for the result. It stands in for curl in the Docker HEALTHCHECK,
+// as the scratch image has nothing but this binary.
+func Healthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	ready := fs.Bool("ready", false, "probe /readyz instead of /healthz")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for an answer")
+	url := fs.String("url", "", "the URL to probe (default http://127.0.0.1:$PORT/healthz, or https with TLS_CERT_FILE)")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	insecure := false
+	if *url == "" {
+		// Without a usable config file the port can still be in the environment
+		cfg, _ := config.Load(os.Getenv("CONFIG_FILE"))
+		port := cfg.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+
+		path := "/healthz"
+		if *ready {
+			path = "/readyz"
+		}
+
+		*url = "http://127.0.0.1:" + port + path
+
+		if cfg.Getenv("TLS_CERT_FILE") != "" {
+			// The certificate is for the name the server is known by, which
+			// isn't 127.0.0.1, and it's only the server itself being probed
+			*url = "https://127.0.0.1:" + port + path
+			insecure = true
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}},
+	}
+
+	resp, err := client.Get(*url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Health check failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Health check failed with status code %d\n", resp.StatusCode)
+		return 1
+	}
+
+	return 0
+}
+
+// EOF
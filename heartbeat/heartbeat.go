@@ -0,0 +1,246 @@
+// Package heartbeat raises an alert when a controller goes quiet: if it dies
+// or can't reach the bridge, no webhook says so, so silence itself has to be
+// noticed.
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// Monitor expects a webhook from every controller in Expect within the
+// interval given for it, and from every other controller that has sent one
+// within Default (unless that's 0). When a controller stays silent longer,
+// an alert is sent through Notifier, and another once it's heard from again.
+// A nil *Monitor monitors nothing.
+type Monitor struct {
+	Expect   map[string]time.Duration
+	Default  time.Duration
+	Notifier notifier.Notifier
+	Logger   *slog.Logger
+
+	mu          sync.Mutex
+	controllers map[string]*controller
+	silences    []Silence // The most recent ones that ended, the last one last
+}
+
+// How many of the silences that ended are kept.
+const keepSilences = 20
+
+type controller struct {
+	interval time.Duration
+	last     time.Time // The last webhook, or since when one is expected
+	heard    bool      // Whether a webhook was received at all
+	silent   bool      // Whether the alert was sent
+	quietAt  time.Time // The last webhook before going silent
+}
+
+// Status is how a controller is doing, as far as the monitor knows.
+type Status struct {
+	Controller string     `json:"controller"`
+	Interval   string     `json:"interval"`            // Like `1h0m0s`
+	LastSeen   *time.Time `json:"last_seen,omitempty"` // Not set before the first webhook
+	Silent     bool       `json:"silent"`              // Whether the silent alert was sent
+	Since      time.Time  `json:"since"`               // Since when it's silent, or expected
+}
+
+// Silence is a time a controller was silent, from its last webhook before
+// until the first one after.
+type Silence struct {
+	Controller string    `json:"controller"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+}
+
+// Start begins expecting the controllers in Expect from now on.
+func (m *Monitor) Start(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.controllers = map[string]*controller{}
+	for name, interval := range m.Expect {
+		m.controllers[name] = &controller{interval: interval, last: now}
+	}
+}
+
+// Seen records a webhook from the controller.
+func (m *Monitor) Seen(name string, at time.Time) {
+	if m == nil || name == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.controllers[name]
+	if !ok {
+		if m.Default <= 0 {
+			return
+		}
+		if m.controllers == nil {
+			m.controllers = map[string]*controller{}
+		}
+		c = &controller{interval: m.Default}
+		m.controllers[name] = c
+	}
+
+	if at.After(c.last) {
+		c.last = at
+	}
+	c.heard = true
+}
+
+// Run checks the controllers every interval until the context ends.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.Check(ctx, now)
+		}
+	}
+}
+
+// Check sends the alerts for controllers that went silent, or were heard
+// from again, by the given time.
+func (m *Monitor) Check(ctx context.Context, now time.Time) {
+	if m == nil {
+		return
+	}
+
+	// The alerts are sent without holding the lock, so a slow notifier
+	// doesn't hold up the webhooks calling Seen
+	for _, a := range m.alerts(now) {
+		ctx := logging.WithRequestID(ctx, logging.NewRequestID())
+
+		if err := m.Notifier.Send(ctx, a.msg); err != nil {
+			// Tried again on the next check
+			m.Logger.ErrorContext(ctx, "Could not send controller heartbeat alert", "controller", a.name, "type", a.msg.Type().String(), "error", err)
+			continue
+		}
+
+		m.Logger.WarnContext(ctx, "Sent controller heartbeat alert", "controller", a.name, "type", a.msg.Type().String())
+
+		m.mu.Lock()
+		if c := m.controllers[a.name]; c != nil {
+			if c.silent {
+				m.silences = append(m.silences, Silence{Controller: a.name, From: c.quietAt, To: a.last})
+				if len(m.silences) > keepSilences {
+					m.silences = m.silences[1:]
+				}
+			}
+
+			c.silent = a.msg.Type() == omada.ControllerSilentMessage
+			c.quietAt = a.last
+		}
+		m.mu.Unlock()
+	}
+}
+
+type alert struct {
+	name string
+	last time.Time // The last webhook when the alert was raised
+	msg  *omada.OmadaMessage
+}
+
+// alerts returns the alerts due by the given time, sorted by controller.
+func (m *Monitor) alerts(now time.Time) []alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.controllers))
+	for name := range m.controllers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var alerts []alert
+	for _, name := range names {
+		c := m.controllers[name]
+		quiet := now.Sub(c.last)
+
+		var text string
+		var raised omada.OmadaMessageType
+		switch {
+		case !c.silent && quiet > c.interval:
+			raised = omada.ControllerSilentMessage
+			text = fmt.Sprintf("Nothing was received from controller [%v] for %v. It may be down, or unable to reach the bridge.", name, omada.HumanReadableDuration(quiet))
+		case c.silent && c.last.After(c.quietAt):
+			raised = omada.ControllerResumedMessage
+			text = fmt.Sprintf("Messages from controller [%v] are received again, after %v of silence.", name, omada.HumanReadableDuration(c.last.Sub(c.quietAt)))
+		default:
+			continue
+		}
+
+		msg := &omada.OmadaMessage{Controller: name, Text: []string{text}, Timestamp: now.UnixMilli(), Raised: raised}
+		alerts = append(alerts, alert{name: name, last: c.last, msg: msg})
+	}
+
+	return alerts
+}
+
+// Status returns how every monitored controller is doing, sorted by name,
+// and the most recent silences that ended, the last one first.
+func (m *Monitor) Status() ([]Status, []Silence) {
+	if m == nil {
+		return []Status{}, []Silence{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := []Status{}
+	for name, c := range m.controllers {
+		s := Status{Controller: name, Interval: c.interval.String(), Silent: c.silent, Since: c.last}
+		if c.heard {
+			last := c.last
+			s.LastSeen = &last
+		}
+		if c.silent {
+			s.Since = c.quietAt
+		}
+		statuses = append(statuses, s)
+	}
+	slices.SortFunc(statuses, func(a, b Status) int { return strings.Compare(a.Controller, b.Controller) })
+
+	silences := slices.Clone(m.silences)
+	slices.Reverse(silences)
+	if silences == nil {
+		silences = []Silence{}
+	}
+
+	return statuses, silences
+}
+
+// ServeHTTP answers on the `/api/heartbeats` endpoint with the status of
+// every controller and the recent silences.
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	controllers, silences := m.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{"controllers": controllers, "silences": silences})
+}
+
+// EOF
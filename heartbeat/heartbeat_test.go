@@ -0,0 +1,178 @@
+package heartbeat_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/heartbeat"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+type notifierMock struct {
+	sent   []*omada.OmadaMessage
+	err    error
+	during func() // Called while sending
+}
+
+func (n *notifierMock) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	if n.during != nil {
+		n.during()
+	}
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, payload)
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	n := &notifierMock{}
+	m := &heartbeat.Monitor{
+		Expect:   map[string]time.Duration{"Home": time.Hour},
+		Notifier: n,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	m.Start(start)
+
+	m.Seen("Home", start.Add(30*time.Minute))
+	m.Check(ctx, start.Add(80*time.Minute))
+	if len(n.sent) != 0 {
+		t.Fatalf("Alert sent before the interval passed")
+	}
+
+	// Failures are retried on the next check
+	n.err = errors.New("unreachable")
+	m.Check(ctx, start.Add(100*time.Minute))
+	n.err = nil
+
+	m.Check(ctx, start.Add(101*time.Minute))
+	if len(n.sent) != 1 {
+		t.Fatalf("Expected a silent alert, got %v messages", len(n.sent))
+	}
+	if got := n.sent[0]; got.Type() != omada.ControllerSilentMessage || got.Controller != "Home" {
+		t.Errorf("Unexpected alert %v for [%v]: %v", got.Type(), got.Controller, got.Text)
+	}
+	if !strings.Contains(n.sent[0].Text[0], "for 1h 11m.") {
+		t.Errorf("Silent alert doesn't say for how long: %v", n.sent[0].Text[0])
+	}
+
+	m.Check(ctx, start.Add(5*time.Hour))
+	if len(n.sent) != 1 {
+		t.Fatalf("Silent alert repeated")
+	}
+
+	m.Seen("Home", start.Add(6*time.Hour))
+	m.Check(ctx, start.Add(6*time.Hour+time.Minute))
+	if len(n.sent) != 2 {
+		t.Fatalf("Expected a resumed alert, got %v messages", len(n.sent))
+	}
+	if got := n.sent[1]; got.Type() != omada.ControllerResumedMessage {
+		t.Errorf("Unexpected alert %v: %v", got.Type(), got.Text)
+	}
+	if !strings.Contains(n.sent[1].Text[0], "after 5h 30m of silence") {
+		t.Errorf("Resumed alert doesn't say how long it was silent: %v", n.sent[1].Text[0])
+	}
+
+	m.Check(ctx, start.Add(6*time.Hour+30*time.Minute))
+	if len(n.sent) != 2 {
+		t.Fatalf("Resumed alert repeated")
+	}
+
+	t.Run("Status", func(t *testing.T) {
+		m.Check(ctx, start.Add(8*time.Hour))
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/api/heartbeats", nil))
+
+		var res struct {
+			Controllers []heartbeat.Status  `json:"controllers"`
+			Silences    []heartbeat.Silence `json:"silences"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Response is not JSON: %v", w.Body.String())
+		}
+
+		if len(res.Controllers) != 1 || !res.Controllers[0].Silent || !res.Controllers[0].Since.Equal(start.Add(6*time.Hour)) || res.Controllers[0].Interval != "1h0m0s" {
+			t.Errorf("Expected Home to be silent since its last webhook, got %+v", res.Controllers)
+		}
+		if len(res.Silences) != 1 || !res.Silences[0].From.Equal(start.Add(30*time.Minute)) || !res.Silences[0].To.Equal(start.Add(6*time.Hour)) {
+			t.Errorf("Expected the silence that ended, got %+v", res.Silences)
+		}
+	})
+}
+
+func TestMonitorDefault(t *testing.T) {
+	n := &notifierMock{}
+	m := &heartbeat.Monitor{Notifier: n, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	ctx := context.Background()
+	start := time.Now()
+	m.Start(start)
+
+	// Without a default, only expected controllers are watched
+	m.Seen("Office", start)
+	m.Check(ctx, start.Add(48*time.Hour))
+	if len(n.sent) != 0 {
+		t.Fatalf("Alert sent for a controller that isn't expected")
+	}
+
+	m.Default = 24 * time.Hour
+	m.Seen("Office", start)
+	m.Seen("", start)
+	m.Check(ctx, start.Add(23*time.Hour))
+	if len(n.sent) != 0 {
+		t.Fatalf("Alert sent before the default interval passed")
+	}
+
+	m.Check(ctx, start.Add(25*time.Hour))
+	if len(n.sent) != 1 || n.sent[0].Controller != "Office" {
+		t.Fatalf("Expected a silent alert for Office, got %v", n.sent)
+	}
+}
+
+func TestMonitorSendsUnlocked(t *testing.T) {
+	n := &notifierMock{}
+	m := &heartbeat.Monitor{
+		Expect:   map[string]time.Duration{"Home": time.Hour},
+		Notifier: n,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	start := time.Now()
+	m.Start(start)
+
+	// A webhook arriving while the alert is sent isn't held up, and counts
+	// as the controller being heard from again
+	n.during = func() { m.Seen("Home", start.Add(2*time.Hour)) }
+	m.Check(context.Background(), start.Add(90*time.Minute))
+	n.during = nil
+
+	m.Check(context.Background(), start.Add(2*time.Hour+time.Minute))
+	if len(n.sent) != 2 || n.sent[1].Type() != omada.ControllerResumedMessage {
+		t.Fatalf("Expected a silent and a resumed alert, got %v", n.sent)
+	}
+}
+
+func TestMonitorNil(t *testing.T) {
+	var m *heartbeat.Monitor
+	m.Seen("Home", time.Now())
+	m.Check(context.Background(), time.Now())
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/api/heartbeats", nil))
+	if got := strings.TrimSpace(w.Body.String()); got != `{"controllers":[],"silences":[]}` {
+		t.Errorf("Expected nothing to be monitored, got %v", got)
+	}
+}
+
+// EOF
@@ -0,0 +1,146 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of the API.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+type page struct {
+	Total  int     `json:"total"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+	Events []Entry `json:"events"`
+}
+
+var csvHeader = []string{
+	"id", "received", "time", "controller", "site", "type", "priority",
+	"device", "device_mac", "interface", "title", "body", "status", "error",
+}
+
+// parseQuery reads a Query from the parameters of an API request.
+func parseQuery(r *http.Request) (Query, error) {
+	params := r.URL.Query()
+
+	q := Query{
+		Controller: params.Get("controller"),
+		Site:       params.Get("site"),
+		Type:       params.Get("type"),
+		DeviceMAC:  params.Get("device_mac"),
+		Status:     params.Get("status"),
+		Limit:      DefaultLimit,
+	}
+
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("%v must be a time like 2006-01-02T15:04:05Z, got `%v`", name, v)
+			}
+			*t = parsed
+		}
+	}
+
+	for name, n := range map[string]*int{"offset": &q.Offset, "limit": &q.Limit} {
+		if v := params.Get(name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				return q, fmt.Errorf("%v must be a positive number, got `%v`", name, v)
+			}
+			*n = parsed
+		}
+	}
+
+	if q.Limit == 0 || q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+
+	return q, nil
+}
+
+// ServeHTTP answers queries for events on the `/api/events` endpoint, as JSON
+// or, with `format=csv`, as CSV.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, total := s.Find(q)
+	if events == nil {
+		events = []Entry{}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+
+	switch format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page{Total: total, Offset: q.Offset, Limit: q.Limit, Events: events})
+
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="omada-events.csv"`)
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, e := range events {
+			cw.Write(csvCells(
+				strconv.FormatInt(e.ID, 10),
+				e.Received.Format(time.RFC3339),
+				e.Time.Format(time.RFC3339),
+				e.Controller,
+				e.Site,
+				e.Type,
+				strconv.Itoa(e.Priority),
+				e.Device,
+				e.DeviceMAC,
+				e.Interface,
+				e.Title,
+				e.Body,
+				e.Status,
+				e.Error,
+			))
+		}
+		cw.Flush()
+
+	default:
+		http.Error(w, fmt.Sprintf("format must be json or csv, got `%v`", format), http.StatusBadRequest)
+	}
+}
+
+// csvCells returns the cells with those that a spreadsheet would take for a
+// formula, like a site named `=HYPERLINK(...)`, prefixed with a `'`.
+func csvCells(cells ...string) []string {
+	for i, c := range cells {
+		if c != "" && strings.ContainsRune("=+-@\t\r", rune(c[0])) {
+			cells[i] = "'" + c
+		}
+	}
+	return cells
+}
+
+// EOF
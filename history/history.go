@@ -0,0 +1,318 @@
+// Package history keeps the events the bridge received, with how their
+// delivery went, so they can be looked up after the notification is gone.
+// Events are kept in memory and, when a file is given, appended to it as
+// JSON lines so they survive a restart.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// Defaults for how much history is kept.
+const (
+	DefaultMaxAge    = 30 * 24 * time.Hour
+	DefaultMaxEvents = 10000
+)
+
+// Delivery statuses of an entry.
+const (
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Entry is an event in the history.
+type Entry struct {
+	ID        int64     `json:"id"`
+	Received  time.Time `json:"received"`
+	RequestID string    `json:"request_id,omitempty"`
+	omada.Event
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewEntry makes the history entry for a received message and the outcome of
+// delivering it.
+func NewEntry(requestID string, payload *omada.OmadaMessage, err error) Entry {
+	e := Entry{
+		Received:  time.Now(),
+		RequestID: requestID,
+		Event:     payload.Event(),
+		Status:    StatusDelivered,
+	}
+
+	if err != nil {
+		e.Status, e.Error = StatusFailed, err.Error()
+	}
+
+	return e
+}
+
+// Store holds the history. Entries older than MaxAge are dropped, as are the
+// oldest ones once there are more than MaxEvents. A nil *Store keeps nothing.
+type Store struct {
+	path      string
+	maxAge    time.Duration
+	maxEvents int
+
+	mu      sync.Mutex
+	entries []Entry // Oldest first
+	nextID  int64
+	file    *os.File
+	lines   int  // Lines in the file, to know when to compact it
+	dirty   bool // The file has a broken line or misses entries, so it's rewritten on the next add
+}
+
+// Open opens the history kept in the file at path, or only in memory if the
+// path is empty. Zero limits take the defaults.
+func Open(path string, maxAge time.Duration, maxEvents int) (*Store, error) {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	if maxEvents <= 0 {
+		maxEvents = DefaultMaxEvents
+	}
+
+	s := &Store{path: path, maxAge: maxAge, maxEvents: maxEvents, nextID: 1}
+
+	if path == "" {
+		return s, nil
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.prune(time.Now())
+
+	// The file is only compacted when adding, as other commands than the
+	// server open the history as well
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open history file: %w", err)
+	}
+	s.file = f
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read history file: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	for n, line := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			// A last line cut short by a crash shouldn't lose the whole history
+			if n == len(lines)-1 {
+				s.dirty = true
+				break
+			}
+			return fmt.Errorf("history file %v: line %d: %w", s.path, n+1, err)
+		}
+
+		s.entries = append(s.entries, e)
+		s.nextID = max(s.nextID, e.ID+1)
+	}
+
+	s.lines = len(lines)
+
+	return nil
+}
+
+// prune drops the entries that are past the retention limits.
+func (s *Store) prune(now time.Time) {
+	drop := max(len(s.entries)-s.maxEvents, 0)
+
+	for drop < len(s.entries) && now.Sub(s.entries[drop].Received) > s.maxAge {
+		drop++
+	}
+
+	if drop > 0 {
+		s.entries = slices.Delete(s.entries, 0, drop)
+	}
+}
+
+// compact rewrites the file with only the entries that are kept. The new
+// file replaces the old one only once it's complete, and is then appended to
+// as it is; on failure the old one is kept, and compacting is tried again with
+// the next entry, as the entries in memory aren't all in the file.
+func (s *Store) compact() error {
+	s.dirty = true
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write history file: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range s.entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write history file: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = tmp
+	s.lines = len(s.entries)
+	s.dirty = false
+
+	return nil
+}
+
+// Add adds the entry to the history, giving it the next ID.
+func (s *Store) Add(e Entry) (Entry, error) {
+	if s == nil {
+		return e, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = s.nextID
+	s.nextID++
+
+	s.entries = append(s.entries, e)
+	s.prune(time.Now())
+
+	if s.file == nil {
+		return e, nil
+	}
+
+	// Once most of the file is history itself, only keep what's needed
+	if s.dirty || (s.lines >= 2*len(s.entries) && s.lines > 100) {
+		return e, s.compact()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	s.lines++
+
+	return e, err
+}
+
+// Close closes the history file.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// Query selects entries from the history; zero fields match everything.
+type Query struct {
+	From       time.Time // Received at or after
+	To         time.Time // Received before
+	Controller string
+	Site       string
+	Type       string
+	DeviceMAC  string // In any notation, e.g. `98:03:8e:3a:8d:53`, or its pseudonym when redacted
+	Status     string
+	Offset     int
+	Limit      int // Defaults to all of them
+}
+
+func (q Query) matches(e Entry) bool {
+	switch {
+	case !q.From.IsZero() && e.Received.Before(q.From):
+		return false
+	case !q.To.IsZero() && !e.Received.Before(q.To):
+		return false
+	case q.Controller != "" && !strings.EqualFold(q.Controller, e.Controller):
+		return false
+	case q.Site != "" && !strings.EqualFold(q.Site, e.Site):
+		return false
+	case q.Type != "" && !strings.EqualFold(q.Type, e.Type):
+		return false
+	case q.DeviceMAC != "" && !strings.EqualFold(NormaliseMAC(q.DeviceMAC), e.DeviceMAC): // Or its pseudonym
+		return false
+	case q.Status != "" && !strings.EqualFold(q.Status, e.Status):
+		return false
+	}
+
+	return true
+}
+
+// NormaliseMAC writes a MAC address the way Omada does, uppercase with
+// dashes.
+func NormaliseMAC(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "-", ".", "-").Replace(strings.TrimSpace(mac)))
+}
+
+// Find returns the entries matching the query, newest first, along with the
+// total number of matches before the offset and limit are applied.
+func (s *Store) Find(q Query) ([]Entry, int) {
+	if s == nil {
+		return nil, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []Entry
+	total := 0
+
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if !q.matches(e) {
+			continue
+		}
+
+		total++
+		if total > q.Offset && (q.Limit <= 0 || len(found) < q.Limit) {
+			found = append(found, e)
+		}
+	}
+
+	return found, total
+}
+
+// EOF
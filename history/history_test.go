@@ -0,0 +1,193 @@
+package history_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+func message(controller string, state string) *omada.OmadaMessage {
+	return &omada.OmadaMessage{
+		Controller: controller,
+		Site:       "Default",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was " + state + "."},
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	s, err := history.Open(path, time.Hour, 3)
+	if err != nil {
+		t.Fatalf("Open() returned an unexpected error: %v", err)
+	}
+
+	old := history.NewEntry("old", message("Home", "offline"), nil)
+	old.Received = time.Now().Add(-2 * time.Hour)
+	s.Add(old)
+
+	for i, state := range []string{"offline", "online", "offline", "online"} {
+		var err error
+		if i == 2 {
+			err = errors.New("ntfy is down")
+		}
+		s.Add(history.NewEntry("", message("Home", state), err))
+	}
+
+	t.Run("Retention limits are applied", func(t *testing.T) {
+		events, total := s.Find(history.Query{})
+		if total != 3 || events[0].ID != 5 || events[2].ID != 3 {
+			t.Errorf("Expected the 3 newest events, got %d: %v", total, events)
+		}
+	})
+
+	t.Run("Queries filter and paginate", func(t *testing.T) {
+		events, total := s.Find(history.Query{Type: "offline", DeviceMAC: "98:03:8e:3a:8d:53"})
+		if total != 1 || events[0].Status != history.StatusFailed || events[0].Error != "ntfy is down" {
+			t.Errorf("Unexpected result for offline events: %v", events)
+		}
+
+		events, total = s.Find(history.Query{Offset: 1, Limit: 1})
+		if total != 3 || len(events) != 1 || events[0].ID != 4 {
+			t.Errorf("Unexpected second page: %v", events)
+		}
+
+		if _, total := s.Find(history.Query{Controller: "Office"}); total != 0 {
+			t.Errorf("Found events for another controller")
+		}
+	})
+
+	s.Close()
+
+	t.Run("History survives a restart", func(t *testing.T) {
+		// Cut the last line short, like a crash halfway through writing would
+		data, _ := os.ReadFile(path)
+		os.WriteFile(path, append(data, `{"id":6,"rec`...), 0o600)
+
+		s, err := history.Open(path, time.Hour, 3)
+		if err != nil {
+			t.Fatalf("Open() returned an unexpected error: %v", err)
+		}
+		defer s.Close()
+
+		if _, total := s.Find(history.Query{}); total != 3 {
+			t.Errorf("Expected 3 events after reopening, got %d", total)
+		}
+
+		if e, _ := s.Add(history.NewEntry("", message("Home", "online"), nil)); e.ID != 6 {
+			t.Errorf("Expected the IDs to carry on at 6, got %d", e.ID)
+		}
+
+		// The broken line is gone once the file is rewritten
+		data, _ = os.ReadFile(path)
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 || strings.Contains(string(data), `"rec"`) {
+			t.Errorf("Expected the file to be compacted to 3 lines, got:\n%s", data)
+		}
+	})
+
+	t.Run("A failed rewrite is tried again", func(t *testing.T) {
+		data, _ := os.ReadFile(path)
+		os.WriteFile(path, append(data, `{"id":7,"rec`...), 0o600)
+
+		s, err := history.Open(path, time.Hour, 3)
+		if err != nil {
+			t.Fatalf("Open() returned an unexpected error: %v", err)
+		}
+		defer s.Close()
+
+		// A directory in the way of the rewritten file
+		os.Remove(path)
+		os.Mkdir(path, 0o700)
+		os.WriteFile(filepath.Join(path, "in-the-way"), nil, 0o600)
+
+		if _, err := s.Add(history.NewEntry("", message("Home", "offline"), nil)); err == nil {
+			t.Errorf("Expected an error when the file can't be rewritten")
+		}
+
+		os.RemoveAll(path)
+
+		if _, err := s.Add(history.NewEntry("", message("Home", "online"), nil)); err != nil {
+			t.Fatalf("Add() returned an unexpected error: %v", err)
+		}
+
+		// With the entry that wasn't written the first time
+		data, _ = os.ReadFile(path)
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 || !strings.Contains(lines[1], `"id":7`) || !strings.Contains(lines[2], `"id":8`) {
+			t.Errorf("Expected the file to have the last 3 entries, got:\n%s", data)
+		}
+
+		s.Add(history.NewEntry("", message("Office", "online"), nil))
+		if data, _ = os.ReadFile(path); !strings.Contains(string(data), `"id":9`) {
+			t.Errorf("Expected the next entry to be appended, got:\n%s", data)
+		}
+	})
+}
+
+func TestServeHTTP(t *testing.T) {
+	s, _ := history.Open("", 0, 0)
+	s.Add(history.NewEntry("abc123", message("Home", "offline"), nil))
+	s.Add(history.NewEntry("def456", message("Office", "online"), nil))
+
+	t.Run("JSON", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/api/events?controller=home&limit=10", nil))
+
+		var page struct {
+			Total  int             `json:"total"`
+			Limit  int             `json:"limit"`
+			Events []history.Entry `json:"events"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Response is not JSON: %v", w.Body.String())
+		}
+
+		if page.Total != 1 || page.Limit != 10 || page.Events[0].RequestID != "abc123" || page.Events[0].Interface != "2.5G WAN1" {
+			t.Errorf("Unexpected page: %+v", page)
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/api/events?format=csv", nil))
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil || len(records) != 3 || records[0][0] != "id" || records[1][3] != "Office" || records[2][5] != "offline" {
+			t.Errorf("Unexpected CSV: %v, %v", records, err)
+		}
+	})
+
+	t.Run("CSV cells aren't taken for formulas", func(t *testing.T) {
+		s, _ := history.Open("", 0, 0)
+		s.Add(history.NewEntry("", message("=HYPERLINK(\"http://example.com\")", "offline"), nil))
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/api/events?format=csv", nil))
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil || len(records) != 2 || records[1][3] != `'=HYPERLINK("http://example.com")` {
+			t.Errorf("Unexpected CSV: %v, %v", records, err)
+		}
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"from=yesterday", "limit=-1", "format=xml"} {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/api/events?"+query, nil))
+
+			if w.Code != 400 {
+				t.Errorf("Expected status code 400 for `%v`, got %d", query, w.Code)
+			}
+		}
+	})
+}
+
+// EOF
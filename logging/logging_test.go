@@ -0,0 +1,70 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/logging"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("JSON output with the request ID from the context", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		logger, err := logging.New(&buf, "json", "info")
+		if err != nil {
+			t.Fatalf("New() returned an unexpected error: %v", err)
+		}
+
+		ctx := logging.WithRequestID(context.Background(), "abc123")
+		logger.With("component", "test").InfoContext(ctx, "Hello", "answer", 42)
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("Output is not JSON: %v", buf.String())
+		}
+
+		if record["msg"] != "Hello" || record["request_id"] != "abc123" || record["component"] != "test" || record["answer"] != float64(42) {
+			t.Errorf("Unexpected record: %v", record)
+		}
+	})
+
+	t.Run("Text output filtered by level", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		logger, err := logging.New(&buf, "", "warn")
+		if err != nil {
+			t.Fatalf("New() returned an unexpected error: %v", err)
+		}
+
+		logger.Info("Hidden")
+		logger.Warn("Shown")
+
+		if strings.Contains(buf.String(), "Hidden") || !strings.Contains(buf.String(), "level=WARN msg=Shown") {
+			t.Errorf("Unexpected output: %v", buf.String())
+		}
+	})
+
+	t.Run("Rejects unknown formats and levels", func(t *testing.T) {
+		if _, err := logging.New(&bytes.Buffer{}, "xml", ""); err == nil {
+			t.Error("New() should fail on an unknown format")
+		}
+
+		if _, err := logging.New(&bytes.Buffer{}, "", "loud"); err == nil {
+			t.Error("New() should fail on an unknown level")
+		}
+	})
+}
+
+func TestNewRequestID(t *testing.T) {
+	a, b := logging.NewRequestID(), logging.NewRequestID()
+
+	if len(a) != 16 || a == b {
+		t.Errorf("NewRequestID() returned %q and %q", a, b)
+	}
+}
+
+// EOF
@@ -1,70 +1,702 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/access"
+	"github.com/zimmra/omada-to-ntfy/capture"
+	"github.com/zimmra/omada-to-ntfy/certs"
+	"github.com/zimmra/omada-to-ntfy/config"
+	"github.com/zimmra/omada-to-ntfy/dashboard"
+	"github.com/zimmra/omada-to-ntfy/health"
+	"github.com/zimmra/omada-to-ntfy/heartbeat"
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/metrics"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/redact"
+	"github.com/zimmra/omada-to-ntfy/reminder"
+	"github.com/zimmra/omada-to-ntfy/state"
+	"github.com/zimmra/omada-to-ntfy/tracing"
 	"github.com/zimmra/omada-to-ntfy/webhook"
 )
 
 var version = "development"
 
 func main() {
-	logger := log.Default()
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command `%v`; try healthcheck, send-test, validate-config, classify, replay or version\n", os.Args[1])
+			os.Exit(2)
+		}
+		os.Exit(command(os.Args[2:]))
+	}
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	_, server, port, err := InitMain(logger)
+	logger, err := logging.New(os.Stderr, cfg.Getenv("LOG_FORMAT"), cfg.Getenv("LOG_LEVEL"))
 	if err != nil {
-		logger.Fatal(err.Error())
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Checked by InitMain too, for validate-config
+	if r, _ := redactorFromEnv(cfg.Getenv, "REDACT_LOGS"); r != nil {
+		logger = slog.New(r.Handler(logger.Handler()))
+	}
+	slog.SetDefault(logger)
+
+	notifiers, server, port, err := InitMain(logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	logger.Info("omada-to-ntfy server starting", "version", version, "port", port, "notifiers", len(notifiers))
+
+	live := &liveServer{}
+	live.Store(server)
+	go live.watch(os.Getenv("CONFIG_FILE"), configPollInterval, logger)
+
+	// Stopped by `docker stop` and Kubernetes with SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if r, _ := reminderFromEnv(cfg.Getenv); r != nil {
+		r.State, r.Notifier, r.Logger = server.State, live, logger
+		go r.Run(ctx)
+	}
+
+	if h := server.Heartbeat; h != nil {
+		h.Notifier, h.Logger = live, logger
+		h.Start(time.Now())
+		go h.Run(ctx, time.Minute)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		(&health.Readiness{Server: live.Load()}).ServeHTTP(w, r)
+	})
+
+	// The dashboard and its API are only served with admin credentials, as
+	// the events and states are full of device details. The metrics name the
+	// controllers and sites, so they're put behind the credentials too.
+	if credentials := adminFromEnv(cfg.Getenv); credentials != nil {
+		live.admin.Store(credentials)
+
+		mux.Handle("/metrics", live.Admin(server.Metrics))
+
+		mux.Handle("/dashboard/", live.Admin(http.StripPrefix("/dashboard/", dashboard.Handler())))
+		mux.Handle("/api/events", live.Admin(server.History))
+		mux.Handle("/api/state", live.Admin(server.State))
+		mux.Handle("/api/state/ack", live.Admin(http.HandlerFunc(server.State.ServeAck)))
+		mux.Handle("/api/heartbeats", live.Admin(server.Heartbeat))
+	} else {
+		mux.Handle("/metrics", server.Metrics)
+	}
+
+	HandleWebhook(mux, cfg.Getenv("WEBHOOK_PATH"), live)
+
+	srv, shutdownTimeout, _ := httpServerFromEnv(cfg.Getenv, ":"+port, logger)
+	srv.Handler = mux
+	serve := srv.ListenAndServe
+
+	if certificate, _ := tlsFromEnv(cfg.Getenv, logger); certificate != nil {
+		if err := certificate.Load(); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		srv.TLSConfig = certificate.TLSConfig()
+		if certificate.ClientCAFile != "" {
+			// Docker's health checks come without a client certificate
+			srv.Handler = certs.RequireClientCert(mux, "/healthz", "/readyz")
+		}
+
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- serve() }()
+
+	exitCode := 0
+	select {
+	case err := <-stopped:
+		logger.Error("Server stopped", "error", err)
+		exitCode = 1
+
+	case <-ctx.Done():
+		// Deliveries happen while handling the request, so waiting for the
+		// requests underway waits for their deliveries too
+		logger.Info("Shutting down, finishing the deliveries underway", "in_flight", server.Metrics.InFlight())
+
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := srv.Shutdown(sctx); err != nil {
+			logger.Warn("Deliveries still underway at shutdown were abandoned", "error", err)
+			exitCode = 1
+		}
+		live.Load().Watchdog.Wait(sctx)
+		cancel()
 	}
 
-	logger.Printf("omada-to-ntfy %s server starting on port %s ...", version, port)
+	tctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	server.Tracer.Shutdown(tctx)
+	cancel()
 
-	logger.Fatal(http.ListenAndServe(":"+port, server))
+	os.Exit(exitCode)
 }
 
-func InitMain(logger *log.Logger) (nc ntfy.NtfyClient, s *webhook.WebhookServer, p string, err error) {
-	ntfyURL := os.Getenv("NTFY_URL")
-	if ntfyURL == "" {
-		return ntfy.NtfyClient{}, nil, "", errors.New("NTFY_URL environment variable is required")
+// HandleWebhook serves the webhook on the path. Omada only ever POSTs, so
+// anything else is answered with 405. Without a path webhooks are taken on
+// any path not served otherwise, like they always were; with one, other paths
+// are answered with 404.
+func HandleWebhook(mux *http.ServeMux, path string, h http.Handler) {
+	if path == "" {
+		// Not `POST /`, which would conflict with the likes of `/dashboard/`
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				w.Header().Set("Allow", "POST")
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+		return
 	}
 
-	ntfyTopic := os.Getenv("NTFY_TOPIC")
-	if ntfyTopic == "" {
-		return ntfy.NtfyClient{}, nil, "", errors.New("NTFY_TOPIC environment variable is required")
+	if strings.HasSuffix(path, "/") {
+		path += "{$}" // Only the path itself, not everything below it
 	}
+	mux.Handle("POST "+path, h)
+}
 
-	// Username and password are optional for ntfy (some instances may not require auth)
-	ntfyUser := os.Getenv("NTFY_USER")
-	ntfyPassword := os.Getenv("NTFY_PASSWORD")
+// InitMain loads the configuration from the file named by CONFIG_FILE, if
+// any, and the environment, and sets up the webhook server with it, opening
+// the history and state files and starting to export traces.
+func InitMain(logger *slog.Logger) (n notifier.Multi, s *webhook.WebhookServer, p string, err error) {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, nil, "", err
+	}
 
-	sharedSecret := os.Getenv("OMADA_SHARED_SECRET")
-	if sharedSecret == "" {
-		return ntfy.NtfyClient{}, nil, "", errors.New("OMADA_SHARED_SECRET environment variable is required")
+	n, s, p, err = checkConfig(cfg, logger)
+	if err != nil {
+		return nil, nil, "", err
 	}
 
-	port := os.Getenv("PORT")
+	if s.History, err = historyFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	if s.State, err = state.Open(cfg.Getenv("STATE_FILE")); err != nil {
+		return nil, nil, "", err
+	}
+	s.State.Redactor = s.RedactHistory
+
+	// Tracing is set up last, as it starts exporting in the background
+	if s.Tracer, err = tracerFromEnv(cfg.Getenv, logger); err != nil {
+		return nil, nil, "", err
+	}
+
+	return n, s, p, nil
+}
+
+// checkConfig checks the configuration the way the server does at startup,
+// and sets up the webhook server with it as far as that's possible without
+// side effects: the history and state files aren't opened and no traces are
+// exported, so the server has neither History, State nor Tracer.
+func checkConfig(cfg config.Config, logger *slog.Logger) (notifier.Multi, *webhook.WebhookServer, string, error) {
+	server, err := newServer(cfg.Getenv, logger, metrics.New())
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	port := cfg.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	ntfyClient := ntfy.NtfyClient{
-		NtfyURL:  ntfyURL,
-		Topic:    ntfyTopic,
-		Username: ntfyUser,
-		Password: ntfyPassword,
-		Logger:   logger,
+	if server.Capture, err = captureFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	if server.Lockout, err = lockoutFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	if server.Replays, err = replaysFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Only checked here, InitMain opens the history
+	if _, _, err := historyLimitsFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Seen by the server, main starts checking it
+	if server.Heartbeat, err = heartbeatFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Only checked here, main redacts the logs with it
+	if _, err := redactorFromEnv(cfg.Getenv, "REDACT_LOGS"); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Only checked here, main starts serving
+	if _, _, err := httpServerFromEnv(cfg.Getenv, ":"+port, logger); err != nil {
+		return nil, nil, "", err
+	}
+
+	if path := cfg.Getenv("WEBHOOK_PATH"); path != "" && !strings.HasPrefix(path, "/") {
+		return nil, nil, "", fmt.Errorf("WEBHOOK_PATH must start with a /, got `%v`", path)
+	}
+
+	// Only checked here, main loads the certificate
+	if _, err := tlsFromEnv(cfg.Getenv, logger); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Only checked here, main starts sending the reminders
+	if _, err := reminderFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	// Only checked here, InitMain starts exporting
+	if _, _, err := otlpFromEnv(cfg.Getenv); err != nil {
+		return nil, nil, "", err
+	}
+
+	return server.Notifier.(notifier.Multi), server, port, nil
+}
+
+// newServer builds the webhook server from the settings that can change when
+// the configuration is reloaded.
+func newServer(getenv func(string) string, logger *slog.Logger, m *metrics.Metrics) (*webhook.WebhookServer, error) {
+	redactNotifications, err := redactorFromEnv(getenv, "REDACT_NOTIFICATIONS")
+	if err != nil {
+		return nil, err
+	}
+
+	redactHistory, err := redactorFromEnv(getenv, "REDACT_HISTORY")
+	if err != nil {
+		return nil, err
+	}
+
+	watchdog, err := watchdogFromEnv(getenv, logger, redactNotifications)
+	if err != nil {
+		return nil, err
+	}
+
+	notifiers, err := notifiersFromEnv(getenv, logger, m, watchdog, redactNotifications)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret := getenv("OMADA_SHARED_SECRET")
+	if sharedSecret == "" {
+		return nil, errors.New("OMADA_SHARED_SECRET environment variable is required")
+	}
+
+	logPayloads := true
+	if v := getenv("LOG_PAYLOADS"); v != "" {
+		if logPayloads, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("LOG_PAYLOADS must be true or false, got `%v`", v)
+		}
+	}
+
+	var previousSecrets []string
+	for secret := range strings.SplitSeq(getenv("OMADA_PREVIOUS_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			previousSecrets = append(previousSecrets, secret)
+		}
+	}
+
+	allowedIPs, err := access.ParseAllowlist(getenv("ALLOWED_IPS"))
+	if err != nil {
+		return nil, fmt.Errorf("ALLOWED_IPS: %w", err)
+	}
+
+	trustedProxies, err := access.ParsePrefixes(getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+
+	maxBodyKB := 1024
+	if v := getenv("WEBHOOK_MAX_BODY_KB"); v != "" {
+		if maxBodyKB, err = strconv.Atoi(v); err != nil || maxBodyKB < 1 {
+			return nil, fmt.Errorf("WEBHOOK_MAX_BODY_KB must be a positive number, got `%v`", v)
+		}
 	}
 
 	server := &webhook.WebhookServer{
-		NtfyClient:   ntfyClient,
-		SharedSecret: sharedSecret,
+		Notifier:        notifiers,
+		SharedSecret:    sharedSecret,
+		PreviousSecrets: previousSecrets,
+		AllowedIPs:      allowedIPs,
+		TrustedProxies:  trustedProxies,
+		LogPayloads:     logPayloads,
+		MaxBodySize:     int64(maxBodyKB) * 1024,
+		RedactHistory:   redactHistory,
+		Metrics:         m,
+		Watchdog:        watchdog,
+		Logger:          logger,
+	}
+
+	return server, nil
+}
+
+// captureFromEnv sets up recording the incoming requests when a capture file
+// is configured; nil otherwise.
+func captureFromEnv(getenv func(string) string) (*capture.Recorder, error) {
+	path := getenv("CAPTURE_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	recorder := &capture.Recorder{Path: path}
+
+	if v := getenv("CAPTURE_MAX_SIZE_MB"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("CAPTURE_MAX_SIZE_MB must be a positive number, got `%v`", v)
+		}
+		recorder.MaxSize = int64(size) << 20
+	}
+
+	if v := getenv("CAPTURE_MAX_FILES"); v != "" {
+		files, err := strconv.Atoi(v)
+		if err != nil || files < 1 {
+			return nil, fmt.Errorf("CAPTURE_MAX_FILES must be a positive number, got `%v`", v)
+		}
+		recorder.MaxFiles = files
+	}
+
+	return recorder, nil
+}
+
+// reminderFromEnv sets up reminders about devices that stay offline when an
+// interval is configured; nil otherwise.
+func reminderFromEnv(getenv func(string) string) (*reminder.Reminder, error) {
+	v := getenv("REMINDER_INTERVAL")
+	if v == "" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval < time.Minute {
+		return nil, fmt.Errorf("REMINDER_INTERVAL must be a duration of at least 1m, like 30m, got `%v`", v)
+	}
+
+	r := &reminder.Reminder{Interval: interval, Max: 3}
+
+	if v := getenv("REMINDER_MAX"); v != "" {
+		if r.Max, err = strconv.Atoi(v); err != nil || r.Max < 0 {
+			return nil, fmt.Errorf("REMINDER_MAX must be a number, 0 for no limit, got `%v`", v)
+		}
+	}
+
+	return r, nil
+}
+
+// httpServerFromEnv sets up the HTTP server with the configured timeouts,
+// and returns how long to wait for requests underway when shutting down.
+func httpServerFromEnv(getenv func(string) string, addr string, logger *slog.Logger) (*http.Server, time.Duration, error) {
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", 30 * time.Second},
+		{"HTTP_WRITE_TIMEOUT", 60 * time.Second},
+		{"HTTP_IDLE_TIMEOUT", 120 * time.Second},
+		{"SHUTDOWN_TIMEOUT", 30 * time.Second},
+	}
+
+	for i, t := range timeouts {
+		if v := getenv(t.name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, 0, fmt.Errorf("%v must be a duration like 30s, got `%v`", t.name, v)
+			}
+			timeouts[i].value = d
+		}
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       timeouts[0].value,
+		WriteTimeout:      timeouts[1].value,
+		IdleTimeout:       timeouts[2].value,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+
+	return srv, timeouts[3].value, nil
+}
+
+// tlsFromEnv sets up serving over HTTPS when TLS_CERT_FILE and TLS_KEY_FILE
+// are set, requiring client certificates signed by TLS_CLIENT_CA_FILE when
+// that's set too.
+func tlsFromEnv(getenv func(string) string, logger *slog.Logger) (*certs.Reloader, error) {
+	r := &certs.Reloader{
+		CertFile:     getenv("TLS_CERT_FILE"),
+		KeyFile:      getenv("TLS_KEY_FILE"),
+		ClientCAFile: getenv("TLS_CLIENT_CA_FILE"),
 		Logger:       logger,
 	}
 
-	return ntfyClient, server, port, nil
+	if v := getenv("TLS_SELF_SIGNED"); v != "" {
+		var err error
+		if r.SelfSigned, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("TLS_SELF_SIGNED must be true or false, got `%v`", v)
+		}
+	}
+
+	if r.CertFile == "" && r.KeyFile == "" {
+		if r.ClientCAFile != "" || r.SelfSigned {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE are required for TLS_CLIENT_CA_FILE and TLS_SELF_SIGNED")
+		}
+		return nil, nil
+	}
+
+	if r.CertFile == "" || r.KeyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	return r, nil
+}
+
+// lockoutFromEnv sets up locking out addresses that keep sending the wrong
+// secret. It's on by default only with TRUSTED_PROXIES set: behind a proxy
+// that isn't trusted every request seems to come from the proxy, so anyone
+// sending the wrong secret would lock out the controllers too. Without it,
+// setting AUTH_LOCKOUT_FAILURES turns it on, 0 off.
+func lockoutFromEnv(getenv func(string) string) (*access.Lockout, error) {
+	l := &access.Lockout{Failures: 10, Window: 5 * time.Minute, Duration: 15 * time.Minute}
+
+	if v := getenv("AUTH_LOCKOUT_FAILURES"); v != "" {
+		var err error
+		if l.Failures, err = strconv.Atoi(v); err != nil || l.Failures < 0 {
+			return nil, fmt.Errorf("AUTH_LOCKOUT_FAILURES must be a number, 0 to never lock out, got `%v`", v)
+		}
+		if l.Failures == 0 {
+			return nil, nil
+		}
+	} else if getenv("TRUSTED_PROXIES") == "" {
+		return nil, nil
+	}
+
+	for name, d := range map[string]*time.Duration{"AUTH_LOCKOUT_WINDOW": &l.Window, "AUTH_LOCKOUT_DURATION": &l.Duration} {
+		if v := getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("%v must be a duration like 15m, got `%v`", name, v)
+			}
+			*d = parsed
+		}
+	}
+
+	return l, nil
+}
+
+// replaysFromEnv sets up rejecting stale and repeated webhooks, when
+// REPLAY_WINDOW is set.
+func replaysFromEnv(getenv func(string) string) (*access.ReplayGuard, error) {
+	v := getenv("REPLAY_WINDOW")
+	if v == "" {
+		return nil, nil
+	}
+
+	window, err := time.ParseDuration(v)
+	if err != nil || window < time.Second {
+		return nil, fmt.Errorf("REPLAY_WINDOW must be a duration of at least 1s, like 5m, got `%v`", v)
+	}
+
+	return &access.ReplayGuard{MaxSkew: window}, nil
+}
+
+// redactorFromEnv sets up redacting with the mode set in the variable by the
+// name given, like REDACT_LOGS, and the detectors in REDACT_DETECTORS (every
+// built-in one by default, or none) and REDACT_PATTERNS. It returns nil when
+// the mode is off.
+func redactorFromEnv(getenv func(string) string, name string) (*redact.Redactor, error) {
+	mode, err := redact.ParseMode(getenv(name))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	if mode == "" {
+		return nil, nil
+	}
+
+	r := &redact.Redactor{Mode: mode, Key: []byte(getenv("REDACT_HASH_SECRET"))}
+	if mode == redact.ModeHash && len(r.Key) == 0 {
+		return nil, fmt.Errorf("REDACT_HASH_SECRET environment variable is required to hash with %v", name)
+	}
+
+	// The patterns first, as they're the more specific ones; sorted, so they
+	// always apply in the same order
+	if v := getenv("REDACT_PATTERNS"); v != "" {
+		var patterns map[string]string
+		if err := json.Unmarshal([]byte(v), &patterns); err != nil {
+			return nil, fmt.Errorf("REDACT_PATTERNS must be a JSON object of names to regular expressions: %w", err)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(patterns)) {
+			d, err := redact.Custom(name, patterns[name])
+			if err != nil {
+				return nil, fmt.Errorf("REDACT_PATTERNS: %w", err)
+			}
+			r.Detectors = append(r.Detectors, d)
+		}
+	}
+
+	var names []string
+	for n := range strings.SplitSeq(getenv("REDACT_DETECTORS"), ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+
+	if !slices.Equal(names, []string{"none"}) {
+		builtin, err := redact.Builtin(names...)
+		if err != nil {
+			return nil, fmt.Errorf("REDACT_DETECTORS: %w", err)
+		}
+		r.Detectors = append(r.Detectors, builtin...)
+	}
+
+	return r, nil
+}
+
+// heartbeatFromEnv sets up alerts about controllers that go silent, when
+// HEARTBEAT_CONTROLLERS (like `Home=1h,Office=24h`) or HEARTBEAT_INTERVAL
+// (for every controller that sends a webhook) is set.
+func heartbeatFromEnv(getenv func(string) string) (*heartbeat.Monitor, error) {
+	controllers, v := getenv("HEARTBEAT_CONTROLLERS"), getenv("HEARTBEAT_INTERVAL")
+	if controllers == "" && v == "" {
+		return nil, nil
+	}
+
+	m := &heartbeat.Monitor{Expect: map[string]time.Duration{}}
+
+	if v != "" {
+		var err error
+		if m.Default, err = time.ParseDuration(v); err != nil || m.Default < time.Minute {
+			return nil, fmt.Errorf("HEARTBEAT_INTERVAL must be a duration of at least 1m, like 24h, got `%v`", v)
+		}
+	}
+
+	for _, entry := range strings.Split(controllers, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, v, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		interval, err := time.ParseDuration(strings.TrimSpace(v))
+		if !ok || name == "" || err != nil || interval < time.Minute {
+			return nil, fmt.Errorf("HEARTBEAT_CONTROLLERS must list controller=interval pairs, with intervals of at least 1m, like Home=1h,Office=24h, got `%v`", entry)
+		}
+
+		m.Expect[name] = interval
+	}
+
+	return m, nil
+}
+
+// historyFromEnv opens the event history, kept in the configured file or
+// only in memory when there is none.
+func historyFromEnv(getenv func(string) string) (*history.Store, error) {
+	maxAge, maxEvents, err := historyLimitsFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	return history.Open(getenv("HISTORY_FILE"), maxAge, maxEvents)
+}
+
+// historyLimitsFromEnv returns how much history to keep; zero for the
+// defaults.
+func historyLimitsFromEnv(getenv func(string) string) (maxAge time.Duration, maxEvents int, err error) {
+	if v := getenv("HISTORY_MAX_AGE"); v != "" {
+		if maxAge, err = time.ParseDuration(v); err != nil || maxAge <= 0 {
+			return 0, 0, fmt.Errorf("HISTORY_MAX_AGE must be a duration like 720h, got `%v`", v)
+		}
+	}
+
+	if v := getenv("HISTORY_MAX_EVENTS"); v != "" {
+		if maxEvents, err = strconv.Atoi(v); err != nil || maxEvents < 1 {
+			return 0, 0, fmt.Errorf("HISTORY_MAX_EVENTS must be a positive number, got `%v`", v)
+		}
+	}
+
+	return maxAge, maxEvents, nil
+}
+
+// tracerFromEnv sets up exporting traces when an OTLP endpoint is configured
+// with the standard OpenTelemetry environment variables; nil otherwise.
+func tracerFromEnv(getenv func(string) string, logger *slog.Logger) (*tracing.Tracer, error) {
+	endpoint, headers, err := otlpFromEnv(getenv)
+	if err != nil || endpoint == "" {
+		return nil, err
+	}
+
+	serviceName := getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "omada-to-ntfy"
+	}
+
+	logger.Info("Exporting traces", "endpoint", endpoint, "service", serviceName)
+
+	return tracing.New(endpoint, headers, serviceName, version, logger), nil
+}
+
+// otlpFromEnv returns the OTLP endpoint to export traces to, empty when
+// none is configured, and the headers to send along.
+func otlpFromEnv(getenv func(string) string) (string, map[string]string, error) {
+	endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+
+	if endpoint == "" {
+		return "", nil, nil
+	}
+
+	headers := map[string]string{}
+	if v := getenv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		for pair := range strings.SplitSeq(v, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return "", nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS must be a list of key=value pairs, got `%v`", v)
+			}
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return endpoint, headers, nil
 }
 
 // EOF
@@ -2,25 +2,38 @@ package main_test
 
 import (
 	"bytes"
-	"log"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	main "github.com/zimmra/omada-to-ntfy"
+	"github.com/zimmra/omada-to-ntfy/chat"
+	"github.com/zimmra/omada-to-ntfy/email"
+	"github.com/zimmra/omada-to-ntfy/gotify"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
 )
 
 func TestInitMain(t *testing.T) {
 
 	var (
 		buf    bytes.Buffer
-		logger = log.New(&buf, "logger: ", log.Lshortfile)
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
 	)
 
-	t.Run("NTFY_URL is required", func(t *testing.T) {
+	t.Run("NTFY_URL or another destination is required", func(t *testing.T) {
 		buf.Reset()
 		_, _, _, err := main.InitMain(logger)
-		if err.Error() != "NTFY_URL environment variable is required" {
-			logger.Fatalf("Failed test whether NTFY_URL is required; log is `%v`", buf.String())
+		if err.Error() != "NTFY_URL or another notification destination environment variable is required" {
+			t.Fatalf("Failed test whether a destination is required; log is `%v`", buf.String())
 		}
 	})
 
@@ -30,7 +43,7 @@ func TestInitMain(t *testing.T) {
 		buf.Reset()
 		_, _, _, err := main.InitMain(logger)
 		if err.Error() != "NTFY_TOPIC environment variable is required" {
-			logger.Fatalf("Failed test whether NTFY_TOPIC is required; log is `%v`", buf.String())
+			t.Fatalf("Failed test whether NTFY_TOPIC is required; log is `%v`", buf.String())
 		}
 	})
 
@@ -40,7 +53,7 @@ func TestInitMain(t *testing.T) {
 		buf.Reset()
 		_, _, _, err := main.InitMain(logger)
 		if err.Error() != "OMADA_SHARED_SECRET environment variable is required" {
-			logger.Fatalf("Failed test whether OMADA_SHARED_SECRET is required; log is `%v`", buf.String())
+			t.Fatalf("Failed test whether OMADA_SHARED_SECRET is required; log is `%v`", buf.String())
 		}
 	})
 
@@ -49,26 +62,683 @@ func TestInitMain(t *testing.T) {
 	t.Run("Can initialise after environment variables are set", func(t *testing.T) {
 		buf.Reset()
 
-		ntfyClient, server, port, err := main.InitMain(logger)
+		notifiers, server, port, err := main.InitMain(logger)
 
 		if err != nil {
-			logger.Fatalf("Still failed to initialize main; log is %v", buf.String())
+			t.Fatalf("Still failed to initialize main; log is %v", buf.String())
+		}
+
+		if len(notifiers) != 1 {
+			t.Fatalf("Expected only the ntfy notifier to be configured; got %d notifiers", len(notifiers))
+		}
+
+		ntfyClient, ok := notifier.Unwrap(notifiers[0]).(*ntfy.NtfyClient)
+		if !ok {
+			t.Fatalf("Expected the first notifier to be ntfy; got %T", notifiers[0])
 		}
 
 		if ntfyClient.NtfyURL != "https://ntfy.sh" {
-			logger.Fatalf("Failed to initialize ntfy client properly; NtfyURL is `%v`", ntfyClient.NtfyURL)
+			t.Fatalf("Failed to initialize ntfy client properly; NtfyURL is `%v`", ntfyClient.NtfyURL)
 		}
 
 		if ntfyClient.Topic != "my_omada_alerts" {
-			logger.Fatalf("Failed to initialize ntfy client properly; Topic is `%v`", ntfyClient.Topic)
+			t.Fatalf("Failed to initialize ntfy client properly; Topic is `%v`", ntfyClient.Topic)
 		}
 
 		if port != "8080" {
-			logger.Fatalf("Failed to initialize server port; PORT is `%v`", port)
+			t.Fatalf("Failed to initialize server port; PORT is `%v`", port)
 		}
 
 		if server == nil {
-			logger.Fatal("The server wasn't created by the init call")
+			t.Fatal("The server wasn't created by the init call")
+		}
+	})
+
+	os.Setenv("GOTIFY_URL", "https://gotify.example.com")
+
+	t.Run("GOTIFY_APP_TOKEN is required with GOTIFY_URL", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err.Error() != "GOTIFY_APP_TOKEN environment variable is required" {
+			t.Fatalf("Failed test whether GOTIFY_APP_TOKEN is required; log is `%v`", buf.String())
+		}
+	})
+
+	os.Setenv("GOTIFY_APP_TOKEN", "app-token")
+
+	t.Run("Can combine ntfy and Gotify", func(t *testing.T) {
+		buf.Reset()
+
+		notifiers, _, _, err := main.InitMain(logger)
+
+		if err != nil {
+			t.Fatalf("Failed to initialize main with both notifiers; log is %v", buf.String())
+		}
+
+		if len(notifiers) != 2 {
+			t.Fatalf("Expected both ntfy and Gotify to be configured; got %d notifiers", len(notifiers))
+		}
+
+		gotifyClient, ok := notifier.Unwrap(notifiers[1]).(*gotify.GotifyClient)
+		if !ok || gotifyClient.AppToken != "app-token" {
+			t.Fatalf("Failed to initialize Gotify client properly; got %#v", notifiers[1])
+		}
+	})
+
+	os.Setenv("DISCORD_WEBHOOK_URL", "https://discord.com/api/webhooks/123/abc")
+	os.Setenv("DISCORD_MIN_PRIORITY", "eleven")
+
+	t.Run("Routing rules must be valid", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || !strings.HasPrefix(err.Error(), "DISCORD_MIN_PRIORITY must be a number") {
+			t.Fatalf("Failed test whether DISCORD_MIN_PRIORITY is validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("DISCORD_MIN_PRIORITY", "7")
+	os.Setenv("DISCORD_TYPES", "offline, online")
+
+	t.Run("Chat destinations are routed", func(t *testing.T) {
+		buf.Reset()
+
+		notifiers, _, _, err := main.InitMain(logger)
+
+		if err != nil {
+			t.Fatalf("Failed to initialize main with a chat destination; error is %v", err)
+		}
+
+		route, ok := notifiers[2].(notifier.Route)
+		if !ok {
+			t.Fatalf("Expected the Discord notifier to be wrapped in a route; got %T", notifiers[2])
+		}
+
+		if _, ok := notifier.Unwrap(route).(*chat.DiscordClient); !ok || route.MinPriority != 7 || len(route.Types) != 2 || route.Name != "discord" {
+			t.Fatalf("Failed to initialize the Discord route properly; got %#v", route)
+		}
+	})
+
+	os.Unsetenv("DISCORD_WEBHOOK_URL")
+
+	os.Setenv("SMTP_HOST", "smtp.example.com")
+	os.Setenv("SMTP_FROM", "omada@example.com")
+
+	t.Run("SMTP_TO is required with SMTP_HOST", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "SMTP_TO environment variable is required" {
+			t.Fatalf("Failed test whether SMTP_TO is required; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("SMTP_TO", "noc@example.com, helpdesk@example.com")
+	os.Setenv("SMTP_SECURITY", "tls")
+
+	t.Run("Email destination is configured", func(t *testing.T) {
+		buf.Reset()
+
+		notifiers, _, _, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialize main with an email destination; error is %v", err)
+		}
+
+		client, ok := notifier.Unwrap(notifiers[len(notifiers)-1]).(*email.EmailClient)
+		if !ok {
+			t.Fatalf("Expected the last notifier to be email; got %T", notifiers[len(notifiers)-1])
+		}
+
+		if client.Port != "465" || len(client.To) != 2 || client.To[1] != "helpdesk@example.com" {
+			t.Fatalf("Failed to initialize the email client properly; got %#v", client)
+		}
+	})
+
+	os.Unsetenv("SMTP_HOST")
+
+	os.Setenv("GENERIC_WEBHOOK_URL", "https://alerts.example.com/{{.Type}")
+
+	t.Run("Generic webhook templates are validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || !strings.HasPrefix(err.Error(), "GENERIC_WEBHOOK: invalid URL template") {
+			t.Fatalf("Failed test whether the generic webhook templates are validated; error is `%v`", err)
+		}
+	})
+
+	os.Unsetenv("GENERIC_WEBHOOK_URL")
+
+	os.Setenv("HEARTBEAT_CONTROLLERS", "Home=1h,Office")
+
+	t.Run("Heartbeat intervals are validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || !strings.HasPrefix(err.Error(), "HEARTBEAT_CONTROLLERS must list controller=interval pairs") {
+			t.Fatalf("Failed test whether the heartbeat intervals are validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("HEARTBEAT_CONTROLLERS", "Home=1h, Office=24h")
+
+	t.Run("Heartbeats are configured", func(t *testing.T) {
+		buf.Reset()
+		_, server, _, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialise with heartbeats; error is `%v`", err)
+		}
+		if server.Heartbeat == nil || server.Heartbeat.Expect["Office"] != 24*time.Hour {
+			t.Fatalf("Heartbeats not configured as expected: %+v", server.Heartbeat)
+		}
+	})
+
+	os.Unsetenv("HEARTBEAT_CONTROLLERS")
+
+	os.Setenv("ALLOWED_IPS", "192.168.1.0/24, Office=203.0.113")
+
+	t.Run("Allowed addresses are validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "ALLOWED_IPS: `203.0.113` is not an IP address or CIDR range" {
+			t.Fatalf("Failed test whether the allowed addresses are validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("ALLOWED_IPS", "192.168.1.0/24, Office=203.0.113.7")
+	os.Setenv("OMADA_PREVIOUS_SECRETS", "bar, baz")
+
+	t.Run("Access rules are configured", func(t *testing.T) {
+		buf.Reset()
+		_, server, _, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialise with access rules; error is `%v`", err)
+		}
+		if len(server.PreviousSecrets) != 2 || server.AllowedIPs == nil || server.Lockout != nil {
+			t.Fatalf("Access rules not configured as expected: %v, %+v, %+v", server.PreviousSecrets, server.AllowedIPs, server.Lockout)
+		}
+
+		// Without a trusted proxy the lockout is only on when asked for, as
+		// the proxy could be locked out otherwise
+		t.Setenv("TRUSTED_PROXIES", "10.0.0.1")
+		if _, server, _, _ = main.InitMain(logger); server.Lockout == nil || server.Lockout.Failures != 10 {
+			t.Errorf("Expected the lockout to be on by default with a trusted proxy, got %+v", server.Lockout)
+		}
+
+		os.Unsetenv("TRUSTED_PROXIES")
+		t.Setenv("AUTH_LOCKOUT_FAILURES", "3")
+		if _, server, _, _ = main.InitMain(logger); server.Lockout == nil || server.Lockout.Failures != 3 {
+			t.Errorf("Expected the lockout to be on when configured, got %+v", server.Lockout)
+		}
+	})
+
+	os.Unsetenv("ALLOWED_IPS")
+	os.Unsetenv("OMADA_PREVIOUS_SECRETS")
+
+	os.Setenv("REPLAY_WINDOW", "5")
+
+	t.Run("The replay window is validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "REPLAY_WINDOW must be a duration of at least 1s, like 5m, got `5`" {
+			t.Fatalf("Failed test whether the replay window is validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("REPLAY_WINDOW", "5m")
+
+	t.Run("Stale and repeated webhooks are rejected", func(t *testing.T) {
+		buf.Reset()
+		_, server, _, err := main.InitMain(logger)
+		if err != nil || server.Replays == nil || server.Replays.MaxSkew != 5*time.Minute {
+			t.Fatalf("Replay window not configured as expected: %+v, %v", server.Replays, err)
+		}
+	})
+
+	os.Unsetenv("REPLAY_WINDOW")
+
+	os.Setenv("REDACT_NOTIFICATIONS", "hash")
+
+	t.Run("Hashing needs a secret", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "REDACT_HASH_SECRET environment variable is required to hash with REDACT_NOTIFICATIONS" {
+			t.Fatalf("Failed test whether hashing needs a secret; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("REDACT_HASH_SECRET", "pepper")
+	os.Setenv("REDACT_LOGS", "blur")
+
+	t.Run("Redaction modes are validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "REDACT_LOGS: unknown redaction mode `blur`, use off, mask, hash or drop" {
+			t.Fatalf("Failed test whether the redaction modes are validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("REDACT_LOGS", "mask")
+	os.Setenv("REDACT_PATTERNS", `{"client": "[a-"}`)
+
+	t.Run("Redaction patterns are validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || !strings.HasPrefix(err.Error(), "REDACT_PATTERNS: pattern `client`: ") {
+			t.Fatalf("Failed test whether the redaction patterns are validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("REDACT_PATTERNS", `{"client": "[A-Za-z]+-iPhone"}`)
+	os.Setenv("REDACT_HISTORY", "drop")
+
+	t.Run("Notifications and history are redacted", func(t *testing.T) {
+		buf.Reset()
+		notifiers, server, _, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialise with redaction; error is `%v`", err)
+		}
+
+		measured, ok := notifiers[0].(notifier.Measured)
+		if !ok {
+			t.Fatalf("Expected a measured notifier, got %T", notifiers[0])
+		}
+		redacted, ok := measured.Notifier.(notifier.Redacted)
+		if !ok || redacted.Redactor.Mode != redact.ModeHash || redacted.Redactor.Detectors[0].Name != "client" {
+			t.Fatalf("Expected the notifications to be redacted, got %+v", measured.Notifier)
+		}
+		if server.RedactHistory == nil || server.RedactHistory.Mode != redact.ModeDrop {
+			t.Fatalf("Expected the history to be redacted, got %+v", server.RedactHistory)
+		}
+	})
+
+	os.Unsetenv("REDACT_NOTIFICATIONS")
+	os.Unsetenv("REDACT_HASH_SECRET")
+	os.Unsetenv("REDACT_LOGS")
+	os.Unsetenv("REDACT_PATTERNS")
+	os.Unsetenv("REDACT_HISTORY")
+
+	os.Setenv("TLS_CERT_FILE", "/certs/cert.pem")
+
+	t.Run("TLS needs both a certificate and a key", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "TLS_CERT_FILE and TLS_KEY_FILE must be set together" {
+			t.Fatalf("Failed test whether TLS needs a key; error is `%v`", err)
+		}
+	})
+
+	os.Unsetenv("TLS_CERT_FILE")
+
+	os.Setenv("FALLBACK_NTFY_URL", "https://ntfy.example.com")
+
+	t.Run("Fallback destinations are validated", func(t *testing.T) {
+		buf.Reset()
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || err.Error() != "FALLBACK_NTFY_TOPIC environment variable is required" {
+			t.Fatalf("Failed test whether the fallback destination is validated; error is `%v`", err)
+		}
+	})
+
+	os.Setenv("FALLBACK_NTFY_TOPIC", "omada_bridge")
+	os.Setenv("FALLBACK_ERROR_RATE", "50%")
+
+	t.Run("Delivery failures are reported through the fallback", func(t *testing.T) {
+		buf.Reset()
+		notifiers, server, _, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialise with a fallback; error is `%v`", err)
+		}
+		for _, n := range notifiers {
+			if c, ok := notifier.Unwrap(n).(*ntfy.NtfyClient); ok && c.Topic == "omada_bridge" {
+				t.Fatalf("Expected the fallback not to be one of the destinations")
+			}
+		}
+
+		w := server.Watchdog
+		if w == nil || w.Failures != 5 || w.ErrorRate != 0.5 || w.Window != 20 {
+			t.Fatalf("Watchdog not configured as expected: %+v", w)
+		}
+		if fallback := notifier.Unwrap(w.Fallback.(notifier.Multi)[0]).(*ntfy.NtfyClient); fallback.Topic != "omada_bridge" {
+			t.Fatalf("Fallback not configured as expected; Topic is `%v`", fallback.Topic)
+		}
+	})
+
+	os.Unsetenv("FALLBACK_NTFY_URL")
+	os.Unsetenv("FALLBACK_NTFY_TOPIC")
+	os.Unsetenv("FALLBACK_ERROR_RATE")
+}
+
+func TestConfigFile(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	// Start from a clean slate, whatever the other tests left behind
+	for _, key := range []string{"NTFY_URL", "NTFY_TOPIC", "OMADA_SHARED_SECRET", "GOTIFY_URL", "DISCORD_WEBHOOK_URL", "PORT"} {
+		t.Setenv(key, "")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("TEST_OMADA_SECRET", "from-file")
+
+	os.WriteFile(path, []byte(`
+omada_shared_secret = "${TEST_OMADA_SECRET}"
+port = 9090
+log_payloads = false
+
+[ntfy]
+url = "https://ntfy.sh"
+topic = "from-file"
+types = ["offline", "online"]
+`), 0o600)
+
+	t.Run("Configures from the file", func(t *testing.T) {
+		buf.Reset()
+
+		notifiers, server, port, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialise from the config file: %v", err)
+		}
+
+		client, ok := notifier.Unwrap(notifiers[0]).(*ntfy.NtfyClient)
+		if !ok || client.Topic != "from-file" || server.SharedSecret != "from-file" || server.LogPayloads || port != "9090" {
+			t.Fatalf("Config file not applied; got topic %#v, secret `%v`, port %v", notifiers[0], server.SharedSecret, port)
+		}
+	})
+
+	t.Setenv("NTFY_TOPIC", "from-env")
+
+	t.Run("The environment overrides the file", func(t *testing.T) {
+		buf.Reset()
+
+		notifiers, _, _, err := main.InitMain(logger)
+		if err != nil {
+			t.Fatalf("Failed to initialise from the config file: %v", err)
+		}
+
+		if client := notifier.Unwrap(notifiers[0]).(*ntfy.NtfyClient); client.Topic != "from-env" {
+			t.Fatalf("Expected the topic from the environment, got `%v`", client.Topic)
+		}
+	})
+
+	os.WriteFile(path, []byte("port = eighty\n"), 0o600)
+
+	t.Run("Invalid config files are rejected", func(t *testing.T) {
+		buf.Reset()
+
+		_, _, _, err := main.InitMain(logger)
+		if err == nil || !strings.Contains(err.Error(), "line 1: invalid value `eighty`") {
+			t.Fatalf("Expected an error for the invalid config file, got `%v`", err)
+		}
+	})
+}
+
+func TestHealthcheck(t *testing.T) {
+	healthy := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	if code := main.Healthcheck([]string{"-url", server.URL + "/healthz"}); code != 0 {
+		t.Errorf("Healthcheck() = %d for a healthy server, want 0", code)
+	}
+
+	healthy = false
+
+	if code := main.Healthcheck([]string{"-url", server.URL + "/readyz"}); code != 1 {
+		t.Errorf("Healthcheck() = %d for an unhealthy server, want 1", code)
+	}
+
+	if code := main.Healthcheck([]string{"-url", "http://127.0.0.1:1/healthz", "-timeout", "1s"}); code != 1 {
+		t.Errorf("Healthcheck() = %d for an unreachable server, want 1", code)
+	}
+
+	t.Run("Probes over HTTPS with TLS_CERT_FILE", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		t.Setenv("CONFIG_FILE", "")
+		t.Setenv("PORT", server.URL[strings.LastIndex(server.URL, ":")+1:])
+		t.Setenv("TLS_CERT_FILE", "cert.pem")
+
+		if code := main.Healthcheck(nil); code != 0 {
+			t.Errorf("Healthcheck() = %d for a healthy server over HTTPS, want 0", code)
+		}
+	})
+}
+
+func TestHandleWebhook(t *testing.T) {
+	webhook := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	other := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+
+	tests := map[string][]struct {
+		method string
+		path   string
+		code   int
+	}{
+		"": {
+			{"POST", "/", 200},
+			{"POST", "/any/path", 200},
+			{"GET", "/", 405},
+			{"POST", "/dashboard/", http.StatusTeapot},
+		},
+		"/omada": {
+			{"POST", "/omada", 200},
+			{"POST", "/", 404},
+			{"GET", "/omada", 405},
+		},
+		"/hooks/": {
+			{"POST", "/hooks/", 200},
+			{"POST", "/hooks/below", 404},
+		},
+	}
+
+	for path, requests := range tests {
+		mux := http.NewServeMux()
+		mux.Handle("/dashboard/", other)
+		main.HandleWebhook(mux, path, webhook)
+
+		for _, r := range requests {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(r.method, r.path, nil))
+
+			if w.Code != r.code {
+				t.Errorf("WEBHOOK_PATH=%q: %v %v = %d, want %d", path, r.method, r.path, w.Code, r.code)
+			}
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, key := range []string{"NTFY_URL", "NTFY_TOPIC", "OMADA_SHARED_SECRET", "GOTIFY_URL", "DISCORD_WEBHOOK_URL"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("CONFIG_FILE", "")
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte("omada_shared_secret = 'foo'\n[ntfy]\nurl = 'https://ntfy.sh'\ntopic = 'alerts'\n"), 0o600)
+
+	var out bytes.Buffer
+	if code := main.ValidateConfig([]string{"-config", path}, &out); code != 0 || out.String() != "Configuration is valid, with destinations:\n  ntfy\n" {
+		t.Errorf("ValidateConfig() = %d for a valid config, printing `%v`", code, out.String())
+	}
+
+	// Checking has no side effects: no files are created, and the
+	// environment is left as it was
+	historyFile := filepath.Join(t.TempDir(), "history.jsonl")
+	os.WriteFile(path, []byte("omada_shared_secret = 'foo'\nhistory_file = '"+historyFile+"'\n[ntfy]\nurl = 'https://ntfy.sh'\ntopic = 'alerts'\n"), 0o600)
+
+	out.Reset()
+	if code := main.ValidateConfig([]string{"-config", path}, &out); code != 0 {
+		t.Errorf("ValidateConfig() = %d for a valid config with a history file", code)
+	}
+	if _, err := os.Stat(historyFile); !os.IsNotExist(err) {
+		t.Errorf("Expected validating not to create the history file, got %v", err)
+	}
+	if v := os.Getenv("CONFIG_FILE"); v != "" {
+		t.Errorf("Expected CONFIG_FILE to be left alone, got `%v`", v)
+	}
+
+	os.WriteFile(path, []byte("[ntfy]\nurl = 'https://ntfy.sh'\n"), 0o600)
+
+	out.Reset()
+	if code := main.ValidateConfig([]string{"-config", path}, &out); code != 1 {
+		t.Errorf("ValidateConfig() = %d for an invalid config, want 1", code)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	t.Setenv("NTFY_URL", "")
+	t.Setenv("CONFIG_FILE", "")
+
+	payload := `{"Controller":"Home","Site":"Default","text":["[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was online."]}`
+
+	var out bytes.Buffer
+	if code := main.Classify(nil, strings.NewReader(payload), &out); code != 0 {
+		t.Fatalf("Classify() = %d, want 0", code)
+	}
+
+	for _, want := range []string{
+		"Type:          online\n",
+		"Priority:      7 (ntfy 4)\n",
+		"Tags:          white_check_mark\n",
+		"Interface:     2.5G WAN1\n",
+		"POST /omada_alerts HTTP/1.1\n",
+		"Title: Home: Default\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Classify() output is missing `%v`; got:\n%v", strings.TrimSpace(want), out.String())
+		}
+	}
+
+	if code := main.Classify(nil, strings.NewReader("not json"), &out); code != 1 {
+		t.Errorf("Classify() = %d for an invalid payload, want 1", code)
+	}
+
+	t.Run("Redacted as it would be sent", func(t *testing.T) {
+		t.Setenv("REDACT_NOTIFICATIONS", "mask")
+
+		var out bytes.Buffer
+		if code := main.Classify(nil, strings.NewReader(payload), &out); code != 0 {
+			t.Fatalf("Classify() = %d, want 0", code)
+		}
+
+		if got := out.String(); !strings.Contains(got, "Type:          online\n") || !strings.Contains(got, "Device:        gateway:[mac]\n") || strings.Contains(got, "8D-53") {
+			t.Errorf("Expected the device to be redacted, with the type kept; got:\n%v", got)
+		}
+	})
+}
+
+func TestVersion(t *testing.T) {
+	var out bytes.Buffer
+
+	if code := main.Version(nil, &out); code != 0 || !strings.HasPrefix(out.String(), "omada-to-ntfy ") {
+		t.Errorf("Version() = %d, printing `%v`", code, out.String())
+	}
+}
+
+func TestReplay(t *testing.T) {
+	for _, key := range []string{"NTFY_URL", "NTFY_TOPIC", "OMADA_SHARED_SECRET", "GOTIFY_URL", "DISCORD_WEBHOOK_URL", "NTFY_TYPES", "NTFY_MIN_PRIORITY"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("CONFIG_FILE", "")
+
+	dir := t.TempDir()
+
+	configPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(configPath, []byte("omada_shared_secret = 'foo'\n[ntfy]\nurl = 'https://ntfy.sh'\ntopic = 'alerts'\ntypes = ['offline']\n"), 0o600)
+
+	// A record written by capture mode, and a bare payload
+	capturePath := filepath.Join(dir, "capture.jsonl")
+	os.WriteFile(capturePath, []byte(
+		`{"time":"2025-09-26T02:15:04Z","method":"POST","path":"/?controller=Home","headers":{},"body":{"Controller":"Home","Site":"Default","shardSecret":"****","text":["[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline."]}}`+"\n"+
+			`{"Controller":"Home","Site":"Default","text":["[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was online."],"timestamp":1758852934790}`+"\n",
+	), 0o600)
+
+	t.Run("Dry run shows the routing", func(t *testing.T) {
+		var out bytes.Buffer
+		if code := main.Replay([]string{"-config", configPath, capturePath}, nil, &out); code != 0 {
+			t.Fatalf("Replay() = %d, want 0", code)
+		}
+
+		for _, want := range []string{
+			"#1 2025-09-26 02:15:04: offline, priority 10\n  Title: Home: Default\n",
+			"  ntfy: would send\n",
+			"#2 ",
+			": online, priority 7\n",
+			"  ntfy: skipped by its routing rules\n",
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Replay() output is missing `%v`; got:\n%v", want, out.String())
+			}
+		}
+	})
+
+	t.Run("Payloads are posted to a running bridge", func(t *testing.T) {
+		var received, queries []string
+
+		bridge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header["Access_token"][0] != "foo" {
+				http.Error(w, "Not authorized", http.StatusForbidden)
+				return
+			}
+			body := new(bytes.Buffer)
+			body.ReadFrom(r.Body)
+			received = append(received, body.String())
+			queries = append(queries, r.URL.RawQuery)
+		}))
+		defer bridge.Close()
+
+		var out bytes.Buffer
+		if code := main.Replay([]string{"-config", configPath, "-url", bridge.URL, "-speed", "0", capturePath}, nil, &out); code != 0 {
+			t.Fatalf("Replay() = %d, want 0; output:\n%v", code, out.String())
+		}
+
+		if len(received) != 2 || !strings.Contains(received[0], "was offline") || !strings.Contains(received[1], "was online") {
+			t.Errorf("Bridge received unexpected payloads: %v", received)
+		}
+		if len(queries) != 2 || queries[0] != "controller=Home" || queries[1] != "" {
+			t.Errorf("Expected the captured query to be sent along, got %q", queries)
+		}
+
+		received = nil
+		out.Reset()
+		if code := main.Replay([]string{"-config", configPath, "-url", bridge.URL, "-speed", "0", "-restamp", capturePath}, nil, &out); code != 0 {
+			t.Fatalf("Replay() = %d with -restamp, want 0; output:\n%v", code, out.String())
+		}
+
+		for _, body := range received {
+			var msg omada.OmadaMessage
+			json.Unmarshal([]byte(body), &msg)
+			if time.Since(msg.Date()) > time.Minute {
+				t.Errorf("Expected the payload to be sent with the current time, got %v", body)
+			}
+		}
+	})
+
+	t.Run("Dry run shows the notifications redacted", func(t *testing.T) {
+		t.Setenv("REDACT_NOTIFICATIONS", "mask")
+
+		var out bytes.Buffer
+		if code := main.Replay([]string{"-config", configPath, capturePath}, nil, &out); code != 0 {
+			t.Fatalf("Replay() = %d, want 0", code)
+		}
+
+		if !strings.Contains(out.String(), "[gateway:[mac]]") || strings.Contains(out.String(), "98-03-8E") {
+			t.Errorf("Expected the MAC address to be redacted; got:\n%v", out.String())
+		}
+	})
+
+	t.Run("An invalid configuration fails", func(t *testing.T) {
+		t.Setenv("OMADA_SHARED_SECRET", "")
+		os.WriteFile(configPath, []byte("[ntfy]\nurl = 'https://ntfy.sh'\n"), 0o600)
+
+		var out bytes.Buffer
+		if code := main.Replay([]string{"-config", configPath, capturePath}, nil, &out); code != 1 {
+			t.Errorf("Replay() = %d for an invalid configuration, want 1", code)
 		}
 	})
 }
@@ -0,0 +1,167 @@
+// Package metrics keeps count of what the bridge is doing and serves it in
+// the Prometheus text format, without depending on the Prometheus client.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Buckets for delivery latencies in seconds, from a fast local ntfy up to
+// the point where something is clearly wrong.
+var deliveryBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics holds everything that's measured. All methods can be called on a
+// nil *Metrics, in which case nothing is recorded.
+type Metrics struct {
+	WebhooksReceived *CounterVec
+	AuthFailures     *CounterVec
+	ParseErrors      *CounterVec
+	Deliveries       *CounterVec
+	HTTPResponses    *CounterVec
+	Suppressed       *CounterVec
+	DeliveryDuration *HistogramVec
+
+	inFlight   atomic.Int64
+	collectors []collector
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		WebhooksReceived: newCounterVec("omada_webhooks_received_total", "Omada webhook messages received and parsed.", "controller", "site", "type"),
+		AuthFailures:     newCounterVec("omada_webhook_auth_failures_total", "Webhook requests rejected for a missing or wrong shared secret, a locked out or a disallowed address, by reason.", "reason"),
+		ParseErrors:      newCounterVec("omada_webhook_parse_errors_total", "Webhook requests whose body could not be parsed as an Omada message."),
+		Deliveries:       newCounterVec("omada_deliveries_total", "Messages delivered to a notifier, by result.", "notifier", "result"),
+		HTTPResponses:    newCounterVec("omada_notifier_http_responses_total", "HTTP responses received by notifiers, by status code.", "notifier", "code"),
+		Suppressed:       newCounterVec("omada_events_suppressed_total", "Messages not delivered to a notifier on purpose, by reason.", "notifier", "reason"),
+		DeliveryDuration: newHistogramVec("omada_delivery_duration_seconds", "Time taken to deliver a message to a notifier.", deliveryBuckets, "notifier"),
+	}
+
+	m.collectors = []collector{
+		m.WebhooksReceived,
+		m.AuthFailures,
+		m.ParseErrors,
+		m.Deliveries,
+		m.HTTPResponses,
+		m.Suppressed,
+		m.DeliveryDuration,
+		&GaugeFunc{
+			name:  "omada_deliveries_in_flight",
+			help:  "Deliveries currently in progress; deliveries are made while Omada waits, so this is the queue depth.",
+			value: func() float64 { return float64(m.InFlight()) },
+		},
+	}
+
+	return m
+}
+
+// WebhookReceived counts a parsed Omada message.
+func (m *Metrics) WebhookReceived(controller string, site string, messageType string) {
+	if m == nil {
+		return
+	}
+	m.WebhooksReceived.Inc(controller, site, messageType)
+}
+
+// AuthFailure counts a request rejected before it's read, for the reason
+// given: `secret`, `lockout` or `address`.
+func (m *Metrics) AuthFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.AuthFailures.Inc(reason)
+}
+
+// ParseError counts a request that could not be parsed.
+func (m *Metrics) ParseError() {
+	if m == nil {
+		return
+	}
+	m.ParseErrors.Inc()
+}
+
+// SuppressedEvent counts a message deliberately not delivered to a notifier.
+func (m *Metrics) SuppressedEvent(notifier string, reason string) {
+	if m == nil {
+		return
+	}
+	m.Suppressed.Inc(notifier, reason)
+}
+
+// StartDelivery marks the start of a delivery to a notifier. Call the
+// returned function with the delivery result when it's done.
+func (m *Metrics) StartDelivery(notifier string) func(err error) {
+	if m == nil {
+		return func(error) {}
+	}
+
+	start := time.Now()
+	m.inFlight.Add(1)
+
+	return func(err error) {
+		m.inFlight.Add(-1)
+		m.DeliveryDuration.Observe(time.Since(start).Seconds(), notifier)
+
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		m.Deliveries.Inc(notifier, result)
+	}
+}
+
+// InFlight returns the number of deliveries currently in progress.
+func (m *Metrics) InFlight() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.inFlight.Load()
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if m == nil {
+		return
+	}
+
+	for _, c := range m.collectors {
+		c.write(w)
+	}
+}
+
+type transport struct {
+	metrics  *Metrics
+	notifier string
+	next     http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.metrics.HTTPResponses.Inc(t.notifier, "error")
+		return resp, err
+	}
+
+	t.metrics.HTTPResponses.Inc(t.notifier, strconv.Itoa(resp.StatusCode))
+	return resp, nil
+}
+
+// Transport wraps an HTTP transport (nil for the default) to count the status
+// codes of the responses a notifier receives.
+func (m *Metrics) Transport(notifier string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	if m == nil {
+		return next
+	}
+
+	return &transport{metrics: m, notifier: notifier, next: next}
+}
+
+// EOF
@@ -0,0 +1,96 @@
+package metrics_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/metrics"
+)
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := metrics.New()
+
+	m.WebhookReceived("Omada \"Main\"", "Home", "offline")
+	m.WebhookReceived("Omada \"Main\"", "Home", "offline")
+	m.AuthFailure("secret")
+
+	done := m.StartDelivery("ntfy")
+	if m.InFlight() != 1 {
+		t.Errorf("Expected 1 delivery in flight, got %d", m.InFlight())
+	}
+	done(nil)
+
+	m.StartDelivery("ntfy")(errors.New("failed"))
+
+	response := httptest.NewRecorder()
+	m.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	got := response.Body.String()
+
+	for _, want := range []string{
+		"# TYPE omada_webhooks_received_total counter\n",
+		`omada_webhooks_received_total{controller="Omada \"Main\"",site="Home",type="offline"} 2` + "\n",
+		`omada_webhook_auth_failures_total{reason="secret"} 1` + "\n",
+		"omada_webhook_parse_errors_total 0\n",
+		`omada_deliveries_total{notifier="ntfy",result="failure"} 1` + "\n",
+		`omada_deliveries_total{notifier="ntfy",result="success"} 1` + "\n",
+		"# TYPE omada_delivery_duration_seconds histogram\n",
+		`omada_delivery_duration_seconds_bucket{notifier="ntfy",le="0.05"} 2` + "\n",
+		`omada_delivery_duration_seconds_bucket{notifier="ntfy",le="+Inf"} 2` + "\n",
+		`omada_delivery_duration_seconds_count{notifier="ntfy"} 2` + "\n",
+		"omada_deliveries_in_flight 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Metrics output does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	m := metrics.New()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: m.Transport("ntfy", nil)}
+
+	for _, path := range []string{"/", "/", "/forbidden"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := m.HTTPResponses.Value("ntfy", "200"); got != 2 {
+		t.Errorf("Expected 2 responses with status 200, got %v", got)
+	}
+
+	if got := m.HTTPResponses.Value("ntfy", "403"); got != 1 {
+		t.Errorf("Expected 1 response with status 403, got %v", got)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics.Metrics
+
+	// None of these should panic when metrics are not enabled
+	m.WebhookReceived("controller", "site", "test")
+	m.AuthFailure("secret")
+	m.ParseError()
+	m.SuppressedEvent("ntfy", "route")
+	m.StartDelivery("ntfy")(nil)
+
+	if m.Transport("ntfy", nil) != http.DefaultTransport {
+		t.Error("Transport() on nil metrics should return the transport unchanged")
+	}
+}
+
+// EOF
@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * Minimal counters, gauges and histograms written out in the Prometheus
+ * text exposition format, see
+ * https://prometheus.io/docs/instrumenting/exposition_formats/
+ */
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// vec holds one value per combination of label values; the key is the
+// label values joined by a zero byte.
+type vec[T any] struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]T
+}
+
+func (v *vec[T]) get(labelValues []string, create func() T) T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	value, ok := v.values[key]
+	if !ok {
+		value = create()
+		v.values[key] = value
+	}
+
+	return value
+}
+
+// each calls fn for every label combination in a stable order.
+func (v *vec[T]) each(fn func(labels string, value T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		var pairs []string
+		if len(v.labels) > 0 {
+			for i, value := range strings.Split(key, "\x00") {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", v.labels[i], escapeLabelValue(value)))
+			}
+		}
+		fn(strings.Join(pairs, ","), v.values[key])
+	}
+}
+
+func (v *vec[T]) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+// Label values are written with %q, which already escapes backslashes,
+// quotes and newlines; this just keeps %q from escaping everything else.
+func escapeLabelValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if !strconv.IsPrint(r) && r != '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func withLabels(name string, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec[*float64]
+}
+
+func newCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec[*float64]{name: name, help: help, kind: "counter", labels: labels, values: map[string]*float64{}}}
+
+	// Without labels there's just the one series, so show it from the start
+	if len(labels) == 0 {
+		c.get(nil, func() *float64 { return new(float64) })
+	}
+
+	return c
+}
+
+// Inc adds one to the counter for the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	value := c.get(labelValues, func() *float64 { return new(float64) })
+
+	c.mu.Lock()
+	*value++
+	c.mu.Unlock()
+}
+
+// Value returns the current count for the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	value := c.get(labelValues, func() *float64 { return new(float64) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, value *float64) {
+		fmt.Fprintf(w, "%s %s\n", withLabels(c.name, labels), formatFloat(*value))
+	})
+}
+
+// GaugeFunc is a gauge whose value is looked up when the metrics are read.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec[*histogram]
+	buckets []float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		vec:     vec[*histogram]{name: name, help: help, kind: "histogram", labels: labels, values: map[string]*histogram{}},
+		buckets: buckets,
+	}
+}
+
+// Observe records a value in the histogram for the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	hist := h.get(labelValues, func() *histogram { return &histogram{counts: make([]uint64, len(h.buckets))} })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, hist *histogram) {
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", h.name, labels, sep, formatFloat(upper), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, labels, sep, hist.count)
+		fmt.Fprintf(w, "%s %s\n", withLabels(h.name+"_sum", labels), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s %d\n", withLabels(h.name+"_count", labels), hist.count)
+	})
+}
+
+// EOF
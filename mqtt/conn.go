@@ -0,0 +1,226 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+/*
+ * Just enough of MQTT 3.1.1 to connect to a broker and publish to it, see
+ * https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+ *
+ * Nothing is ever subscribed to, so the only packets coming back from the
+ * broker are acknowledgements to what was sent, which keeps this synchronous.
+ */
+
+// MQTT control packet types, shifted into the high nibble of the first byte.
+const (
+	packetConnect    byte = 1 << 4
+	packetConnack    byte = 2 << 4
+	packetPublish    byte = 3 << 4
+	packetPuback     byte = 4 << 4
+	packetDisconnect byte = 14 << 4
+)
+
+const operationTimeout = 10 * time.Second
+
+// conn is a connection to a broker, over which messages can be published
+// one at a time.
+type conn struct {
+	net.Conn
+	r        *bufio.Reader
+	packetID uint16
+	deadline time.Time // When the delivery is given up on; none when zero
+}
+
+// until returns the deadline for the next operation: operationTimeout from
+// now, or that of the delivery when it's sooner.
+func (c *conn) until() time.Time {
+	until := time.Now().Add(operationTimeout)
+	if !c.deadline.IsZero() && c.deadline.Before(until) {
+		return c.deadline
+	}
+	return until
+}
+
+type packet struct {
+	header byte
+	body   []byte
+}
+
+// appendString appends the length prefixed UTF-8 string MQTT uses.
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendRemainingLength appends the variable length encoding of the number
+// of bytes following the fixed header.
+func appendRemainingLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func (c *conn) writePacket(header byte, body []byte) error {
+	b := appendRemainingLength([]byte{header}, len(body))
+	b = append(b, body...)
+
+	c.SetWriteDeadline(c.until())
+	_, err := c.Write(b)
+	return err
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		if i == 4 {
+			return packet{}, errors.New("malformed MQTT remaining length")
+		}
+
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+
+	return packet{header: header, body: body}, nil
+}
+
+func (c *conn) readPacket() (packet, error) {
+	c.SetReadDeadline(c.until())
+	return readPacket(c.r)
+}
+
+// connectReturnCodes explains the CONNACK return codes, index is the code.
+var connectReturnCodes = []string{
+	"accepted",
+	"unacceptable protocol version",
+	"identifier rejected",
+	"server unavailable",
+	"bad user name or password",
+	"not authorized",
+}
+
+// connect performs the MQTT handshake on an already opened network
+// connection, which is given up on at the deadline of the context.
+func connect(ctx context.Context, nc net.Conn, clientID string, username string, password string) (*conn, error) {
+	c := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	c.deadline, _ = ctx.Deadline()
+
+	var flags byte = 0x02 // Clean session
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags) // Protocol level 4 is MQTT 3.1.1
+	body = binary.BigEndian.AppendUint16(body, 60)
+	body = appendString(body, clientID)
+	if username != "" {
+		body = appendString(body, username)
+		if password != "" {
+			body = appendString(body, password)
+		}
+	}
+
+	if err := c.writePacket(packetConnect, body); err != nil {
+		return nil, err
+	}
+
+	p, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.header&0xf0 != packetConnack || len(p.body) != 2 {
+		return nil, fmt.Errorf("expected CONNACK from MQTT broker, got packet type %d", p.header>>4)
+	}
+
+	if code := int(p.body[1]); code != 0 {
+		reason := "unknown reason"
+		if code < len(connectReturnCodes) {
+			reason = connectReturnCodes[code]
+		}
+		return nil, fmt.Errorf("MQTT broker refused connection: %s", reason)
+	}
+
+	return c, nil
+}
+
+// publish sends a message with QoS 1 and waits for the broker to
+// acknowledge it.
+func (c *conn) publish(topic string, payload []byte, retain bool) error {
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+
+	header := packetPublish | 1<<1 // QoS 1
+	if retain {
+		header |= 0x01
+	}
+
+	body := appendString(nil, topic)
+	body = binary.BigEndian.AppendUint16(body, c.packetID)
+	body = append(body, payload...)
+
+	if err := c.writePacket(header, body); err != nil {
+		return err
+	}
+
+	p, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if p.header&0xf0 != packetPuback || len(p.body) != 2 || !bytes.Equal(p.body, binary.BigEndian.AppendUint16(nil, c.packetID)) {
+		return fmt.Errorf("expected PUBACK for packet %d from MQTT broker", c.packetID)
+	}
+
+	return nil
+}
+
+// disconnect tells the broker the connection is being closed on purpose,
+// and closes it.
+func (c *conn) disconnect() error {
+	err := c.writePacket(packetDisconnect, nil)
+	c.Close()
+	return err
+}
+
+// EOF
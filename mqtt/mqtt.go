@@ -0,0 +1,243 @@
+// Package mqtt publishes Omada events to an MQTT broker, including the
+// retained device state and discovery configuration Home Assistant needs to
+// show devices as binary sensors.
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// The default topic layouts. Placeholders are replaced by the values for
+// the message, with `{device}` being the device MAC address (or `controller`
+// for messages not about a device) and `{interface}` being e.g. `2.5G WAN1`
+// (or `device` for messages about the device as a whole).
+const (
+	DefaultTopic           = "omada/{controller}/{site}/{device}/{event}"
+	DefaultStateTopic      = "omada/{controller}/{site}/{device}/{interface}/state"
+	DefaultDiscoveryPrefix = "homeassistant"
+)
+
+// Payloads of the retained state topics.
+const (
+	StateOnline  = "online"
+	StateOffline = "offline"
+)
+
+type MQTTClient struct {
+	BrokerURL       string // mqtt://host:1883, or mqtts://host:8883 for TLS
+	Username        string
+	Password        string
+	ClientID        string
+	Topic           string // Defaults to DefaultTopic
+	StateTopic      string // Defaults to DefaultStateTopic
+	Discovery       bool   // Publish Home Assistant discovery configs
+	DiscoveryPrefix string // Defaults to DefaultDiscoveryPrefix
+	Logger          *slog.Logger
+
+	mu         sync.Mutex
+	discovered map[string]bool
+}
+
+// topicSegmentRe matches what can't be used inside a single topic level.
+var topicSegmentRe = regexp.MustCompile(`[/+#\x00]`)
+
+// objectIDRe matches what Home Assistant doesn't allow in discovery IDs.
+var objectIDRe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+func topicSegment(s string, fallback string) string {
+	s = strings.TrimSpace(topicSegmentRe.ReplaceAllString(s, "_"))
+	if s == "" {
+		return fallback
+	}
+
+	return s
+}
+
+func objectID(s string) string {
+	return strings.Trim(objectIDRe.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+// Topics returns the event topic and state topic for the message, with the
+// placeholders of the configured layouts filled in.
+func (mc *MQTTClient) Topics(payload *omada.OmadaMessage) (topic string, stateTopic string) {
+	replacer := strings.NewReplacer(
+		"{controller}", topicSegment(payload.Controller, "unknown"),
+		"{site}", topicSegment(payload.Site, "unknown"),
+		"{device}", topicSegment(payload.DeviceMAC(), "controller"),
+		"{interface}", topicSegment(payload.Interface(), "device"),
+		"{event}", payload.Type().String(),
+	)
+
+	topic, stateTopic = mc.Topic, mc.StateTopic
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	if stateTopic == "" {
+		stateTopic = DefaultStateTopic
+	}
+
+	return replacer.Replace(topic), replacer.Replace(stateTopic)
+}
+
+// discoveryConfig builds the Home Assistant MQTT discovery topic and config
+// for a connectivity binary sensor following the state topic, see
+// https://www.home-assistant.io/integrations/binary_sensor.mqtt/
+func (mc *MQTTClient) discoveryConfig(payload *omada.OmadaMessage, stateTopic string) (string, []byte, error) {
+	prefix := mc.DiscoveryPrefix
+	if prefix == "" {
+		prefix = DefaultDiscoveryPrefix
+	}
+
+	mac := payload.DeviceMAC()
+	node := "omada_" + objectID(mac)
+
+	name := payload.Interface()
+	object := objectID(name)
+	if name == "" {
+		name = "Connectivity"
+		object = "device"
+	}
+
+	device := payload.Device()
+	model, _, _ := strings.Cut(device, ":")
+
+	info := map[string]any{
+		"identifiers":  []string{node},
+		"name":         fmt.Sprintf("Omada %s", device),
+		"manufacturer": "TP-Link",
+		"model":        model,
+	}
+
+	// Not when the MAC address was redacted to a pseudonym
+	if hw, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":")); err == nil {
+		info["connections"] = [][]string{{"mac", hw.String()}}
+	}
+
+	config, err := json.Marshal(map[string]any{
+		"name":         name,
+		"unique_id":    node + "_" + object,
+		"state_topic":  stateTopic,
+		"payload_on":   StateOnline,
+		"payload_off":  StateOffline,
+		"device_class": "connectivity",
+		"device":       info,
+	})
+
+	return fmt.Sprintf("%s/binary_sensor/%s/%s/config", prefix, node, object), config, err
+}
+
+// dial opens the network connection to the broker, using TLS for the
+// mqtts:// scheme.
+func (mc *MQTTClient) dial(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(mc.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: operationTimeout}
+
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		return dialer.DialContext(ctx, "tcp", hostWithDefaultPort(u, "1883"))
+	case "mqtts", "ssl", "tls":
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}
+		return tlsDialer.DialContext(ctx, "tcp", hostWithDefaultPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker URL scheme `%v`", u.Scheme)
+	}
+}
+
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Send publishes the message as a JSON event, and for online and offline
+// messages also updates the retained device state (after announcing the
+// device to Home Assistant the first time it's seen).
+func (mc *MQTTClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	topic, stateTopic := mc.Topics(payload)
+
+	event, err := json.Marshal(payload.Event())
+	if err != nil {
+		mc.Logger.ErrorContext(ctx, "Could not encode MQTT event", "error", err)
+		return err
+	}
+
+	nc, err := mc.dial(ctx)
+	if err != nil {
+		mc.Logger.ErrorContext(ctx, "Could not connect to MQTT broker", "error", err)
+		return err
+	}
+
+	clientID := mc.ClientID
+	if clientID == "" {
+		clientID = "omada-to-ntfy"
+	}
+
+	c, err := connect(ctx, nc, clientID, mc.Username, mc.Password)
+	if err != nil {
+		nc.Close()
+		mc.Logger.ErrorContext(ctx, "Could not connect to MQTT broker", "error", err)
+		return err
+	}
+	defer c.disconnect()
+
+	if err := c.publish(topic, event, false); err != nil {
+		mc.Logger.ErrorContext(ctx, "Could not publish to MQTT", "topic", topic, "error", err)
+		return err
+	}
+
+	var state string
+	switch payload.Type() {
+	case omada.OmadaOfflineMessage:
+		state = StateOffline
+	case omada.OmadaOnlineMessage:
+		state = StateOnline
+	}
+
+	if state != "" && payload.DeviceMAC() != "" {
+		if mc.Discovery && !mc.discovered[stateTopic] {
+			discoveryTopic, config, err := mc.discoveryConfig(payload, stateTopic)
+			if err == nil {
+				err = c.publish(discoveryTopic, config, true)
+			}
+			if err != nil {
+				mc.Logger.ErrorContext(ctx, "Could not publish Home Assistant discovery config", "error", err)
+				return err
+			}
+
+			if mc.discovered == nil {
+				mc.discovered = map[string]bool{}
+			}
+			mc.discovered[stateTopic] = true
+		}
+
+		if err := c.publish(stateTopic, []byte(state), true); err != nil {
+			mc.Logger.ErrorContext(ctx, "Could not publish to MQTT", "topic", stateTopic, "error", err)
+			return err
+		}
+	}
+
+	mc.Logger.InfoContext(ctx, "Message published to MQTT", "topic", topic)
+	return nil
+}
+
+// EOF
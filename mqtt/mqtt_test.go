@@ -0,0 +1,262 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+)
+
+type published struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// fakeBroker accepts MQTT connections and acknowledges everything, keeping
+// track of what was published to it.
+type fakeBroker struct {
+	listener  net.Listener
+	connects  chan []byte
+	published chan published
+}
+
+func newFakeBroker(t *testing.T, returnCode byte) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	b := &fakeBroker{listener: listener, connects: make(chan []byte, 10), published: make(chan published, 100)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				for {
+					p, err := readPacket(r)
+					if err != nil {
+						return
+					}
+
+					switch p.header & 0xf0 {
+					case packetConnect:
+						b.connects <- p.body
+						conn.Write([]byte{packetConnack, 2, 0, returnCode})
+					case packetPublish:
+						topicLen := int(binary.BigEndian.Uint16(p.body))
+						topic := string(p.body[2 : 2+topicLen])
+						id := p.body[2+topicLen : 4+topicLen]
+						b.published <- published{topic, string(p.body[4+topicLen:]), p.header&0x01 == 1}
+						conn.Write(append([]byte{packetPuback, 2}, id...))
+					case packetDisconnect:
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeBroker) drain() []published {
+	var all []published
+	for {
+		select {
+		case p := <-b.published:
+			all = append(all, p)
+		default:
+			return all
+		}
+	}
+}
+
+func TestAppendRemainingLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+
+	for _, tt := range tests {
+		got := appendRemainingLength(nil, tt.n)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("appendRemainingLength(%d) = %x, want %x", tt.n, got, tt.want)
+		}
+
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(append(append([]byte{packetPublish}, got...), make([]byte, tt.n)...))))
+		if err != nil || len(p.body) != tt.n {
+			t.Errorf("readPacket() could not read back a body of %d bytes: %v", tt.n, err)
+		}
+	}
+}
+
+func TestMQTTClientSend(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
+	)
+
+	offline := &omada.OmadaMessage{
+		Controller: "Omada_Controller",
+		Site:       "Home",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r"},
+		Timestamp:  1758852904877,
+	}
+
+	online := &omada.OmadaMessage{
+		Controller: "Omada_Controller",
+		Site:       "Home",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was online.\r"},
+		Timestamp:  1758852934790,
+	}
+
+	broker := newFakeBroker(t, 0)
+
+	client := &MQTTClient{
+		BrokerURL: "mqtt://" + broker.listener.Addr().String(),
+		Username:  "user",
+		Password:  "pass",
+		Discovery: true,
+		Logger:    logger,
+	}
+
+	t.Run("Publishes the event, discovery config and state", func(t *testing.T) {
+		if err := client.Send(context.Background(), offline); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+
+		connect := <-broker.connects
+		if !bytes.Contains(connect, []byte("omada-to-ntfy")) || !bytes.Contains(connect, []byte("user")) {
+			t.Errorf("CONNECT did not contain the client ID and username: %q", connect)
+		}
+
+		got := broker.drain()
+		if len(got) != 3 {
+			t.Fatalf("Expected 3 publishes, got %d: %v", len(got), got)
+		}
+
+		if got[0].topic != "omada/Omada_Controller/Home/98-03-8E-3A-8D-53/offline" || got[0].retain {
+			t.Errorf("Unexpected event publish: %+v", got[0])
+		}
+
+		var event omada.Event
+		if err := json.Unmarshal([]byte(got[0].payload), &event); err != nil || event.Type != "offline" || event.Interface != "2.5G WAN1" {
+			t.Errorf("Unexpected event payload %v: %v", got[0].payload, err)
+		}
+
+		if got[1].topic != "homeassistant/binary_sensor/omada_98-03-8e-3a-8d-53/2_5g_wan1/config" || !got[1].retain {
+			t.Errorf("Unexpected discovery publish: %+v", got[1])
+		}
+
+		var config map[string]any
+		if err := json.Unmarshal([]byte(got[1].payload), &config); err != nil || config["state_topic"] != "omada/Omada_Controller/Home/98-03-8E-3A-8D-53/2.5G WAN1/state" || config["device_class"] != "connectivity" {
+			t.Errorf("Unexpected discovery payload %v: %v", got[1].payload, err)
+		}
+
+		if got[2] != (published{"omada/Omada_Controller/Home/98-03-8E-3A-8D-53/2.5G WAN1/state", StateOffline, true}) {
+			t.Errorf("Unexpected state publish: %+v", got[2])
+		}
+	})
+
+	t.Run("Announces a device to Home Assistant only once", func(t *testing.T) {
+		if err := client.Send(context.Background(), online); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+		<-broker.connects
+
+		got := broker.drain()
+		if len(got) != 2 || got[1].payload != StateOnline {
+			t.Errorf("Expected the event and an online state, got %v", got)
+		}
+	})
+
+	t.Run("Test messages don't touch the device state", func(t *testing.T) {
+		if err := client.Send(context.Background(), &omada.OmadaMessage{Description: "This is a webhook test message. Please ignore this"}); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+		<-broker.connects
+
+		got := broker.drain()
+		if len(got) != 1 || got[0].topic != "omada/unknown/unknown/controller/test" {
+			t.Errorf("Expected only the event, got %v", got)
+		}
+	})
+
+	t.Run("Keeps the device state with the notifications redacted", func(t *testing.T) {
+		detectors, _ := redact.Builtin()
+		r := &redact.Redactor{Detectors: detectors, Mode: redact.ModeHash, Key: []byte("key")}
+
+		redacting := &MQTTClient{BrokerURL: client.BrokerURL, Discovery: true, Logger: logger}
+		if err := redacting.Send(context.Background(), r.Message(offline)); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+		<-broker.connects
+
+		got := broker.drain()
+		if len(got) != 3 {
+			t.Fatalf("Expected the event, discovery config and state, got %v", got)
+		}
+
+		mac := r.String("98-03-8E-3A-8D-53")
+		if got[2] != (published{"omada/Omada_Controller/Home/" + mac + "/2.5G WAN1/state", StateOffline, true}) {
+			t.Errorf("Expected the state under the pseudonym of the device, got %+v", got[2])
+		}
+		for _, p := range got {
+			if strings.Contains(p.topic+p.payload, "8D-53") || strings.Contains(p.payload, "8d:53") {
+				t.Errorf("MAC address published in the clear: %+v", p)
+			}
+		}
+	})
+
+	t.Run("Reports a refused connection", func(t *testing.T) {
+		refusing := newFakeBroker(t, 5)
+		client := &MQTTClient{BrokerURL: "mqtt://" + refusing.listener.Addr().String(), Logger: logger}
+
+		if err := client.Send(context.Background(), offline); err == nil {
+			t.Error("Send() should fail when the broker refuses the connection")
+		}
+	})
+
+	t.Run("Gives up on a broker that doesn't answer at the deadline", func(t *testing.T) {
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+
+		client := &MQTTClient{BrokerURL: "mqtt://" + silent.Addr().String(), Logger: logger}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if err := client.Send(ctx, offline); err == nil || time.Since(start) > 5*time.Second {
+			t.Errorf("Expected Send() to give up at the deadline, got %v after %v", err, time.Since(start))
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,177 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/metrics"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+	"github.com/zimmra/omada-to-ntfy/tracing"
+)
+
+// Notifier is implemented by every backend that can deliver an Omada
+// message somewhere, such as ntfy or Gotify.
+type Notifier interface {
+	Send(ctx context.Context, payload *omada.OmadaMessage) error
+}
+
+// Checker is implemented by notifiers that can tell whether the service they
+// deliver to is currently reachable.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Multi combines several notifiers into one; a message is delivered to each
+// of them in turn.
+type Multi []Notifier
+
+// Send sends the message to every notifier, even when an earlier one fails.
+// All errors encountered are joined together and returned.
+func (m Multi) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	var errs []error
+
+	for _, n := range m {
+		if err := n.Send(ctx, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Route passes a message on to its notifier only when the message matches
+// the routing rules. Rules left at their zero value match every message.
+type Route struct {
+	Notifier    Notifier
+	MinPriority int                      // The lowest Omada priority (0-10) to deliver
+	Types       []omada.OmadaMessageType // The message types to deliver; empty for all
+	Name        string                   // Name of the destination for the metrics
+	Metrics     *metrics.Metrics         // Optional; counts the messages not routed
+}
+
+// Matches reports whether the message should be delivered through this route.
+func (r Route) Matches(payload *omada.OmadaMessage) bool {
+	if payload.Priority() < r.MinPriority {
+		return false
+	}
+
+	if len(r.Types) == 0 {
+		return true
+	}
+
+	return slices.Contains(r.Types, payload.Type())
+}
+
+// Send sends the message to the notifier if it matches the route, otherwise
+// the message is silently dropped for this destination.
+func (r Route) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	ctx, span := tracing.Start(ctx, "notifier.route", tracing.KindInternal)
+	defer span.End()
+
+	matches := r.Matches(payload)
+	span.SetAttributes("notifier", r.Name, "routed", matches)
+
+	if !matches {
+		r.Metrics.SuppressedEvent(r.Name, "route")
+		return nil
+	}
+
+	err := r.Notifier.Send(ctx, payload)
+	span.SetError(err)
+
+	return err
+}
+
+func (r Route) Unwrap() Notifier {
+	return r.Notifier
+}
+
+// Measured records the latency and result of every delivery to its notifier
+// in the metrics, under the given name, and traces it when the context
+// carries a span. With a Timeout, a delivery is given up on after that long,
+// so a destination that hangs can't hold up the webhook for good.
+type Measured struct {
+	Notifier Notifier
+	Name     string
+	Metrics  *metrics.Metrics
+	Watchdog *Watchdog     // Optional; also told about the result
+	Timeout  time.Duration // Optional; no limit when 0
+}
+
+func (m Measured) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+
+	ctx, span := tracing.Start(ctx, "notifier.deliver", tracing.KindInternal)
+	defer span.End()
+	span.SetAttributes("notifier", m.Name)
+
+	done := m.Metrics.StartDelivery(m.Name)
+	err := m.Notifier.Send(ctx, payload)
+	done(err)
+	span.SetError(err)
+
+	m.Watchdog.Record(ctx, m.Name, err)
+
+	return err
+}
+
+func (m Measured) Unwrap() Notifier {
+	return m.Notifier
+}
+
+// Redacted redacts every message before passing it on to its notifier.
+type Redacted struct {
+	Notifier Notifier
+	Redactor *redact.Redactor
+}
+
+func (r Redacted) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return r.Notifier.Send(ctx, r.Redactor.Message(payload))
+}
+
+func (r Redacted) Unwrap() Notifier {
+	return r.Notifier
+}
+
+// Unwrap returns the notifier that does the actual delivery, by taking off
+// every wrapper (like Route, Measured or Redacted) around it.
+func Unwrap(n Notifier) Notifier {
+	for {
+		w, ok := n.(interface{ Unwrap() Notifier })
+		if !ok {
+			return n
+		}
+		n = w.Unwrap()
+	}
+}
+
+// Name returns the name the notifier was given by a wrapper around it, or
+// its type when it doesn't have one.
+func Name(n Notifier) string {
+	for {
+		switch w := n.(type) {
+		case Route:
+			if w.Name != "" {
+				return w.Name
+			}
+			n = w.Notifier
+		case Measured:
+			if w.Name != "" {
+				return w.Name
+			}
+			n = w.Notifier
+		default:
+			return fmt.Sprintf("%T", n)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,274 @@
+package notifier_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/metrics"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+type notifierMock struct {
+	Calls       int
+	Sent        []*omada.OmadaMessage
+	returnError error
+}
+
+func (mock *notifierMock) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	mock.Calls += 1
+	mock.Sent = append(mock.Sent, payload)
+	return mock.returnError
+}
+
+// notifierFunc is a notifier doing whatever the function does.
+type notifierFunc func(ctx context.Context) error
+
+func (f notifierFunc) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return f(ctx)
+}
+
+// blockingMock doesn't return from Send until released.
+type blockingMock struct {
+	release chan struct{}
+}
+
+func (mock *blockingMock) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	<-mock.release
+	return nil
+}
+
+func TestMulti(t *testing.T) {
+	t.Run("Sends to every notifier", func(t *testing.T) {
+		a, b := &notifierMock{}, &notifierMock{}
+
+		if err := (notifier.Multi{a, b}).Send(context.Background(), &omada.OmadaMessage{}); err != nil {
+			t.Fatalf("Send() returned an unexpected error: %v", err)
+		}
+
+		if a.Calls != 1 || b.Calls != 1 {
+			t.Errorf("Expected each notifier to be called once; got %d and %d", a.Calls, b.Calls)
+		}
+	})
+
+	t.Run("Keeps sending after a failure and returns the error", func(t *testing.T) {
+		failure := errors.New("delivery failed")
+		a, b := &notifierMock{returnError: failure}, &notifierMock{}
+
+		err := (notifier.Multi{a, b}).Send(context.Background(), &omada.OmadaMessage{})
+		if !errors.Is(err, failure) {
+			t.Errorf("Send() error = %v, want it to wrap %v", err, failure)
+		}
+
+		if b.Calls != 1 {
+			t.Errorf("The second notifier should still be called; got %d calls", b.Calls)
+		}
+	})
+}
+
+func TestRoute(t *testing.T) {
+	offline := &omada.OmadaMessage{Text: []string{"The online detection result of [2.5G WAN1] was offline."}}
+	online := &omada.OmadaMessage{Text: []string{"The online detection result of [2.5G WAN1] was online."}}
+	test := &omada.OmadaMessage{Description: "This is a webhook test message. Please ignore this"}
+
+	tests := []struct {
+		name  string
+		route notifier.Route
+		want  []bool // offline, online, test
+	}{
+		{"No rules", notifier.Route{}, []bool{true, true, true}},
+		{"Minimum priority", notifier.Route{MinPriority: 7}, []bool{true, true, false}},
+		{"Types", notifier.Route{Types: []omada.OmadaMessageType{omada.OmadaOfflineMessage}}, []bool{true, false, false}},
+		{"Both", notifier.Route{MinPriority: 10, Types: []omada.OmadaMessageType{omada.OmadaOnlineMessage}}, []bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &notifierMock{}
+			tt.route.Notifier = mock
+
+			for i, msg := range []*omada.OmadaMessage{offline, online, test} {
+				mock.Calls = 0
+
+				if got := tt.route.Matches(msg); got != tt.want[i] {
+					t.Errorf("Matches(%v) = %v, want %v", msg.Type(), got, tt.want[i])
+				}
+
+				if err := tt.route.Send(context.Background(), msg); err != nil {
+					t.Errorf("Send() returned an unexpected error: %v", err)
+				}
+
+				if (mock.Calls == 1) != tt.want[i] {
+					t.Errorf("Send(%v) called the notifier %d times", msg.Type(), mock.Calls)
+				}
+			}
+		})
+	}
+}
+
+func TestMeasured(t *testing.T) {
+	m := metrics.New()
+	failure := errors.New("delivery failed")
+	mock := &notifierMock{}
+
+	measured := notifier.Measured{Notifier: mock, Name: "mock", Metrics: m}
+
+	_ = measured.Send(context.Background(), &omada.OmadaMessage{})
+	mock.returnError = failure
+	if err := measured.Send(context.Background(), &omada.OmadaMessage{}); !errors.Is(err, failure) {
+		t.Errorf("Send() error = %v, want %v", err, failure)
+	}
+
+	if got := m.Deliveries.Value("mock", "success"); got != 1 {
+		t.Errorf("Expected 1 successful delivery, got %v", got)
+	}
+
+	if got := m.Deliveries.Value("mock", "failure"); got != 1 {
+		t.Errorf("Expected 1 failed delivery, got %v", got)
+	}
+
+	if m.InFlight() != 0 {
+		t.Errorf("Expected no deliveries in flight, got %d", m.InFlight())
+	}
+
+	t.Run("Gives up after the timeout", func(t *testing.T) {
+		hanging := notifierFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		timed := notifier.Measured{Notifier: hanging, Name: "hanging", Metrics: m, Timeout: 10 * time.Millisecond}
+
+		if err := timed.Send(context.Background(), &omada.OmadaMessage{}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Send() error = %v, want the deadline exceeded", err)
+		}
+	})
+
+	route := notifier.Route{Notifier: measured, MinPriority: 10, Name: "mock", Metrics: m}
+	_ = route.Send(context.Background(), &omada.OmadaMessage{})
+
+	if got := m.Suppressed.Value("mock", "route"); got != 1 {
+		t.Errorf("Expected 1 suppressed message, got %v", got)
+	}
+
+	if notifier.Unwrap(route) != mock {
+		t.Errorf("Unwrap() did not return the innermost notifier")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	ctx := context.Background()
+	failure := errors.New("connection refused")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("Reports failures in a row and the recovery", func(t *testing.T) {
+		fallback, mock := &notifierMock{}, &notifierMock{returnError: failure}
+		w := &notifier.Watchdog{Fallback: fallback, Failures: 3, Logger: logger}
+		measured := notifier.Measured{Notifier: mock, Name: "ntfy", Watchdog: w}
+
+		for range 2 {
+			_ = measured.Send(ctx, &omada.OmadaMessage{})
+		}
+		w.Wait(ctx)
+		if fallback.Calls != 0 {
+			t.Fatalf("Reported before 3 failures in a row")
+		}
+
+		for range 3 {
+			_ = measured.Send(ctx, &omada.OmadaMessage{})
+		}
+		w.Wait(ctx)
+		if fallback.Calls != 1 {
+			t.Fatalf("Expected the failures to be reported once, got %d reports", fallback.Calls)
+		}
+		if got := fallback.Sent[0]; got.Type() != omada.DeliveryFailingMessage || !strings.Contains(got.Text[0], "[ntfy]: 3 deliveries in a row failed. The last error was: connection refused") {
+			t.Errorf("Unexpected report %v: %v", got.Type(), got.Text)
+		}
+
+		mock.returnError = nil
+		_ = measured.Send(ctx, &omada.OmadaMessage{})
+		_ = measured.Send(ctx, &omada.OmadaMessage{})
+		w.Wait(ctx)
+		if fallback.Calls != 2 {
+			t.Fatalf("Expected the recovery to be reported once, got %d reports", fallback.Calls)
+		}
+		if got := fallback.Sent[1]; got.Type() != omada.DeliveryRecoveredMessage || !strings.Contains(got.Text[0], "5 messages could not be delivered and were dropped") {
+			t.Errorf("Unexpected report %v: %v", got.Type(), got.Text)
+		}
+	})
+
+	t.Run("Reports the error rate", func(t *testing.T) {
+		fallback := &notifierMock{}
+		w := &notifier.Watchdog{Fallback: fallback, ErrorRate: 0.75, Window: 4, Logger: logger}
+
+		for _, err := range []error{failure, nil, failure, nil, failure} {
+			w.Record(ctx, "gotify", err)
+		}
+		w.Wait(ctx)
+		if fallback.Calls != 0 {
+			t.Fatalf("Reported before 3 of 4 deliveries failed")
+		}
+
+		w.Record(ctx, "gotify", failure)
+		w.Wait(ctx)
+		if fallback.Calls != 1 || !strings.Contains(fallback.Sent[0].Text[0], "3 of the last 4 deliveries failed") {
+			t.Fatalf("Expected the error rate to be reported, got %v", fallback.Sent)
+		}
+	})
+
+	t.Run("Retries a report that fails", func(t *testing.T) {
+		fallback := &notifierMock{returnError: failure}
+		w := &notifier.Watchdog{Fallback: fallback, Failures: 1, Logger: logger}
+
+		w.Record(ctx, "ntfy", failure)
+		w.Wait(ctx)
+		fallback.returnError = nil
+		w.Record(ctx, "ntfy", failure)
+		w.Wait(ctx)
+		if fallback.Calls != 2 || fallback.Sent[1].Type() != omada.DeliveryFailingMessage {
+			t.Fatalf("Expected the report to be sent again, got %d reports", fallback.Calls)
+		}
+
+		// Reloaded with a new watchdog
+		next := &notifier.Watchdog{Fallback: fallback, Failures: 1, Logger: logger}
+		next.TakeOver(w)
+		next.Record(ctx, "ntfy", nil)
+		next.Wait(ctx)
+		if fallback.Calls != 3 || fallback.Sent[2].Type() != omada.DeliveryRecoveredMessage {
+			t.Fatalf("Expected the recovery to be reported after a reload, got %d reports", fallback.Calls)
+		}
+	})
+
+	t.Run("Doesn't wait for the report", func(t *testing.T) {
+		fallback := &blockingMock{release: make(chan struct{})}
+		w := &notifier.Watchdog{Fallback: fallback, Failures: 1, Logger: logger}
+
+		recorded := make(chan struct{})
+		go func() {
+			w.Record(ctx, "ntfy", failure)
+			close(recorded)
+		}()
+
+		select {
+		case <-recorded:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Record() waited for the fallback")
+		}
+
+		close(fallback.release)
+		w.Wait(ctx)
+	})
+
+	t.Run("Nil watches nothing", func(t *testing.T) {
+		var w *notifier.Watchdog
+		w.Record(ctx, "ntfy", failure)
+		w.TakeOver(nil)
+		w.Wait(ctx)
+	})
+}
+
+// EOF
@@ -0,0 +1,178 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// Watchdog keeps an eye on the deliveries to every destination. When one
+// keeps failing, that's reported through Fallback, as nobody would otherwise
+// know until they read the logs, and again once it recovers. A nil *Watchdog
+// watches nothing.
+type Watchdog struct {
+	Fallback  Notifier
+	Failures  int     // Report after this many failures in a row; 0 to not count them
+	ErrorRate float64 // Report when this share (0-1) of the last Window deliveries failed; 0 to not check
+	Window    int
+	Logger    *slog.Logger
+
+	mu           sync.Mutex
+	destinations map[string]*destination
+	reports      sync.WaitGroup
+}
+
+type destination struct {
+	recent   []bool // Whether each of the last Window deliveries failed
+	failures int    // Failures in a row
+	failing  bool   // Whether that was reported
+	since    time.Time
+	missed   int // Messages not delivered since
+}
+
+// Record takes note of the result of a delivery to the named destination,
+// and reports through Fallback when that makes it failing or recovered.
+func (w *Watchdog) Record(ctx context.Context, name string, err error) {
+	if w == nil {
+		return
+	}
+
+	text := w.record(name, err, time.Now())
+	if text == "" {
+		return
+	}
+
+	raised := omada.DeliveryFailingMessage
+	if err == nil {
+		raised = omada.DeliveryRecoveredMessage
+	}
+
+	msg := &omada.OmadaMessage{Controller: "omada-to-ntfy", Text: []string{text}, Timestamp: time.Now().UnixMilli(), Raised: raised}
+
+	// Sent in the background, so the webhook being answered doesn't wait for
+	// the fallback too; nor is the report cut short once it's answered
+	ctx = context.WithoutCancel(ctx)
+	w.reports.Go(func() { w.report(ctx, name, msg) })
+}
+
+// report sends the report through Fallback.
+func (w *Watchdog) report(ctx context.Context, name string, msg *omada.OmadaMessage) {
+	if err := w.Fallback.Send(ctx, msg); err != nil {
+		w.Logger.ErrorContext(ctx, "Could not report delivery problems through the fallback", "notifier", name, "type", msg.Type().String(), "error", err)
+
+		// Reported again with the next delivery
+		w.mu.Lock()
+		if d := w.destinations[name]; d != nil {
+			d.failing = msg.Type() != omada.DeliveryFailingMessage
+		}
+		w.mu.Unlock()
+		return
+	}
+
+	w.Logger.WarnContext(ctx, "Reported delivery problems through the fallback", "notifier", name, "type", msg.Type().String())
+}
+
+// Wait waits for the reports still being sent, or until the context ends.
+func (w *Watchdog) Wait(ctx context.Context) {
+	if w == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.reports.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// record updates the state of the destination, and returns the text to
+// report when it changed.
+func (w *Watchdog) record(name string, err error, now time.Time) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.destinations == nil {
+		w.destinations = map[string]*destination{}
+	}
+
+	d, ok := w.destinations[name]
+	if !ok {
+		d = &destination{}
+		w.destinations[name] = d
+	}
+
+	if w.Window > 0 {
+		d.recent = append(d.recent, err != nil)
+		if len(d.recent) > w.Window {
+			d.recent = d.recent[1:]
+		}
+	}
+
+	if err == nil {
+		d.failures = 0
+		if !d.failing {
+			return ""
+		}
+
+		d.failing = false
+		return fmt.Sprintf("Delivery to [%v] has recovered, after failing for %v. %v messages could not be delivered and were dropped.", name, omada.HumanReadableDuration(now.Sub(d.since)), d.missed)
+	}
+
+	d.failures++
+	if d.failing {
+		d.missed++
+		return ""
+	}
+
+	var reason string
+	switch failed := count(d.recent); {
+	case w.Failures > 0 && d.failures >= w.Failures:
+		reason = fmt.Sprintf("%v deliveries in a row failed", d.failures)
+		d.missed = d.failures
+	case w.ErrorRate > 0 && len(d.recent) == w.Window && float64(failed)/float64(w.Window) >= w.ErrorRate:
+		reason = fmt.Sprintf("%v of the last %v deliveries failed", failed, w.Window)
+		d.missed = failed
+	default:
+		return ""
+	}
+
+	d.failing, d.since = true, now
+	return fmt.Sprintf("Messages could not be delivered to [%v]: %v. The last error was: %v", name, reason, err)
+}
+
+// TakeOver continues watching the destinations the old watchdog was
+// watching, so a failure reported before a reload is also reported as
+// recovered after it. The old watchdog starts afresh.
+func (w *Watchdog) TakeOver(old *Watchdog) {
+	if w == nil || old == nil {
+		return
+	}
+
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.destinations, old.destinations = old.destinations, nil
+}
+
+func count(failed []bool) int {
+	n := 0
+	for _, f := range failed {
+		if f {
+			n++
+		}
+	}
+	return n
+}
+
+// EOF
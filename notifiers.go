@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/chat"
+	"github.com/zimmra/omada-to-ntfy/email"
+	"github.com/zimmra/omada-to-ntfy/generic"
+	"github.com/zimmra/omada-to-ntfy/gotify"
+	"github.com/zimmra/omada-to-ntfy/metrics"
+	"github.com/zimmra/omada-to-ntfy/mqtt"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+	"github.com/zimmra/omada-to-ntfy/tracing"
+)
+
+// notifiersFromEnv builds every notification destination configured through
+// the environment (or config file), each measured in the metrics, watched by
+// the watchdog, redacting what it sends when r is set and wrapped in its
+// routing rules when it has any.
+func notifiersFromEnv(getenv func(string) string, logger *slog.Logger, m *metrics.Metrics, w *notifier.Watchdog, r *redact.Redactor) (notifier.Multi, error) {
+	notifiers, err := destinationsFromEnv(getenv, logger, m, w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(notifiers) == 0 {
+		return nil, errors.New("NTFY_URL or another notification destination environment variable is required")
+	}
+
+	return notifiers, nil
+}
+
+// destinationsFromEnv builds the notification destinations that are
+// configured, which may be none.
+func destinationsFromEnv(getenv func(string) string, logger *slog.Logger, m *metrics.Metrics, w *notifier.Watchdog, r *redact.Redactor) (notifier.Multi, error) {
+	var notifiers notifier.Multi
+
+	// Each delivery is given up on after this long, even when Omada hangs up
+	timeout := 30 * time.Second
+	if v := getenv("DELIVERY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("DELIVERY_TIMEOUT must be a duration like 30s, got `%v`", v)
+		}
+		timeout = d
+	}
+
+	add := func(prefix string, n notifier.Notifier) error {
+		name := strings.ToLower(prefix)
+
+		// Inside the routing rules, so they go by the message as received
+		if r != nil {
+			n = notifier.Redacted{Notifier: n, Redactor: r}
+		}
+
+		routed, err := routeFromEnv(getenv, prefix, notifier.Measured{Notifier: n, Name: name, Metrics: m, Watchdog: w, Timeout: timeout})
+		if err != nil {
+			return err
+		}
+
+		if route, ok := routed.(notifier.Route); ok {
+			route.Name, route.Metrics = name, m
+			routed = route
+		}
+
+		notifiers = append(notifiers, routed)
+		return nil
+	}
+
+	// httpClient returns an HTTP client counting responses for the notifier
+	// and tracing its requests. The trace is only passed on to destinations
+	// that are run by the user, not to the chat services.
+	httpClient := func(prefix string) *http.Client {
+		propagate := !slices.Contains([]string{"SLACK", "DISCORD", "MATTERMOST", "TEAMS"}, prefix)
+		return &http.Client{Transport: tracing.Transport(m.Transport(strings.ToLower(prefix), nil), propagate), Timeout: timeout}
+	}
+
+	if ntfyURL := getenv("NTFY_URL"); ntfyURL != "" {
+		ntfyTopic := getenv("NTFY_TOPIC")
+		if ntfyTopic == "" {
+			return nil, errors.New("NTFY_TOPIC environment variable is required")
+		}
+
+		// Username and password are optional for ntfy (some instances may not require auth)
+		err := add("NTFY", &ntfy.NtfyClient{
+			NtfyURL:  ntfyURL,
+			Topic:    ntfyTopic,
+			Username: getenv("NTFY_USER"),
+			Password: getenv("NTFY_PASSWORD"),
+			Client:   httpClient("NTFY"),
+			Logger:   logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if gotifyURL := getenv("GOTIFY_URL"); gotifyURL != "" {
+		gotifyToken := getenv("GOTIFY_APP_TOKEN")
+		if gotifyToken == "" {
+			return nil, errors.New("GOTIFY_APP_TOKEN environment variable is required")
+		}
+
+		err := add("GOTIFY", &gotify.GotifyClient{
+			GotifyURL: gotifyURL,
+			AppToken:  gotifyToken,
+			Client:    httpClient("GOTIFY"),
+			Logger:    logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	chatClients := []struct {
+		prefix string
+		client func(url string, client *http.Client) notifier.Notifier
+	}{
+		{"SLACK", func(url string, client *http.Client) notifier.Notifier {
+			return &chat.SlackClient{WebhookURL: url, Client: client, Logger: logger}
+		}},
+		{"DISCORD", func(url string, client *http.Client) notifier.Notifier {
+			return &chat.DiscordClient{WebhookURL: url, Client: client, Logger: logger}
+		}},
+		{"MATTERMOST", func(url string, client *http.Client) notifier.Notifier {
+			return &chat.MattermostClient{WebhookURL: url, Client: client, Logger: logger}
+		}},
+		{"TEAMS", func(url string, client *http.Client) notifier.Notifier {
+			return &chat.TeamsClient{WebhookURL: url, Client: client, Logger: logger}
+		}},
+	}
+
+	for _, cc := range chatClients {
+		if url := getenv(cc.prefix + "_WEBHOOK_URL"); url != "" {
+			if err := add(cc.prefix, cc.client(url, httpClient(cc.prefix))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if smtpHost := getenv("SMTP_HOST"); smtpHost != "" {
+		client, err := emailFromEnv(getenv, smtpHost, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := add("SMTP", client); err != nil {
+			return nil, err
+		}
+	}
+
+	if mqttURL := getenv("MQTT_URL"); mqttURL != "" {
+		discovery := true
+		if v := getenv("MQTT_DISCOVERY"); v != "" {
+			d, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("MQTT_DISCOVERY must be true or false, got `%v`", v)
+			}
+			discovery = d
+		}
+
+		err := add("MQTT", &mqtt.MQTTClient{
+			BrokerURL:       mqttURL,
+			Username:        getenv("MQTT_USER"),
+			Password:        getenv("MQTT_PASSWORD"),
+			ClientID:        getenv("MQTT_CLIENT_ID"),
+			Topic:           getenv("MQTT_TOPIC"),
+			StateTopic:      getenv("MQTT_STATE_TOPIC"),
+			Discovery:       discovery,
+			DiscoveryPrefix: getenv("MQTT_DISCOVERY_PREFIX"),
+			Logger:          logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if webhookURL := getenv("GENERIC_WEBHOOK_URL"); webhookURL != "" {
+		var headers map[string]string
+		if h := getenv("GENERIC_WEBHOOK_HEADERS"); h != "" {
+			if err := json.Unmarshal([]byte(h), &headers); err != nil {
+				return nil, fmt.Errorf("GENERIC_WEBHOOK_HEADERS must be a JSON object of header names to values: %w", err)
+			}
+		}
+
+		client := &generic.WebhookClient{
+			Method:          getenv("GENERIC_WEBHOOK_METHOD"),
+			URL:             webhookURL,
+			Headers:         headers,
+			Body:            getenv("GENERIC_WEBHOOK_BODY"),
+			Secret:          getenv("GENERIC_WEBHOOK_SECRET"),
+			SignatureHeader: getenv("GENERIC_WEBHOOK_SIGNATURE_HEADER"),
+			Client:          httpClient("GENERIC_WEBHOOK"),
+			Logger:          logger,
+		}
+
+		if err := client.Validate(); err != nil {
+			return nil, fmt.Errorf("GENERIC_WEBHOOK: %w", err)
+		}
+
+		if err := add("GENERIC_WEBHOOK", client); err != nil {
+			return nil, err
+		}
+	}
+
+	return notifiers, nil
+}
+
+// watchdogFromEnv sets up reporting deliveries that keep failing when a
+// fallback destination is configured, with the same variables as the others
+// prefixed with `FALLBACK_`, like `FALLBACK_NTFY_URL`. It isn't measured in
+// the metrics or watched itself; failing to report is only logged. What it
+// reports is redacted by r like any other notification.
+func watchdogFromEnv(getenv func(string) string, logger *slog.Logger, r *redact.Redactor) (*notifier.Watchdog, error) {
+	fallback, err := destinationsFromEnv(func(name string) string { return getenv("FALLBACK_" + name) }, logger, nil, nil, r)
+	if err != nil {
+		return nil, fmt.Errorf("FALLBACK_%w", err)
+	}
+
+	if len(fallback) == 0 {
+		return nil, nil
+	}
+
+	w := &notifier.Watchdog{Fallback: fallback, Failures: 5, Window: 20, Logger: logger}
+
+	if v := getenv("FALLBACK_FAILURES"); v != "" {
+		if w.Failures, err = strconv.Atoi(v); err != nil || w.Failures < 0 {
+			return nil, fmt.Errorf("FALLBACK_FAILURES must be a number, 0 to not count failures in a row, got `%v`", v)
+		}
+	}
+
+	if v := getenv("FALLBACK_ERROR_RATE"); v != "" {
+		rate, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil || rate < 0 || rate > 100 {
+			return nil, fmt.Errorf("FALLBACK_ERROR_RATE must be a percentage from 0 to 100, got `%v`", v)
+		}
+		w.ErrorRate = float64(rate) / 100
+	}
+
+	if v := getenv("FALLBACK_WINDOW"); v != "" {
+		if w.Window, err = strconv.Atoi(v); err != nil || w.Window < 1 {
+			return nil, fmt.Errorf("FALLBACK_WINDOW must be a positive number, got `%v`", v)
+		}
+	}
+
+	return w, nil
+}
+
+// emailFromEnv configures the SMTP notifier from the `SMTP_*` environment
+// variables; the port defaults to the usual one for the chosen security.
+func emailFromEnv(getenv func(string) string, host string, logger *slog.Logger) (*email.EmailClient, error) {
+	from := getenv("SMTP_FROM")
+	if from == "" {
+		return nil, errors.New("SMTP_FROM environment variable is required")
+	}
+
+	var to []string
+	for addr := range strings.SplitSeq(getenv("SMTP_TO"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+
+	if len(to) == 0 {
+		return nil, errors.New("SMTP_TO environment variable is required")
+	}
+
+	security := strings.ToLower(getenv("SMTP_SECURITY"))
+	port := getenv("SMTP_PORT")
+
+	switch security {
+	case "", email.SecuritySTARTTLS:
+		security = email.SecuritySTARTTLS
+		if port == "" {
+			port = "587"
+		}
+	case email.SecurityTLS:
+		if port == "" {
+			port = "465"
+		}
+	case email.SecurityNone:
+		if port == "" {
+			port = "25"
+		}
+	default:
+		return nil, fmt.Errorf("SMTP_SECURITY must be one of starttls, tls or none, got `%v`", security)
+	}
+
+	return &email.EmailClient{
+		Host:     host,
+		Port:     port,
+		Username: getenv("SMTP_USER"),
+		Password: getenv("SMTP_PASSWORD"),
+		From:     from,
+		To:       to,
+		Security: security,
+		Logger:   logger,
+	}, nil
+}
+
+// routeFromEnv wraps the notifier in the routing rules configured for it
+// with the `<PREFIX>_MIN_PRIORITY` and `<PREFIX>_TYPES` environment variables.
+// Without any rules the notifier is returned as-is.
+func routeFromEnv(getenv func(string) string, prefix string, n notifier.Notifier) (notifier.Notifier, error) {
+	route := notifier.Route{Notifier: n}
+
+	minPriority := getenv(prefix + "_MIN_PRIORITY")
+	types := getenv(prefix + "_TYPES")
+
+	if minPriority == "" && types == "" {
+		return n, nil
+	}
+
+	if minPriority != "" {
+		p, err := strconv.Atoi(minPriority)
+		if err != nil || p < 0 || p > 10 {
+			return nil, fmt.Errorf("%s_MIN_PRIORITY must be a number from 0 to 10, got `%v`", prefix, minPriority)
+		}
+
+		route.MinPriority = p
+	}
+
+	if types != "" {
+		for name := range strings.SplitSeq(types, ",") {
+			t, err := omada.ParseMessageType(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s_TYPES: %w", prefix, err)
+			}
+
+			route.Types = append(route.Types, t)
+		}
+	}
+
+	return route, nil
+}
+
+// EOF
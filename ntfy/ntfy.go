@@ -2,10 +2,12 @@ package ntfy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/zimmra/omada-to-ntfy/omada"
 )
@@ -15,7 +17,8 @@ type NtfyClient struct {
 	Topic    string
 	Username string
 	Password string
-	Logger   *log.Logger
+	Client   *http.Client // Optional; defaults to an http.Client with a 30 second timeout
+	Logger   *slog.Logger
 }
 
 // MapPriority maps Omada priorities (0-10) to ntfy priorities (1-5)
@@ -48,6 +51,14 @@ func GetTagsForMessageType(messageType omada.OmadaMessageType) []string {
 		return []string{"white_check_mark"} // ✅
 	case omada.OmadaTestMessage:
 		return []string{"test_tube"} // 🧪
+	case omada.ControllerSilentMessage:
+		return []string{"mute"} // 🔇
+	case omada.ControllerResumedMessage:
+		return []string{"loud_sound"} // 🔊
+	case omada.DeliveryFailingMessage:
+		return []string{"no_entry"} // ⛔
+	case omada.DeliveryRecoveredMessage:
+		return []string{"incoming_envelope"} // 📨
 	case omada.UnrecognisedMessage:
 		return []string{"warning"} // ⚠️
 	default:
@@ -55,17 +66,16 @@ func GetTagsForMessageType(messageType omada.OmadaMessageType) []string {
 	}
 }
 
-// Send sends a message to ntfy using the provided payload
-func (nc *NtfyClient) Send(payload *omada.OmadaMessage) error {
+// NewRequest creates the request that delivers the message to ntfy.
+func (nc *NtfyClient) NewRequest(ctx context.Context, payload *omada.OmadaMessage) (*http.Request, error) {
 	// Construct the full URL
 	url := fmt.Sprintf("%s/%s", strings.TrimSuffix(nc.NtfyURL, "/"), nc.Topic)
 
 	// Create the request body
 	body := []byte(payload.Body())
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		nc.Logger.Printf("Could not create ntfy request: %v", err)
-		return err
+		return nil, err
 	}
 
 	// Set headers
@@ -84,22 +94,65 @@ func (nc *NtfyClient) Send(payload *omada.OmadaMessage) error {
 		req.SetBasicAuth(nc.Username, nc.Password)
 	}
 
+	return req, nil
+}
+
+// Send sends a message to ntfy using the provided payload
+func (nc *NtfyClient) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	req, err := nc.NewRequest(ctx, payload)
+	if err != nil {
+		nc.Logger.ErrorContext(ctx, "Could not create ntfy request", "error", err)
+		return err
+	}
+
 	// Send the request
-	client := &http.Client{}
+	client := nc.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
-		nc.Logger.Printf("Could not send message to ntfy: %v", err)
+		nc.Logger.ErrorContext(ctx, "Could not send message to ntfy", "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	// Check response status
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		nc.Logger.Printf("ntfy returned non-success status code: %d", resp.StatusCode)
+		nc.Logger.ErrorContext(ctx, "ntfy returned non-success status code", "status", resp.StatusCode)
 		return fmt.Errorf("ntfy returned status code %d", resp.StatusCode)
 	}
 
-	nc.Logger.Println("Message sent to ntfy")
+	nc.Logger.InfoContext(ctx, "Message sent to ntfy")
+	return nil
+}
+
+// Check tells whether the ntfy server is reachable and healthy, using its
+// health endpoint.
+func (nc *NtfyClient) Check(ctx context.Context) error {
+	url := fmt.Sprintf("%s/v1/health", strings.TrimSuffix(nc.NtfyURL, "/"))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := nc.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ntfy health check returned status code %d", resp.StatusCode)
+	}
+
 	return nil
 }
 
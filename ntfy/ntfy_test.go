@@ -1,6 +1,8 @@
 package ntfy
 
 import (
+	"context"
+	"io"
 	"testing"
 
 	"github.com/zimmra/omada-to-ntfy/omada"
@@ -57,4 +59,34 @@ func TestGetTagsForMessageType(t *testing.T) {
 	}
 }
 
+func TestNewRequest(t *testing.T) {
+	nc := &NtfyClient{NtfyURL: "https://ntfy.example.com/", Topic: "alerts", Username: "user", Password: "pass"}
+	payload := &omada.OmadaMessage{
+		Controller: "Home",
+		Site:       "Default",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline."},
+	}
+
+	req, err := nc.NewRequest(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("NewRequest() returned an unexpected error: %v", err)
+	}
+
+	if req.Method != "POST" || req.URL.String() != "https://ntfy.example.com/alerts" {
+		t.Errorf("NewRequest() = %v %v; want POST https://ntfy.example.com/alerts", req.Method, req.URL)
+	}
+
+	if req.Header.Get("Title") != "Home: Default" || req.Header.Get("Priority") != "5" || req.Header.Get("Tags") != "rotating_light" {
+		t.Errorf("NewRequest() has unexpected headers: %v", req.Header)
+	}
+
+	if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		t.Errorf("NewRequest() doesn't authenticate as user/pass")
+	}
+
+	if body, _ := io.ReadAll(req.Body); string(body) != payload.Body() {
+		t.Errorf("NewRequest() body = %q; want %q", body, payload.Body())
+	}
+}
+
 // EOF
@@ -1,9 +1,10 @@
 package omada
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
 	"strings"
 	"time"
@@ -21,6 +22,10 @@ const (
 	OmadaTestMessage
 	OmadaOfflineMessage
 	OmadaOnlineMessage
+	ControllerSilentMessage  // Raised by the bridge itself
+	ControllerResumedMessage // Raised by the bridge itself
+	DeliveryFailingMessage   // Raised by the bridge itself
+	DeliveryRecoveredMessage // Raised by the bridge itself
 )
 
 var omadaMessageTypeName = map[OmadaMessageType]string{
@@ -28,6 +33,28 @@ var omadaMessageTypeName = map[OmadaMessageType]string{
 	OmadaTestMessage:    "test",
 	OmadaOfflineMessage: "offline",
 	OmadaOnlineMessage:  "online",
+
+	ControllerSilentMessage:  "silent",
+	ControllerResumedMessage: "resumed",
+	DeliveryFailingMessage:   "failing",
+	DeliveryRecoveredMessage: "recovered",
+}
+
+// The short lowercase name of the message type, e.g. `offline`.
+func (t OmadaMessageType) String() string {
+	return omadaMessageTypeName[t]
+}
+
+// ParseMessageType returns the message type going by the given name, which
+// must be one of the names returned by OmadaMessageType.String().
+func ParseMessageType(name string) (OmadaMessageType, error) {
+	for t, n := range omadaMessageTypeName {
+		if strings.EqualFold(n, strings.TrimSpace(name)) {
+			return t, nil
+		}
+	}
+
+	return UnrecognisedMessage, fmt.Errorf("unknown Omada message type `%v`", name)
 }
 
 // Priorities were discussed by the Gotify author at:
@@ -37,6 +64,11 @@ var messageTypeToPriority = map[OmadaMessageType]int{
 	UnrecognisedMessage: 4,  // Not specifically recognised, but still make it trigger a notification
 	OmadaOfflineMessage: 10, // Going offline seems important
 	OmadaOnlineMessage:  7,  // Back online is important too, not _as_ important?
+
+	ControllerSilentMessage:  10, // Nothing will be heard about any outage
+	ControllerResumedMessage: 7,
+	DeliveryFailingMessage:   10, // Nothing will be heard about anything
+	DeliveryRecoveredMessage: 7,
 }
 
 // OmadaMessage type and methods
@@ -51,6 +83,24 @@ type OmadaMessage struct {
 	Description string   `json:"description"`
 	Text        []string `json:"text"`
 	Timestamp   int64    `json:"timestamp"`
+
+	// The type of a message raised by the bridge itself, like a silent
+	// controller; never taken from a webhook, so one can't pass itself off
+	// as such a message by what it says
+	Raised OmadaMessageType `json:"-"`
+
+	// What was detected about the message before its text was redacted, as
+	// the redacted text may not tell any more
+	Detected *Detected `json:"-"`
+}
+
+// Detected is what's detected about a message, kept along with a redacted
+// copy of it; the device, MAC address and interface redacted too.
+type Detected struct {
+	Type      OmadaMessageType
+	Device    string
+	DeviceMAC string
+	Interface string
 }
 
 // The title for the message as it will be sent to Gotify. Will take the name
@@ -111,32 +161,141 @@ func (msg OmadaMessage) Priority() int {
 	return messageTypeToPriority[msg.Type()]
 }
 
+// The device the message is about as Omada names it in the text, such as
+// `gateway:98-03-8E-3A-8D-53`. Empty if no device is mentioned.
+func (msg OmadaMessage) Device() string {
+	if msg.Detected != nil {
+		return msg.Detected.Device
+	}
+
+	for _, text := range msg.Text {
+		if m := deviceRe.FindStringSubmatch(text); m != nil {
+			return m[1] + ":" + m[2]
+		}
+	}
+
+	return ""
+}
+
+// The MAC address of the device the message is about, in the dash separated
+// uppercase notation Omada uses. Empty if no device is mentioned.
+func (msg OmadaMessage) DeviceMAC() string {
+	if msg.Detected != nil {
+		return msg.Detected.DeviceMAC
+	}
+
+	for _, text := range msg.Text {
+		if m := deviceRe.FindStringSubmatch(text); m != nil {
+			return strings.ToUpper(m[2])
+		}
+	}
+
+	return ""
+}
+
+// The interface of the device the message is about, e.g. `2.5G WAN1` for
+// online detection results. Empty if no interface is mentioned.
+func (msg OmadaMessage) Interface() string {
+	if msg.Detected != nil {
+		return msg.Detected.Interface
+	}
+
+	for _, text := range msg.Text {
+		if m := interfaceRe.FindStringSubmatch(text); m != nil {
+			return m[1]
+		}
+	}
+
+	return ""
+}
+
+// Event is the normalised form of an OmadaMessage, with everything that is
+// detected about the message spelled out. It's what gets handed on to
+// outputs that want structured data rather than a title and body.
+type Event struct {
+	Controller  string    `json:"controller"`
+	Site        string    `json:"site"`
+	Type        string    `json:"type"`
+	Priority    int       `json:"priority"`
+	Title       string    `json:"title"`
+	Body        string    `json:"body"`
+	Description string    `json:"description"`
+	Text        []string  `json:"text"`
+	Device      string    `json:"device,omitempty"`
+	DeviceMAC   string    `json:"device_mac,omitempty"`
+	Interface   string    `json:"interface,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Normalise the message into an Event.
+func (msg OmadaMessage) Event() Event {
+	text := make([]string, len(msg.Text))
+	for i, line := range msg.Text {
+		text[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	return Event{
+		Controller:  msg.Controller,
+		Site:        msg.Site,
+		Type:        msg.Type().String(),
+		Priority:    msg.Priority(),
+		Title:       msg.Title(),
+		Body:        msg.Body(),
+		Description: msg.Description,
+		Text:        text,
+		Device:      msg.Device(),
+		DeviceMAC:   msg.DeviceMAC(),
+		Interface:   msg.Interface(),
+		Time:        msg.Date(),
+	}
+}
+
 // Functions
 
 var shardSecretRe = regexp.MustCompile(`"shardSecret":\s*"([^"]+)"`)
 
-func ParseOmadaMessage(out *log.Logger, body []byte) (*OmadaMessage, error) {
+// MaskSecrets returns the body of a webhook request with the `shardSecret`
+// Omada includes masked out, so it can be logged or shared.
+func MaskSecrets(body []byte) []byte {
+	return shardSecretRe.ReplaceAll(body, []byte(`"shardSecret":"****"`))
+}
+
+// ParseOmadaMessage parses the JSON body of an Omada webhook request. The
+// (sanitised) body is logged too when logPayload is set.
+func ParseOmadaMessage(ctx context.Context, out *slog.Logger, body []byte, logPayload bool) (*OmadaMessage, error) {
 	// It can be helpful to log the incoming JSON data for debugging purposes
 	// but should one need to share their messages with others it's not ideal
 	// that it has the 'shardSecret' within, so wipe this from the string.
-	sanitised := string(body)
-	sanitised = shardSecretRe.ReplaceAllString(sanitised, `"shardSecret":"****"`)
+	sanitised := string(MaskSecrets(body))
 
-	out.Printf("Processing incoming message: `%v`", sanitised)
+	if logPayload {
+		out.InfoContext(ctx, "Processing incoming message", "payload", sanitised)
+	}
 
 	// Parse the JSON body data into the omadaMessage format, populating res
 	res := OmadaMessage{}
 	if err := json.Unmarshal(body, &res); err != nil {
-		out.Printf("Error decoding the message into the OmadaMessage format structure. Error: %v", err)
-		out.Printf("The message was: %v", sanitised)
+		if logPayload {
+			out.ErrorContext(ctx, "Error decoding the message into the OmadaMessage format structure", "error", err, "payload", sanitised)
+		} else {
+			out.ErrorContext(ctx, "Error decoding the message into the OmadaMessage format structure", "error", err)
+		}
 		return &res, err
 	}
 
-	out.Printf("The message is detected to be of type `%v` and is given priority %v", omadaMessageTypeName[res.Type()], res.Priority())
+	out.InfoContext(ctx, "Message type detected",
+		"type", res.Type().String(),
+		"priority", res.Priority(),
+		"controller", res.Controller,
+		"site", res.Site,
+	)
 
 	return &res, nil
 }
 
+var deviceRe = regexp.MustCompile(`\[([^\[\]:]+):((?:[0-9A-Fa-f]{2}-){5}[0-9A-Fa-f]{2})\]`)
+var interfaceRe = regexp.MustCompile(`The online detection result of \[(.+?)\] was`)
+
 var isATestMessage = regexp.MustCompile(`webhook test message[.] Please ignore`)
 var wasOnline = regexp.MustCompile(`The online detection result of \[.+\] was online`)
 var wasOffline = regexp.MustCompile(`The online detection result of \[.+\] was offline`)
@@ -144,6 +303,14 @@ var wasOffline = regexp.MustCompile(`The online detection result of \[.+\] was o
 // Inspect the given message and return what type the message
 // is expected to be based on its findings.
 func parseTypeFromMessage(msg *OmadaMessage) OmadaMessageType {
+	if msg.Raised != UnrecognisedMessage {
+		return msg.Raised
+	}
+
+	if msg.Detected != nil {
+		return msg.Detected.Type
+	}
+
 	if isATestMessage.MatchString(msg.Description) {
 		return OmadaTestMessage
 	}
@@ -167,4 +334,26 @@ func HumanReadableTimestamp(t time.Time) string {
 	return fmt.Sprintf("%v", time.Unix(seconds, 0))
 }
 
+// HumanReadableDuration writes the duration in days, hours and minutes, e.g.
+// `1h 30m`, for people rather than Go.
+func HumanReadableDuration(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	if d < time.Minute {
+		return "less than a minute"
+	}
+
+	var parts []string
+	for _, unit := range []struct {
+		size time.Duration
+		name string
+	}{{24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}} {
+		if d >= unit.size {
+			parts = append(parts, fmt.Sprintf("%d%v", d/unit.size, unit.name))
+			d %= unit.size
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
 // EOF
@@ -2,8 +2,9 @@ package omada_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"testing"
 	"time"
@@ -106,6 +107,78 @@ func TestTypeOmadaMessage(t *testing.T) {
 				Type:     omada.OmadaTestMessage,
 			},
 		},
+		{
+			// Raised by the bridge itself when a controller stops sending
+			name: "Controller silent message",
+			message: &omada.OmadaMessage{
+				Controller: "Home",
+				Text:       []string{"Nothing was received from controller [Home] for 1h 5m."},
+				Raised:     omada.ControllerSilentMessage,
+			},
+			want: &omadaMessageMethodValues{
+				Title:    "Home: ",
+				Body:     "Nothing was received from controller [Home] for 1h 5m.",
+				Priority: 10,
+				Type:     omada.ControllerSilentMessage,
+			},
+		},
+		{
+			name: "Controller resumed message",
+			message: &omada.OmadaMessage{
+				Controller: "Home",
+				Text:       []string{"Messages from controller [Home] are received again, after 2h."},
+				Raised:     omada.ControllerResumedMessage,
+			},
+			want: &omadaMessageMethodValues{
+				Title:    "Home: ",
+				Body:     "Messages from controller [Home] are received again, after 2h.",
+				Priority: 7,
+				Type:     omada.ControllerResumedMessage,
+			},
+		},
+		{
+			// Raised by the bridge itself, through the fallback destination
+			name: "Delivery failing message",
+			message: &omada.OmadaMessage{
+				Controller: "omada-to-ntfy",
+				Text:       []string{"Messages could not be delivered to [ntfy]: 5 deliveries in a row failed. The last error was: EOF"},
+				Raised:     omada.DeliveryFailingMessage,
+			},
+			want: &omadaMessageMethodValues{
+				Title:    "omada-to-ntfy: ",
+				Body:     "Messages could not be delivered to [ntfy]: 5 deliveries in a row failed. The last error was: EOF",
+				Priority: 10,
+				Type:     omada.DeliveryFailingMessage,
+			},
+		},
+		{
+			name: "Delivery recovered message",
+			message: &omada.OmadaMessage{
+				Controller: "omada-to-ntfy",
+				Text:       []string{"Delivery to [ntfy] has recovered, after failing for 12m. 7 messages could not be delivered and were dropped."},
+				Raised:     omada.DeliveryRecoveredMessage,
+			},
+			want: &omadaMessageMethodValues{
+				Title:    "omada-to-ntfy: ",
+				Body:     "Delivery to [ntfy] has recovered, after failing for 12m. 7 messages could not be delivered and were dropped.",
+				Priority: 7,
+				Type:     omada.DeliveryRecoveredMessage,
+			},
+		},
+		{
+			// Only the bridge raises these, whatever a webhook says
+			name: "Webhook looking like a silent message",
+			message: &omada.OmadaMessage{
+				Controller: "Home",
+				Text:       []string{"Nothing was received from controller [Home] for 1h 5m."},
+			},
+			want: &omadaMessageMethodValues{
+				Title:    "Home: ",
+				Body:     "Nothing was received from controller [Home] for 1h 5m.",
+				Priority: 4,
+				Type:     omada.UnrecognisedMessage,
+			},
+		},
 		{
 			// This is not an actual message I've seen, but it's interesting
 			// to test the behaviour is as expected from it nonetheless.
@@ -261,15 +334,15 @@ func TestParseOmadaMessage(t *testing.T) {
 	for _, tt := range tests {
 		var (
 			buf    bytes.Buffer
-			logger = log.New(&buf, "logger: ", log.Lshortfile)
+			logger = slog.New(slog.NewTextHandler(&buf, nil))
 		)
 
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := omada.ParseOmadaMessage(logger, tt.body)
+			got, err := omada.ParseOmadaMessage(context.Background(), logger, tt.body, true)
 
 			logged := buf.String()
 
-			if !strings.Contains(logged, `Processing incoming message:`) {
+			if !strings.Contains(logged, `msg="Processing incoming message" payload=`) {
 				t.Errorf("logger output does not contain incoming message: %s", logged)
 			} else {
 				t.Logf("logger output contains incoming message: %s", logged)
@@ -285,7 +358,7 @@ func TestParseOmadaMessage(t *testing.T) {
 				t.Errorf("ParseOmadaMessage() test failed: %v", diff)
 			}
 
-			if !tt.wantErr && !strings.Contains(logged, `The message is detected to be of type`) {
+			if !tt.wantErr && !strings.Contains(logged, `msg="Message type detected" type=`) {
 				t.Errorf("logger output does not contain info about the detection: %s", logged)
 			} else {
 				t.Logf("logger output contains info about the detection: %s", logged)
@@ -302,11 +375,11 @@ func TestSanitisation(t *testing.T) {
 
 	var (
 		buf    bytes.Buffer
-		logger = log.New(&buf, "logger: ", log.Lshortfile)
+		logger = slog.New(slog.NewTextHandler(&buf, nil))
 	)
 
 	// Create a test message to ensure the sanitization works correctly
-	_, err := omada.ParseOmadaMessage(logger, body)
+	_, err := omada.ParseOmadaMessage(context.Background(), logger, body, true)
 	if err != nil {
 		t.Fatalf("ParseOmadaMessage failed: %v", err)
 	}
@@ -314,13 +387,32 @@ func TestSanitisation(t *testing.T) {
 	logged := buf.String()
 
 	// Verify that shardSecret doesn't appear in the output
-	if strings.Contains(logged, `shardSecret`) && !strings.Contains(logged, `"shardSecret":"****"`) {
+	if strings.Contains(logged, `secret123`) || !strings.Contains(logged, `shardSecret\":\"****\"`) {
 		t.Fatalf("shardSecret` should not be logged; got `%v`", logged)
 	} else {
 		t.Logf("shardSecret` was sanitized correctly; got `%v`", logged)
 	}
 }
 
+func TestParseOmadaMessageWithoutPayloadLogging(t *testing.T) {
+	body := []byte(`{"Controller": "Private Controller", "text": ["Something happened"]}`)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	if _, err := omada.ParseOmadaMessage(context.Background(), logger, body, false); err != nil {
+		t.Fatalf("ParseOmadaMessage failed: %v", err)
+	}
+
+	if _, err := omada.ParseOmadaMessage(context.Background(), logger, []byte(`{"Controller": "Private`), false); err == nil {
+		t.Fatal("ParseOmadaMessage should fail on invalid JSON")
+	}
+
+	if logged := buf.String(); strings.Contains(logged, "payload=") || strings.Contains(logged, "Something happened") {
+		t.Errorf("The payload should not be logged; got `%v`", logged)
+	}
+}
+
 func TestParseTypeFromMessage(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -406,11 +498,11 @@ func TestOmadaMessage_Title(t *testing.T) {
 	for _, tt := range tests {
 		var (
 			buf bytes.Buffer
-			out = log.New(&buf, "logger: ", log.Lshortfile)
+			out = slog.New(slog.NewTextHandler(&buf, nil))
 		)
 
 		t.Run(tt.name, func(t *testing.T) {
-			msg, err := omada.ParseOmadaMessage(out, tt.body)
+			msg, err := omada.ParseOmadaMessage(context.Background(), out, tt.body, false)
 
 			if err != nil {
 				t.Fatalf("could not construct receiver type: %v", err)
@@ -424,3 +516,114 @@ func TestOmadaMessage_Title(t *testing.T) {
 		})
 	}
 }
+
+func TestOmadaMessage_Device(t *testing.T) {
+	tests := []struct {
+		name          string
+		msg           *omada.OmadaMessage
+		wantDevice    string
+		wantMAC       string
+		wantInterface string
+	}{
+		{
+			name: "WAN offline message",
+			msg: &omada.OmadaMessage{
+				Text: []string{
+					"[2.5G WAN1] of [gateway:98-03-8E-3A-8D-53] is down.\r",
+					"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r",
+				},
+			},
+			wantDevice:    "gateway:98-03-8E-3A-8D-53",
+			wantMAC:       "98-03-8E-3A-8D-53",
+			wantInterface: "2.5G WAN1",
+		},
+		{
+			name: "Lowercase MAC address",
+			msg: &omada.OmadaMessage{
+				Text: []string{"[switch:aa-bb-cc-dd-ee-ff] was disconnected."},
+			},
+			wantDevice: "switch:aa-bb-cc-dd-ee-ff",
+			wantMAC:    "AA-BB-CC-DD-EE-FF",
+		},
+		{
+			name: "No device mentioned",
+			msg: &omada.OmadaMessage{
+				Text: []string{"The controller failed to send site logs to 192.168.10.11 automatically (1 logs in total)."},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.msg.Device(); got != tt.wantDevice {
+				t.Errorf("Device() = %q, want %q", got, tt.wantDevice)
+			}
+
+			if got := tt.msg.DeviceMAC(); got != tt.wantMAC {
+				t.Errorf("DeviceMAC() = %q, want %q", got, tt.wantMAC)
+			}
+
+			if got := tt.msg.Interface(); got != tt.wantInterface {
+				t.Errorf("Interface() = %q, want %q", got, tt.wantInterface)
+			}
+		})
+	}
+}
+
+func TestParseMessageType(t *testing.T) {
+	for _, want := range []omada.OmadaMessageType{omada.UnrecognisedMessage, omada.OmadaTestMessage, omada.OmadaOfflineMessage, omada.OmadaOnlineMessage} {
+		got, err := omada.ParseMessageType(" " + strings.ToUpper(want.String()) + " ")
+		if err != nil || got != want {
+			t.Errorf("ParseMessageType(%q) = %v, %v; want %v", want.String(), got, err, want)
+		}
+	}
+
+	if _, err := omada.ParseMessageType("exploded"); err == nil {
+		t.Error("ParseMessageType() should fail on an unknown name")
+	}
+}
+
+func TestOmadaMessage_Event(t *testing.T) {
+	msg := omada.OmadaMessage{
+		Controller:  "Omada_Controller",
+		Site:        "Offline Site",
+		Description: "This is a webhook message from Omada Controller",
+		Text:        []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline.\r"},
+		Timestamp:   1758852904877,
+	}
+
+	want := omada.Event{
+		Controller:  "Omada_Controller",
+		Site:        "Offline Site",
+		Type:        "offline",
+		Priority:    10,
+		Title:       msg.Title(),
+		Body:        msg.Body(),
+		Description: "This is a webhook message from Omada Controller",
+		Text:        []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was offline."},
+		Device:      "gateway:98-03-8E-3A-8D-53",
+		DeviceMAC:   "98-03-8E-3A-8D-53",
+		Interface:   "2.5G WAN1",
+		Time:        time.UnixMilli(1758852904877),
+	}
+
+	if diff := deep.Equal(msg.Event(), want); diff != nil {
+		t.Errorf("Event() test failed: %v", diff)
+	}
+}
+
+func TestHumanReadableDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		30 * time.Second:               "less than a minute",
+		90 * time.Minute:               "1h 30m",
+		26*time.Hour + 59*time.Second:  "1d 2h",
+		49*time.Hour + 5*time.Minute:   "2d 1h 5m",
+		2*time.Minute + 59*time.Second: "2m",
+	}
+
+	for d, want := range tests {
+		if got := omada.HumanReadableDuration(d); got != want {
+			t.Errorf("HumanReadableDuration(%v) = `%v`, want `%v`", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package redact takes personal data, like MAC and IP addresses, out of text
+// before it's logged, stored or sent on: masked, replaced by a pseudonym that
+// stays the same for the same value, or dropped altogether.
+package redact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+)
+
+// Mode is how what's found is redacted.
+type Mode string
+
+// The supported modes.
+const (
+	ModeMask Mode = "mask" // Replaced by the name of the detector, like `[mac]`
+	ModeHash Mode = "hash" // Replaced by a pseudonym, like `mac-3f2a9c1b`
+	ModeDrop Mode = "drop" // Left out
+)
+
+// ParseMode returns the mode going by its name: mask, hash or drop. Empty
+// and `off` mean no redaction, which is returned as an empty mode.
+func ParseMode(name string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(name))); m {
+	case "", "off":
+		return "", nil
+	case ModeMask, ModeHash, ModeDrop:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown redaction mode `%v`, use off, mask, hash or drop", name)
+	}
+}
+
+// Detector finds one kind of data to redact in text.
+type Detector struct {
+	Name    string
+	Pattern *regexp.Regexp
+
+	valid     func(string) bool   // Optional; weeds out matches that only look right
+	normalise func(string) string // Optional; so different notations get the same pseudonym
+}
+
+// The built-in detectors, in the order they're applied in: an email address
+// goes before the hostname in it, and addresses before anything that could
+// be mistaken for a hostname. Hostnames need at least three labels, so file
+// names like `state.json` and the likes of `ntfy.sh` are left alone.
+var builtin = []Detector{
+	{
+		Name:    "mac",
+		Pattern: regexp.MustCompile(`\b(?:[0-9A-Fa-f]{2}[:-]){5}[0-9A-Fa-f]{2}\b`),
+		normalise: func(s string) string {
+			return strings.ToLower(strings.ReplaceAll(s, ":", "-"))
+		},
+	},
+	{
+		Name:      "email",
+		Pattern:   regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@(?:[A-Za-z0-9-]+\.)+[A-Za-z]{2,}\b`),
+		normalise: strings.ToLower,
+	},
+	{
+		Name:    "ipv4",
+		Pattern: regexp.MustCompile(`\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}\b`),
+		valid:   func(s string) bool { a, err := netip.ParseAddr(s); return err == nil && a.Is4() },
+	},
+	{
+		Name:    "ipv6",
+		Pattern: regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}(?:(?:[0-9]{1,3}\.){3}[0-9]{1,3})?`),
+		valid:   validIPv6,
+		normalise: func(s string) string {
+			return netip.MustParseAddr(s).String()
+		},
+	},
+	{
+		Name:      "hostname",
+		Pattern:   regexp.MustCompile(`\b(?:[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.){2,}[A-Za-z][A-Za-z0-9-]{0,61}[A-Za-z0-9]\b`),
+		normalise: strings.ToLower,
+	},
+}
+
+// validIPv6 reports whether the match is an IPv6 address with at least two
+// groups, so `::` in the likes of `std::string` isn't taken for one.
+func validIPv6(s string) bool {
+	a, err := netip.ParseAddr(s)
+	if err != nil || !a.Is6() {
+		return false
+	}
+
+	groups := 0
+	for group := range strings.SplitSeq(s, ":") {
+		if group != "" {
+			groups++
+		}
+	}
+	return groups >= 2
+}
+
+// Builtin returns the built-in detectors with the given names, all of them
+// when none are given: mac, email, ipv4, ipv6 and hostname.
+func Builtin(names ...string) ([]Detector, error) {
+	if len(names) == 0 {
+		return builtin, nil
+	}
+
+	for _, name := range names {
+		if !slices.ContainsFunc(builtin, func(d Detector) bool { return strings.EqualFold(d.Name, name) }) {
+			return nil, fmt.Errorf("unknown detector `%v`, use mac, email, ipv4, ipv6 or hostname", name)
+		}
+	}
+
+	var detectors []Detector
+	for _, d := range builtin {
+		if slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(d.Name, name) }) {
+			detectors = append(detectors, d)
+		}
+	}
+
+	return detectors, nil
+}
+
+// Custom returns a detector for the regular expression, under the name it's
+// masked as and its pseudonyms start with.
+func Custom(name, pattern string) (Detector, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Detector{}, fmt.Errorf("pattern `%v`: %w", name, err)
+	}
+
+	return Detector{Name: name, Pattern: re}, nil
+}
+
+// Redactor redacts what its detectors find, in the order they're given. A
+// nil *Redactor leaves everything as it is.
+type Redactor struct {
+	Detectors []Detector
+	Mode      Mode
+	Key       []byte // Keys the pseudonyms, so they can't be undone by trying every MAC address
+}
+
+// String returns the text redacted.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+
+	for _, d := range r.Detectors {
+		s = d.Pattern.ReplaceAllStringFunc(s, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			return r.replace(d, match)
+		})
+	}
+
+	return s
+}
+
+func (r *Redactor) replace(d Detector, match string) string {
+	switch r.Mode {
+	case ModeHash:
+		if d.normalise != nil {
+			match = d.normalise(match)
+		}
+
+		mac := hmac.New(sha256.New, r.Key)
+		mac.Write([]byte(d.Name + ":" + match))
+		return d.Name + "-" + hex.EncodeToString(mac.Sum(nil)[:4])
+
+	case ModeDrop:
+		return ""
+
+	default:
+		return "[" + d.Name + "]"
+	}
+}
+
+// Message returns a redacted copy of the message. What's detected about the
+// message is worked out first and kept with it, redacted like the text, so
+// the type, device and interface don't get lost when the text no longer
+// tells them.
+func (r *Redactor) Message(msg *omada.OmadaMessage) *omada.OmadaMessage {
+	if r == nil || msg == nil {
+		return msg
+	}
+
+	redacted := *msg
+	redacted.Controller = r.String(msg.Controller)
+	redacted.Site = r.String(msg.Site)
+	redacted.Description = r.String(msg.Description)
+	redacted.Text = r.strings(msg.Text)
+	redacted.Detected = &omada.Detected{
+		Type:      msg.Type(),
+		Device:    r.String(msg.Device()),
+		DeviceMAC: r.String(msg.DeviceMAC()),
+		Interface: r.String(msg.Interface()),
+	}
+
+	return &redacted
+}
+
+// Event returns the event redacted.
+func (r *Redactor) Event(e omada.Event) omada.Event {
+	if r == nil {
+		return e
+	}
+
+	e.Controller = r.String(e.Controller)
+	e.Site = r.String(e.Site)
+	e.Title = r.String(e.Title)
+	e.Body = r.String(e.Body)
+	e.Description = r.String(e.Description)
+	e.Text = r.strings(e.Text)
+	e.Device = r.String(e.Device)
+	e.DeviceMAC = r.String(e.DeviceMAC)
+	e.Interface = r.String(e.Interface)
+
+	return e
+}
+
+func (r *Redactor) strings(texts []string) []string {
+	if texts == nil {
+		return nil
+	}
+
+	redacted := make([]string, len(texts))
+	for i, s := range texts {
+		redacted[i] = r.String(s)
+	}
+	return redacted
+}
+
+// Handler wraps the log handler so the message and every value of a record
+// other than numbers, booleans, times and durations are redacted before
+// they're written.
+func (r *Redactor) Handler(h slog.Handler) slog.Handler {
+	if r == nil {
+		return h
+	}
+
+	return handler{h, r}
+}
+
+type handler struct {
+	slog.Handler
+	r *Redactor
+}
+
+func (h handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.r.String(record.Message), record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.attr(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.attr(a)
+	}
+
+	return handler{h.Handler.WithAttrs(redacted), h.r}
+}
+
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{h.Handler.WithGroup(name), h.r}
+}
+
+func (h handler) attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.r.String(v.String()))
+
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]any, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = h.attr(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+
+	case slog.KindAny:
+		// Errors, addresses like netip.Addr and anything else are redacted
+		// as they'd be written
+		return slog.String(a.Key, h.r.String(fmt.Sprint(v.Any())))
+	}
+
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// EOF
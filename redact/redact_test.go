@@ -0,0 +1,179 @@
+package redact_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+)
+
+func redactor(t *testing.T, mode redact.Mode, names ...string) *redact.Redactor {
+	detectors, err := redact.Builtin(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &redact.Redactor{Detectors: detectors, Mode: mode, Key: []byte("key")}
+}
+
+func TestDetectors(t *testing.T) {
+	r := redactor(t, redact.ModeMask)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"[gateway:00-00-5E-00-53-01]: The online detection result of [WAN1] was offline.", "[gateway:[mac]]: The online detection result of [WAN1] was offline."},
+		{"Client aa:bb:cc:dd:ee:ff connected", "Client [mac] connected"},
+		{"Client 192.168.1.23 got a lease", "Client [ipv4] got a lease"},
+		{"Not an address: 999.1.1.1, version 1.2.3", "Not an address: 999.1.1.1, version 1.2.3"},
+		{"From 2001:db8::42 and fe80::1", "From [ipv6] and [ipv6]"},
+		{"Times like 12:30:45 and std::string are left alone", "Times like 12:30:45 and std::string are left alone"},
+		{"Mail bob.smith@example.com", "Mail [email]"},
+		{"Reach nas.home.arpa or push.example.com", "Reach [hostname] or [hostname]"},
+		{"Loaded state.json from main.go, sent to ntfy.sh", "Loaded state.json from main.go, sent to ntfy.sh"},
+		{"Running v1.2 on example.com", "Running v1.2 on example.com"},
+		{"This is a webhook test message. Please ignore this", "This is a webhook test message. Please ignore this"},
+		{"Interface 2.5G WAN1", "Interface 2.5G WAN1"},
+	}
+
+	for _, tt := range tests {
+		if got := r.String(tt.text); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if _, err := redact.Builtin("mac", "phone"); err == nil {
+		t.Errorf("Expected an error for an unknown detector")
+	}
+}
+
+func TestModes(t *testing.T) {
+	text := "Device 00-00-5E-00-53-01 at 10.0.0.5"
+
+	if got, want := redactor(t, redact.ModeDrop, "mac", "ipv4").String(text), "Device  at "; got != want {
+		t.Errorf("Dropped: got %q, want %q", got, want)
+	}
+
+	if got, want := redactor(t, redact.ModeMask, "ipv4").String(text), "Device 00-00-5E-00-53-01 at [ipv4]"; got != want {
+		t.Errorf("Only the chosen detectors should apply: got %q, want %q", got, want)
+	}
+
+	hashed := redactor(t, redact.ModeHash)
+	first := hashed.String("Device 00-00-5E-00-53-01")
+	if !strings.HasPrefix(first, "Device mac-") || strings.Contains(first, "53-01") {
+		t.Fatalf("Expected a pseudonym, got %q", first)
+	}
+
+	// The same MAC address in another notation gets the same pseudonym, a
+	// different one another
+	if again := hashed.String("Device 00:00:5e:00:53:01"); again != first {
+		t.Errorf("Expected a stable pseudonym, got %q and %q", first, again)
+	}
+	if other := hashed.String("Device 00-00-5E-00-53-02"); other == first {
+		t.Errorf("Expected different MAC addresses to get different pseudonyms")
+	}
+
+	// Without the key the pseudonyms can't be reproduced
+	otherKey := &redact.Redactor{Detectors: hashed.Detectors, Mode: redact.ModeHash, Key: []byte("other")}
+	if otherKey.String("Device 00-00-5E-00-53-01") == first {
+		t.Errorf("Expected the pseudonym to depend on the key")
+	}
+
+	for _, name := range []string{"", "off", "Mask", "hash", "drop"} {
+		if _, err := redact.ParseMode(name); err != nil {
+			t.Errorf("ParseMode(%q) returned an error: %v", name, err)
+		}
+	}
+	if _, err := redact.ParseMode("blur"); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+func TestCustom(t *testing.T) {
+	client, err := redact.Custom("client", `[A-Za-z]+-iPhone`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &redact.Redactor{Detectors: []redact.Detector{client}, Mode: redact.ModeMask}
+	if got, want := r.String("[client:Bobs-iPhone] went offline"), "[client:[client]] went offline"; got != want {
+		t.Errorf("Custom pattern: got %q, want %q", got, want)
+	}
+
+	if _, err := redact.Custom("broken", `[a-`); err == nil {
+		t.Errorf("Expected an error for a broken pattern")
+	}
+}
+
+func TestMessage(t *testing.T) {
+	r := redactor(t, redact.ModeHash)
+	msg := &omada.OmadaMessage{
+		Controller: "Home",
+		Site:       "Main",
+		Text:       []string{"[gateway:00-00-5E-00-53-01]: The online detection result of [WAN1] was offline."},
+		Timestamp:  1758852934790,
+	}
+
+	redacted := r.Message(msg)
+	if redacted.Type() != omada.OmadaOfflineMessage || redacted.Timestamp != msg.Timestamp {
+		t.Errorf("Expected the message to keep its type and time, got %+v", redacted)
+	}
+	if strings.Contains(redacted.Text[0], "53-01") || !strings.Contains(msg.Text[0], "53-01") {
+		t.Errorf("Expected a redacted copy, leaving the message as it was; got %q and %q", redacted.Text[0], msg.Text[0])
+	}
+
+	// The device of the event gets the same pseudonym as the text
+	event := r.Event(msg.Event())
+	if event.DeviceMAC == "" || !strings.Contains(event.Body, event.DeviceMAC) || event.Device != "gateway:"+event.DeviceMAC {
+		t.Errorf("Expected the device to be redacted like the text, got %+v", event)
+	}
+
+	// What the redacted text no longer tells is kept, redacted the same way
+	if redacted.DeviceMAC() != event.DeviceMAC || redacted.Device() != event.Device || redacted.Interface() != "WAN1" {
+		t.Errorf("Expected the device of the redacted message to be %v, got %v (%v)", event.Device, redacted.Device(), redacted.DeviceMAC())
+	}
+
+	wan, _ := redact.Custom("wan", `WAN[0-9]`)
+	dropped := (&redact.Redactor{Detectors: []redact.Detector{wan}, Mode: redact.ModeDrop}).Message(msg)
+	if dropped.Type() != omada.OmadaOfflineMessage || dropped.Interface() != "" || dropped.DeviceMAC() != "00-00-5E-00-53-01" {
+		t.Errorf("Expected the type and device to be kept with the interface dropped, got %v, %q, %q", dropped.Type(), dropped.Interface(), dropped.DeviceMAC())
+	}
+
+	var none *redact.Redactor
+	if none.Message(msg) != msg || none.String("10.0.0.1") != "10.0.0.1" {
+		t.Errorf("Expected a nil redactor to leave everything as it is")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	r := redactor(t, redact.ModeMask)
+	logger := slog.New(r.Handler(slog.NewTextHandler(&buf, nil))).With("peer", "10.0.0.1")
+
+	logger.Info("Device 00-00-5E-00-53-01 went offline",
+		"client_ip", "192.168.1.23",
+		"error", errors.New("dial tcp nas.home.arpa: timeout"),
+		"remote_ip", netip.MustParseAddr("203.0.113.7"),
+		"peers", []netip.Addr{netip.MustParseAddr("2001:db8::42")},
+		slog.Group("request", "host", "push.example.com"),
+		"count", 3,
+	)
+
+	out := buf.String()
+	for _, leaked := range []string{"00-00-5E", "10.0.0.1", "192.168.1.23", "nas.home.arpa", "push.example.com", "203.0.113.7", "2001:db8::42"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("Expected %q to be redacted from the log: %v", leaked, out)
+		}
+	}
+	if !strings.Contains(out, "count=3") || !strings.Contains(out, "request.host=[hostname]") {
+		t.Errorf("Expected the other values and groups to be kept: %v", out)
+	}
+}
+
+// EOF
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/config"
+	"github.com/zimmra/omada-to-ntfy/dashboard"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/webhook"
+)
+
+// How often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// liveServer serves the webhook with the current configuration. A reload
+// swaps in a whole new WebhookServer, so requests that are already underway
+// finish with the configuration they started with.
+type liveServer struct {
+	atomic.Pointer[webhook.WebhookServer]
+
+	// The admin credentials, which can be changed by a reload as well
+	admin atomic.Pointer[credentials]
+}
+
+type credentials struct {
+	username string
+	password string
+}
+
+// adminFromEnv returns the admin credentials, or nil without a password.
+func adminFromEnv(getenv func(string) string) *credentials {
+	password := getenv("ADMIN_PASSWORD")
+	if password == "" {
+		return nil
+	}
+
+	username := getenv("ADMIN_USERNAME")
+	if username == "" {
+		username = "admin"
+	}
+
+	return &credentials{username: username, password: password}
+}
+
+// Admin puts h behind the current admin credentials.
+func (ls *liveServer) Admin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ls.admin.Load()
+		(&dashboard.Auth{Username: c.username, Password: c.password, Next: h}).ServeHTTP(w, r)
+	})
+}
+
+func (ls *liveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ls.Load().ServeHTTP(w, r)
+}
+
+// Send sends a message of the bridge's own through the current notifiers.
+func (ls *liveServer) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	return ls.Load().Notifier.Send(ctx, payload)
+}
+
+// reload loads the configuration again and swaps in a server built from it.
+// When the new configuration isn't valid, the running one is kept.
+//
+// The port, logging, capture, history, state, heartbeat, lockout, replay
+// and tracing settings are only read at startup, and so is whether there's
+// a dashboard at all: the admin credentials can be changed, not removed.
+func (ls *liveServer) reload(path string, logger *slog.Logger) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	current := ls.Load()
+
+	admin := adminFromEnv(cfg.Getenv)
+	if admin == nil && ls.admin.Load() != nil {
+		return errors.New("ADMIN_PASSWORD can't be removed without a restart")
+	}
+
+	server, err := newServer(cfg.Getenv, logger, current.Metrics)
+	if err != nil {
+		return err
+	}
+	server.Tracer = current.Tracer
+	server.Capture = current.Capture
+	server.History = current.History
+	server.State = current.State
+	server.Heartbeat = current.Heartbeat
+	server.Lockout = current.Lockout
+	server.Replays = current.Replays
+	server.Watchdog.TakeOver(current.Watchdog)
+
+	ls.Store(server)
+	if admin != nil && ls.admin.Load() != nil {
+		ls.admin.Store(admin)
+	}
+	logger.Info("Configuration reloaded", "notifiers", len(server.Notifier.(notifier.Multi)))
+
+	return nil
+}
+
+// watch reloads the configuration on SIGHUP, and whenever the config file
+// at path (if any) or a secret file changes, checking them every interval.
+func (ls *liveServer) watch(path string, interval time.Duration, logger *slog.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// The latest change to the config file or a secret file
+	modified := func() time.Time {
+		paths := []string{path}
+		if cfg, err := config.Load(path); err == nil {
+			for _, p := range cfg.SecretFiles() {
+				paths = append(paths, p)
+			}
+		}
+
+		var latest time.Time
+		for _, p := range paths {
+			if info, err := os.Stat(p); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+		return latest
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := modified()
+
+	for {
+		select {
+		case <-hangup:
+			logger.Info("Reloading configuration on SIGHUP")
+		case <-ticker.C:
+			m := modified()
+			if m.Equal(last) {
+				continue
+			}
+			last = m
+			logger.Info("Reloading configuration after the config file or a secret file changed", "path", path)
+		}
+
+		if err := ls.reload(path, logger); err != nil {
+			logger.Error("Configuration not reloaded, keeping the running configuration", "error", err)
+		}
+	}
+}
+
+// EOF
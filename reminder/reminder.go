@@ -0,0 +1,128 @@
+// Package reminder sends reminders about devices that stay offline, as a
+// single notification is easily missed. Reminders stop once the device is
+// back online or the outage is acknowledged.
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/state"
+)
+
+// Reminder sends a reminder through Notifier every Interval while a device
+// tracked by State is offline, up to Max times per outage (or without end
+// when Max is 0).
+type Reminder struct {
+	State    *state.Tracker
+	Notifier notifier.Notifier
+	Interval time.Duration
+	Max      int
+	Logger   *slog.Logger
+
+	mu   sync.Mutex
+	sent map[string]sent // By device and interface
+}
+
+// sent is how many reminders went out about an outage.
+type sent struct {
+	since time.Time
+	count int
+}
+
+// Run checks for reminders that are due until the context ends.
+func (r *Reminder) Run(ctx context.Context) {
+	ticker := time.NewTicker(min(r.Interval, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.Check(ctx, now)
+		}
+	}
+}
+
+// Check sends the reminders that are due at the given time.
+func (r *Reminder) Check(ctx context.Context, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sent == nil {
+		r.sent = map[string]sent{}
+	}
+
+	outages := map[string]bool{}
+
+	for _, s := range r.State.List(state.Filter{State: state.Offline}) {
+		key := s.Device + "\x00" + s.Interface + "\x00" + s.Controller + "\x00" + s.Site
+		outages[key] = true
+
+		if s.Acknowledged != nil {
+			continue
+		}
+
+		prev := r.sent[key]
+		if !prev.since.Equal(s.Since) {
+			// It's a new outage
+			prev = sent{since: s.Since}
+		}
+
+		// After a restart this skips the reminders that were missed, rather
+		// than sending all of them at once
+		due := int(now.Sub(s.Since) / r.Interval)
+		if r.Max > 0 {
+			due = min(due, r.Max)
+		}
+
+		if due <= prev.count {
+			r.sent[key] = prev
+			continue
+		}
+
+		ctx := logging.WithRequestID(ctx, logging.NewRequestID())
+		if err := r.Notifier.Send(ctx, r.message(s, now, due)); err != nil {
+			r.Logger.ErrorContext(ctx, "Could not send outage reminder", "device", s.Device, "interface", s.Interface, "error", err)
+			r.sent[key] = prev
+			continue
+		}
+
+		r.Logger.InfoContext(ctx, "Sent outage reminder", "device", s.Device, "interface", s.Interface, "reminder", due)
+		r.sent[key] = sent{since: s.Since, count: due}
+	}
+
+	// Forget about outages that are over
+	for key := range r.sent {
+		if !outages[key] {
+			delete(r.sent, key)
+		}
+	}
+}
+
+// message makes the reminder: the original offline message, preceded by a
+// line telling how long the device has been offline. It's still recognised
+// as an offline message, so it's routed and prioritised like one.
+func (r *Reminder) message(s state.State, now time.Time, count int) *omada.OmadaMessage {
+	reminder := fmt.Sprintf("Still offline after %v (reminder %d", omada.HumanReadableDuration(now.Sub(s.Since)), count)
+	if r.Max > 0 {
+		reminder += fmt.Sprintf(" of %d", r.Max)
+	}
+	reminder += ")"
+
+	return &omada.OmadaMessage{
+		Controller: s.Controller,
+		Site:       s.Site,
+		Text:       append([]string{reminder}, s.Event.Text...),
+		Timestamp:  now.UnixMilli(),
+	}
+}
+
+// EOF
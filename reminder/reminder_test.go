@@ -0,0 +1,118 @@
+package reminder_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/reminder"
+	"github.com/zimmra/omada-to-ntfy/state"
+)
+
+type notifierMock struct {
+	sent []*omada.OmadaMessage
+	err  error
+}
+
+func (n *notifierMock) Send(ctx context.Context, payload *omada.OmadaMessage) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, payload)
+	return nil
+}
+
+func update(tracker *state.Tracker, result string, at time.Time) {
+	tracker.Update(history.NewEntry("", &omada.OmadaMessage{
+		Controller: "Home",
+		Site:       "Default",
+		Text:       []string{"[gateway:98-03-8E-3A-8D-53]: The online detection result of [WAN1] was " + result + "."},
+		Timestamp:  at.UnixMilli(),
+	}, nil))
+}
+
+func TestReminder(t *testing.T) {
+	tracker, _ := state.Open("")
+	n := &notifierMock{}
+
+	r := &reminder.Reminder{
+		State:    tracker,
+		Notifier: n,
+		Interval: 30 * time.Minute,
+		Max:      2,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	ctx := context.Background()
+	down := time.Now().Truncate(time.Millisecond)
+	update(tracker, "offline", down)
+
+	r.Check(ctx, down.Add(29*time.Minute))
+	if len(n.sent) != 0 {
+		t.Fatalf("Reminder sent before the interval passed")
+	}
+
+	r.Check(ctx, down.Add(31*time.Minute))
+	if len(n.sent) != 1 {
+		t.Fatalf("Expected a reminder after 31 minutes, got %d", len(n.sent))
+	}
+
+	msg := n.sent[0]
+	if msg.Type() != omada.OmadaOfflineMessage || msg.Title() != "Home: Default" || !strings.HasPrefix(msg.Body(), "Still offline after 31m (reminder 1 of 2)\n[gateway:98-03-8E-3A-8D-53]") {
+		t.Errorf("Unexpected reminder: %v, %v", msg.Title(), msg.Body())
+	}
+
+	r.Check(ctx, down.Add(45*time.Minute))
+	if len(n.sent) != 1 {
+		t.Errorf("Reminder sent again within the interval")
+	}
+
+	t.Run("Failed reminders are tried again", func(t *testing.T) {
+		n.err = errors.New("ntfy is down")
+		r.Check(ctx, down.Add(61*time.Minute))
+
+		n.err = nil
+		r.Check(ctx, down.Add(62*time.Minute))
+
+		if len(n.sent) != 2 || !strings.Contains(n.sent[1].Body(), "after 1h 2m (reminder 2 of 2)") {
+			t.Errorf("Expected the second reminder to be sent after a failure, got %d", len(n.sent))
+		}
+	})
+
+	t.Run("No more than the maximum is sent", func(t *testing.T) {
+		r.Check(ctx, down.Add(5*time.Hour))
+		if len(n.sent) != 2 {
+			t.Errorf("Expected 2 reminders at most, got %d", len(n.sent))
+		}
+	})
+
+	t.Run("A new outage gets new reminders", func(t *testing.T) {
+		up := down.Add(6 * time.Hour)
+		update(tracker, "online", up)
+		r.Check(ctx, up.Add(time.Hour))
+
+		update(tracker, "offline", up.Add(2*time.Hour))
+		r.Check(ctx, up.Add(2*time.Hour+31*time.Minute))
+
+		if len(n.sent) != 3 || !strings.Contains(n.sent[2].Body(), "(reminder 1 of 2)") {
+			t.Errorf("Expected a first reminder for the new outage, got %d", len(n.sent))
+		}
+	})
+
+	t.Run("Acknowledged outages get no reminders", func(t *testing.T) {
+		tracker.Acknowledge(state.Filter{DeviceMAC: "98-03-8E-3A-8D-53"}, time.Now())
+		r.Check(ctx, down.Add(24*time.Hour))
+
+		if len(n.sent) != 3 {
+			t.Errorf("Reminder sent for an acknowledged outage")
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/capture"
+	"github.com/zimmra/omada-to-ntfy/config"
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/notifier"
+	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+)
+
+// replayed is a payload read back from a capture.
+type replayed struct {
+	line    int
+	time    time.Time
+	body    []byte
+	query   string // Of the captured request, e.g. `controller=Home`
+	message *omada.OmadaMessage
+	err     error
+}
+
+// readCapture reads the payloads from a JSONL capture. Lines are either
+// records written by capture mode or bare Omada payloads.
+func readCapture(r io.Reader) ([]replayed, error) {
+	var payloads []replayed
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec capture.Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		p := replayed{line: n, time: rec.Time, body: rec.Body}
+		if u, err := url.Parse(rec.Path); err == nil {
+			p.query = u.RawQuery
+		}
+
+		var text string
+		switch {
+		case len(rec.Body) == 0:
+			p.body = append([]byte(nil), line...)
+		case json.Unmarshal(rec.Body, &text) == nil:
+			// Captured bodies that weren't JSON are kept as a string
+			p.body = []byte(text)
+		}
+
+		p.message, p.err = omada.ParseOmadaMessage(context.Background(), discard, p.body, false)
+		if p.err == nil {
+			if p.time.IsZero() {
+				p.time = p.message.Date()
+			}
+			// Named by the webhook URL, as the bridge does for test messages
+			if p.message.Controller == "" {
+				values, _ := url.ParseQuery(p.query)
+				p.message.Controller = values.Get("controller")
+			}
+		}
+
+		payloads = append(payloads, p)
+	}
+
+	return payloads, scanner.Err()
+}
+
+// Replay runs the payloads from a capture through the bridge again, to see
+// what changes to the configuration would have done. By default it shows
+// what would be delivered where, without sending anything.
+func Replay(args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	path := configFlag(fs)
+	topic := fs.String("topic", "", "send the notifications to this ntfy topic on the configured ntfy server")
+	url := fs.String("url", "", "POST the payloads to the bridge running at this URL")
+	secret := fs.String("secret", "", "the shared secret for -url (default from the configuration)")
+	speed := fs.Float64("speed", 1, "how much faster than originally to send with -topic or -url; 0 sends without waiting")
+	restamp := fs.Bool("restamp", false, "with -url, set the timestamp of the payloads to when they're sent, for a bridge with REPLAY_WINDOW")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *topic != "" && *url != "" {
+		fmt.Fprintln(os.Stderr, "Use either -topic or -url, not both")
+		return 2
+	}
+
+	input := stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		input = f
+	}
+
+	payloads, err := readCapture(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read the capture: %v\n", err)
+		return 1
+	}
+
+	cfg, err := config.Load(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	logger := commandLogger(*path)
+
+	var send func(ctx context.Context, p replayed) error
+
+	switch {
+	case *url != "":
+		if *secret == "" {
+			*secret = cfg.Getenv("OMADA_SHARED_SECRET")
+		}
+		send = func(ctx context.Context, p replayed) error {
+			body := p.body
+			if *restamp {
+				var err error
+				if body, err = stamp(body, time.Now()); err != nil {
+					return err
+				}
+			}
+			// With the query it was captured with, unless the URL has its own
+			target := *url
+			if p.query != "" && !strings.Contains(target, "?") {
+				target += "?" + p.query
+			}
+			return replayTo(ctx, target, *secret, body)
+		}
+
+	case *topic != "":
+		if cfg.Getenv("NTFY_URL") == "" {
+			fmt.Fprintln(os.Stderr, "-topic needs NTFY_URL to be configured")
+			return 1
+		}
+		r, err := redactorFromEnv(cfg.Getenv, "REDACT_NOTIFICATIONS")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		client := notifier.Redacted{Notifier: &ntfy.NtfyClient{
+			NtfyURL:  cfg.Getenv("NTFY_URL"),
+			Topic:    *topic,
+			Username: cfg.Getenv("NTFY_USER"),
+			Password: cfg.Getenv("NTFY_PASSWORD"),
+			Logger:   logger,
+		}, Redactor: r}
+		send = func(ctx context.Context, p replayed) error {
+			if p.err != nil {
+				return p.err
+			}
+			return client.Send(ctx, p.message)
+		}
+
+	default:
+		notifiers, _, _, err := checkConfig(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			return 1
+		}
+
+		// Checked along with the rest of the configuration
+		r, _ := redactorFromEnv(cfg.Getenv, "REDACT_NOTIFICATIONS")
+
+		for _, p := range payloads {
+			printReplayed(stdout, p, notifiers, r)
+		}
+		return 0
+	}
+
+	ctx := logging.WithRequestID(context.Background(), "replay")
+	failed := false
+
+	for i, p := range payloads {
+		if i > 0 && *speed > 0 && p.time.After(payloads[i-1].time) {
+			time.Sleep(time.Duration(float64(p.time.Sub(payloads[i-1].time)) / *speed))
+		}
+
+		if err := send(ctx, p); err != nil {
+			fmt.Fprintf(stdout, "#%d: failed: %v\n", p.line, err)
+			failed = true
+			continue
+		}
+
+		fmt.Fprintf(stdout, "#%d: sent\n", p.line)
+	}
+
+	if failed {
+		return 1
+	}
+
+	return 0
+}
+
+// printReplayed shows the notification made from a payload, redacted as it
+// would be sent, and which of the notifiers it would go to.
+func printReplayed(w io.Writer, p replayed, notifiers notifier.Multi, redactor *redact.Redactor) {
+	if p.err != nil {
+		fmt.Fprintf(w, "#%d: not an Omada payload: %v\n\n", p.line, p.err)
+		return
+	}
+
+	msg := p.message
+	sent := redactor.Message(msg)
+	fmt.Fprintf(w, "#%d %v: %v, priority %d\n", p.line, p.time.Format(time.DateTime), msg.Type(), msg.Priority())
+	fmt.Fprintf(w, "  Title: %v\n", sent.Title())
+	fmt.Fprintf(w, "  Body:  %v\n", strings.ReplaceAll(strings.ReplaceAll(sent.Body(), "\r", ""), "\n", "\n         "))
+
+	for _, n := range notifiers {
+		if r, ok := n.(notifier.Route); ok && !r.Matches(msg) {
+			fmt.Fprintf(w, "  %v: skipped by its routing rules\n", notifier.Name(n))
+			continue
+		}
+		fmt.Fprintf(w, "  %v: would send\n", notifier.Name(n))
+	}
+
+	fmt.Fprintln(w)
+}
+
+// stamp returns the payload with its timestamp set to the given time.
+func stamp(body []byte, t time.Time) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("can't set the timestamp: %w", err)
+	}
+
+	fields["timestamp"] = json.RawMessage(strconv.FormatInt(t.UnixMilli(), 10))
+
+	return json.Marshal(fields)
+}
+
+// replayTo posts a payload to a running bridge, as Omada would.
+func replayTo(ctx context.Context, url string, secret string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header["Access_token"] = []string{secret}
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bridge returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// EOF
@@ -0,0 +1,370 @@
+// Package state keeps track of whether each device and interface is online
+// or offline, going by the last online or offline event received about it,
+// so it's possible to tell what is down right now.
+package state
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/redact"
+)
+
+// The states a device or interface can be in.
+const (
+	Online  = "online"
+	Offline = "offline"
+)
+
+// State is the last known state of a device, or of one of its interfaces.
+type State struct {
+	ID         string        `json:"id"` // Picks the state for an acknowledgement, however it's redacted
+	Controller string        `json:"controller"`
+	Site       string        `json:"site"`
+	Device     string        `json:"device"`
+	DeviceMAC  string        `json:"device_mac"`
+	Interface  string        `json:"interface,omitempty"`
+	State      string        `json:"state"`
+	Since      time.Time     `json:"since"`   // When the state last changed
+	Updated    time.Time     `json:"updated"` // When the last event came in
+	Event      history.Entry `json:"event"`   // The event that set the state
+
+	// When someone acknowledged the device being offline, until it changes
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+}
+
+func (s State) key() string {
+	return strings.Join([]string{s.Controller, s.Site, s.Device, s.Interface}, "\x00")
+}
+
+// Tracker keeps the states, and when it has a file, saves them to it on
+// every update so they survive a restart. A nil *Tracker tracks nothing.
+type Tracker struct {
+	// Optional; redacts the states served. They're kept as they are, so
+	// devices are told apart and reminded about whatever the redaction.
+	Redactor *redact.Redactor
+
+	path string
+
+	mu     sync.Mutex
+	states map[string]State
+}
+
+// Open opens the tracker with the states saved in the file at path, or one
+// keeping them in memory only if the path is empty.
+func Open(path string) (*Tracker, error) {
+	t := &Tracker{path: path, states: map[string]State{}}
+
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file: %w", err)
+	}
+
+	var states []State
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("state file %v: %w", path, err)
+	}
+
+	for _, s := range states {
+		if s.ID == "" {
+			s.ID = rand.Text()
+		}
+		t.states[s.key()] = s
+	}
+
+	return t, nil
+}
+
+// Update updates the state of the device the event is about, if it's an
+// online or offline event. It returns the state before and after, and
+// whether the state changed; an event older than the last one about the
+// device doesn't change anything.
+func (t *Tracker) Update(e history.Entry) (before State, after State, changed bool, err error) {
+	if t == nil || e.Device == "" || (e.Type != Online && e.Type != Offline) {
+		return State{}, State{}, false, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	after = State{
+		Controller: e.Controller,
+		Site:       e.Site,
+		Device:     e.Device,
+		DeviceMAC:  e.DeviceMAC,
+		Interface:  e.Interface,
+		State:      e.Type,
+		Since:      e.Time,
+		Updated:    e.Time,
+		Event:      e,
+	}
+
+	before, known := t.states[after.key()]
+
+	if known && e.Time.Before(before.Updated) {
+		return before, before, false, nil
+	}
+
+	after.ID = before.ID
+	if !known {
+		after.ID = rand.Text()
+	}
+
+	if known && before.State == after.State {
+		after.Since = before.Since
+		after.Acknowledged = before.Acknowledged
+	}
+
+	t.states[after.key()] = after
+	changed = !known || before.State != after.State
+
+	return before, after, changed, t.save()
+}
+
+// save writes all states to the file, replacing it as a whole so a crash
+// can't leave half of it behind.
+func (t *Tracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(t.list(Filter{}), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+
+	return nil
+}
+
+// Filter selects states; zero fields match everything. With a redactor
+// in hash mode the controller, site, MAC address and interface can also be
+// given as they're served, as pseudonyms.
+type Filter struct {
+	ID         string
+	State      string
+	Controller string
+	Site       string
+	DeviceMAC  string // In any notation, e.g. `98:03:8e:3a:8d:53`
+	Interface  string
+}
+
+func (f Filter) matches(s State, r *redact.Redactor) bool {
+	// Masked and dropped values don't tell one device from another, so
+	// only pseudonyms are taken for the actual value
+	is := func(want, value string) bool {
+		return strings.EqualFold(want, value) || (r != nil && r.Mode == redact.ModeHash && strings.EqualFold(want, r.String(value)))
+	}
+
+	switch {
+	case f.ID != "" && f.ID != s.ID:
+		return false
+	case f.State != "" && !strings.EqualFold(f.State, s.State):
+		return false
+	case f.Controller != "" && !is(f.Controller, s.Controller):
+		return false
+	case f.Site != "" && !is(f.Site, s.Site):
+		return false
+	case f.DeviceMAC != "" && !is(history.NormaliseMAC(f.DeviceMAC), s.DeviceMAC) && !is(f.DeviceMAC, s.DeviceMAC):
+		return false
+	case f.Interface != "" && !is(f.Interface, s.Interface):
+		return false
+	}
+
+	return true
+}
+
+// List returns the states matching the filter, ordered by controller, site,
+// device and interface.
+func (t *Tracker) List(f Filter) []State {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.list(f)
+}
+
+func (t *Tracker) list(f Filter) []State {
+	states := []State{}
+
+	for _, s := range t.states {
+		if f.matches(s, t.Redactor) {
+			states = append(states, s)
+		}
+	}
+
+	slices.SortFunc(states, func(a, b State) int {
+		return cmp.Or(
+			cmp.Compare(a.Controller, b.Controller),
+			cmp.Compare(a.Site, b.Site),
+			cmp.Compare(a.Device, b.Device),
+			cmp.Compare(a.Interface, b.Interface),
+		)
+	})
+
+	return states
+}
+
+// Acknowledge marks the offline devices matching the filter as acknowledged,
+// which stops the reminders about them, and returns them.
+func (t *Tracker) Acknowledge(f Filter, at time.Time) ([]State, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f.State = Offline
+	acknowledged := t.list(f)
+
+	for i := range acknowledged {
+		acknowledged[i].Acknowledged = &at
+		t.states[acknowledged[i].key()] = acknowledged[i]
+	}
+
+	if len(acknowledged) == 0 {
+		return acknowledged, nil
+	}
+
+	return acknowledged, t.save()
+}
+
+// ServeHTTP answers on the `/api/state` endpoint with the states matching the
+// `state`, `controller`, `site` and `device_mac` query parameters, e.g.
+// `?state=offline` for everything that is down.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+
+	f := Filter{
+		State:      params.Get("state"),
+		Controller: params.Get("controller"),
+		Site:       params.Get("site"),
+		DeviceMAC:  params.Get("device_mac"),
+		Interface:  params.Get("interface"),
+	}
+
+	if f.State != "" && f.State != Online && f.State != Offline {
+		http.Error(w, fmt.Sprintf("state must be online or offline, got `%v`", f.State), http.StatusBadRequest)
+		return
+	}
+
+	states := t.redacted(t.List(f))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{"states": states})
+}
+
+// ServeAck acknowledges outages on the `/api/state/ack` endpoint, for the
+// state given by its `id`, or the device given by the `device_mac` query
+// parameter and, optionally, only its `interface`. Requests from another site's page are turned away, so a page
+// can't have a logged in browser acknowledge outages.
+func (t *Tracker) ServeAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Cross-origin request denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	params := r.URL.Query()
+
+	f := Filter{
+		ID:         params.Get("id"),
+		Controller: params.Get("controller"),
+		Site:       params.Get("site"),
+		DeviceMAC:  params.Get("device_mac"),
+		Interface:  params.Get("interface"),
+	}
+
+	if f.ID == "" && f.DeviceMAC == "" {
+		http.Error(w, "id or device_mac is required", http.StatusBadRequest)
+		return
+	}
+
+	acknowledged, err := t.Acknowledge(f, time.Now())
+	if err != nil {
+		http.Error(w, "Could not save the acknowledgement", http.StatusInternalServerError)
+		return
+	}
+
+	if len(acknowledged) == 0 {
+		http.Error(w, "No such device is offline", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"states": t.redacted(acknowledged)})
+}
+
+// redacted returns the states redacted for serving.
+func (t *Tracker) redacted(states []State) []State {
+	redacted := make([]State, len(states))
+
+	for i, s := range states {
+		if r := t.Redactor; r != nil {
+			s.Controller = r.String(s.Controller)
+			s.Site = r.String(s.Site)
+			s.Device = r.String(s.Device)
+			s.DeviceMAC = r.String(s.DeviceMAC)
+			s.Interface = r.String(s.Interface)
+			s.Event.Event = r.Event(s.Event.Event)
+		}
+		redacted[i] = s
+	}
+
+	return redacted
+}
+
+// EOF
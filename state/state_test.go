@@ -0,0 +1,225 @@
+package state_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+	"github.com/zimmra/omada-to-ntfy/state"
+)
+
+func event(id int64, device string, wan string, result string, at time.Time) history.Entry {
+	msg := &omada.OmadaMessage{
+		Controller: "Home",
+		Site:       "Default",
+		Text:       []string{"[" + device + "]: The online detection result of [" + wan + "] was " + result + "."},
+		Timestamp:  at.UnixMilli(),
+	}
+
+	e := history.NewEntry("", msg, nil)
+	e.ID = id
+
+	return e
+}
+
+func TestTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	tracker, err := state.Open(path)
+	if err != nil {
+		t.Fatalf("Open() returned an unexpected error: %v", err)
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	gateway := "gateway:98-03-8E-3A-8D-53"
+
+	t.Run("The first event sets the state", func(t *testing.T) {
+		_, after, changed, err := tracker.Update(event(1, gateway, "WAN1", "offline", start))
+		if err != nil || !changed || after.State != state.Offline || !after.Since.Equal(start) {
+			t.Errorf("Unexpected update: %+v, %v, %v", after, changed, err)
+		}
+	})
+
+	t.Run("Repeated events keep the time of the change", func(t *testing.T) {
+		_, after, changed, _ := tracker.Update(event(2, gateway, "WAN1", "offline", start.Add(time.Minute)))
+		if changed || !after.Since.Equal(start) || after.Event.ID != 2 {
+			t.Errorf("Unexpected update: %+v, %v", after, changed)
+		}
+	})
+
+	t.Run("Interfaces are tracked separately", func(t *testing.T) {
+		tracker.Update(event(3, gateway, "WAN2", "online", start.Add(2*time.Minute)))
+
+		if states := tracker.List(state.Filter{State: state.Offline}); len(states) != 1 || states[0].Interface != "WAN1" {
+			t.Errorf("Expected only WAN1 to be offline, got %+v", states)
+		}
+	})
+
+	t.Run("Older events don't change the state", func(t *testing.T) {
+		_, after, changed, _ := tracker.Update(event(4, gateway, "WAN2", "offline", start))
+		if changed || after.State != state.Online {
+			t.Errorf("Unexpected update: %+v, %v", after, changed)
+		}
+	})
+
+	t.Run("Other events are ignored", func(t *testing.T) {
+		test := history.NewEntry("", &omada.OmadaMessage{Description: "This is a webhook test message. Please ignore this"}, nil)
+		if _, _, changed, _ := tracker.Update(test); changed || len(tracker.List(state.Filter{})) != 2 {
+			t.Errorf("A test message changed the states")
+		}
+	})
+
+	t.Run("Coming back online changes the state", func(t *testing.T) {
+		before, after, changed, _ := tracker.Update(event(5, gateway, "WAN1", "online", start.Add(10*time.Minute)))
+		if !changed || before.State != state.Offline || after.State != state.Online || !after.Since.Equal(start.Add(10*time.Minute)) {
+			t.Errorf("Unexpected update: %+v -> %+v", before, after)
+		}
+	})
+
+	t.Run("States survive a restart", func(t *testing.T) {
+		reopened, err := state.Open(path)
+		if err != nil {
+			t.Fatalf("Open() returned an unexpected error: %v", err)
+		}
+
+		states := reopened.List(state.Filter{DeviceMAC: "98:03:8e:3a:8d:53"})
+		if len(states) != 2 || states[0].Interface != "WAN1" || states[0].State != state.Online || states[0].Event.ID != 5 {
+			t.Errorf("Unexpected states after reopening: %+v", states)
+		}
+	})
+}
+
+func TestServeHTTP(t *testing.T) {
+	tracker, _ := state.Open("")
+	tracker.Update(event(1, "gateway:98-03-8E-3A-8D-53", "WAN1", "offline", time.Now()))
+	tracker.Update(event(2, "switch:98-03-8E-3A-8D-54", "SFP1", "online", time.Now()))
+
+	w := httptest.NewRecorder()
+	tracker.ServeHTTP(w, httptest.NewRequest("GET", "/api/state?state=offline", nil))
+
+	var res struct {
+		States []state.State `json:"states"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Response is not JSON: %v", w.Body.String())
+	}
+
+	if len(res.States) != 1 || res.States[0].Device != "gateway:98-03-8E-3A-8D-53" {
+		t.Errorf("Unexpected states: %+v", res.States)
+	}
+
+	w = httptest.NewRecorder()
+	tracker.ServeHTTP(w, httptest.NewRequest("GET", "/api/state?state=sideways", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected status code 400 for an invalid state, got %d", w.Code)
+	}
+
+	t.Run("Redacted", func(t *testing.T) {
+		detectors, _ := redact.Builtin("mac")
+		tracker.Redactor = &redact.Redactor{Detectors: detectors, Mode: redact.ModeHash, Key: []byte("key")}
+		defer func() { tracker.Redactor = nil }()
+
+		w := httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest("GET", "/api/state?state=offline", nil))
+		json.Unmarshal(w.Body.Bytes(), &res)
+
+		s := res.States[0]
+		if strings.Contains(w.Body.String(), "8D-53") || !strings.HasPrefix(s.DeviceMAC, "mac-") || s.Device != "gateway:"+s.DeviceMAC {
+			t.Fatalf("Expected the state to be served redacted, got %v", w.Body.String())
+		}
+
+		// The device can be picked by its pseudonyms, as it's kept as it is
+		tracker.Redactor.Detectors = append(tracker.Redactor.Detectors, redact.Detector{Name: "place", Pattern: regexp.MustCompile(`Home|Default|WAN1`)})
+		w = httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest("GET", "/api/state?state=offline", nil))
+		json.Unmarshal(w.Body.Bytes(), &res)
+		s = res.States[0]
+
+		query := url.Values{"controller": {s.Controller}, "site": {s.Site}, "device_mac": {strings.ToUpper(s.DeviceMAC)}, "interface": {s.Interface}}
+		w = httptest.NewRecorder()
+		tracker.ServeAck(w, httptest.NewRequest("POST", "/api/state/ack?"+query.Encode(), nil))
+		if w.Code != 200 || strings.Contains(w.Body.String(), "8D-53") {
+			t.Errorf("Expected the device to be acknowledged by its pseudonyms, got %d: %v", w.Code, w.Body.String())
+		}
+		if states := tracker.List(state.Filter{DeviceMAC: "98-03-8E-3A-8D-53"}); len(states) != 1 || states[0].Acknowledged == nil {
+			t.Errorf("Expected the actual device to be acknowledged, got %+v", states)
+		}
+
+		// Masked, it's picked by its ID
+		tracker.Redactor.Mode = redact.ModeMask
+		tracker.Update(event(3, "switch:98-03-8E-3A-8D-54", "SFP1", "offline", time.Now()))
+		w = httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest("GET", "/api/state?state=offline", nil))
+		json.Unmarshal(w.Body.Bytes(), &res)
+
+		for _, s := range res.States {
+			w = httptest.NewRecorder()
+			tracker.ServeAck(w, httptest.NewRequest("POST", "/api/state/ack?device_mac="+url.QueryEscape(s.DeviceMAC), nil))
+			if w.Code != 404 {
+				t.Errorf("Expected a masked MAC address not to pick any device, got %d", w.Code)
+			}
+		}
+
+		w = httptest.NewRecorder()
+		tracker.ServeAck(w, httptest.NewRequest("POST", "/api/state/ack?id="+res.States[1].ID, nil))
+		if acked := tracker.List(state.Filter{DeviceMAC: "98-03-8E-3A-8D-54"}); w.Code != 200 || acked[0].Acknowledged == nil {
+			t.Errorf("Expected the device to be acknowledged by its ID, got %d: %v", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestServeAck(t *testing.T) {
+	tracker, _ := state.Open("")
+	tracker.Update(event(1, "gateway:98-03-8E-3A-8D-53", "WAN1", "offline", time.Now()))
+	tracker.Update(event(2, "gateway:98-03-8E-3A-8D-53", "WAN2", "online", time.Now()))
+
+	tests := []struct {
+		method string
+		query  string
+		origin string
+		code   int
+	}{
+		{"GET", "device_mac=98-03-8E-3A-8D-53", "", 405},
+		{"POST", "", "", 400},
+		{"POST", "device_mac=98-03-8E-3A-8D-53&interface=WAN2", "", 404},
+		{"POST", "device_mac=98-03-8E-3A-8D-53", "https://evil.example", 403},
+		{"POST", "device_mac=98:03:8e:3a:8d:53", "http://example.com", 200},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/api/state/ack?"+tt.query, nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		tracker.ServeAck(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("%v ?%v: expected status code %d, got %d", tt.method, tt.query, tt.code, w.Code)
+		}
+	}
+
+	states := tracker.List(state.Filter{})
+	if states[0].Acknowledged == nil || states[1].Acknowledged != nil {
+		t.Errorf("Expected only the offline WAN1 to be acknowledged, got %+v", states)
+	}
+
+	t.Run("A change of state clears the acknowledgement", func(t *testing.T) {
+		tracker.Update(event(3, "gateway:98-03-8E-3A-8D-53", "WAN1", "online", time.Now().Add(time.Minute)))
+		tracker.Update(event(4, "gateway:98-03-8E-3A-8D-53", "WAN1", "offline", time.Now().Add(2*time.Minute)))
+
+		if s := tracker.List(state.Filter{Interface: "WAN1"}); s[0].Acknowledged != nil {
+			t.Errorf("Acknowledgement kept for a new outage")
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,258 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How spans are batched up before they're sent to the collector.
+const (
+	batchSize     = 256
+	batchInterval = 5 * time.Second
+	queueSize     = 2048
+)
+
+// Tracer starts spans and exports them in batches to an OTLP/HTTP endpoint,
+// such as `http://localhost:4318/v1/traces` for a local collector. A nil
+// *Tracer doesn't trace anything.
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	version     string
+	client      *http.Client
+	logger      *slog.Logger
+
+	queue    chan *Span
+	flush    chan chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// New creates a tracer exporting to the endpoint, with the extra headers on
+// every export request (e.g. for authentication). The service name and
+// version identify the bridge in the traces.
+func New(endpoint string, headers map[string]string, serviceName string, version string, logger *slog.Logger) *Tracer {
+	t := &Tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		version:     version,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+		queue:       make(chan *Span, queueSize),
+		flush:       make(chan chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+func (t *Tracer) export(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		// Rather lose a span than hold up a webhook
+		t.logger.Warn("Trace export queue is full, dropping span", "span", s.name)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+
+	send := func() {
+		if len(batch) > 0 {
+			t.send(batch)
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-t.flush:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			send()
+			close(done)
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+// Flush exports all spans ended so far, waiting until that's done or the
+// context ends.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+
+	select {
+	case t.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown flushes the remaining spans and stops exporting.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	err := t.Flush(ctx)
+	t.stopOnce.Do(func() { close(t.stopped) })
+
+	return err
+}
+
+/*
+ * The OTLP JSON encoding of spans, see
+ * https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+ */
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpAttribute(key string, value any) otlpKeyValue {
+	var v map[string]any
+
+	switch value := value.(type) {
+	case string:
+		v = map[string]any{"stringValue": value}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]any{"doubleValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+
+	return otlpKeyValue{Key: key, Value: v}
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            map[string]any `json:"status,omitempty"`
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+
+	for _, a := range s.attributes {
+		span.Attributes = append(span.Attributes, otlpAttribute(a.key, a.value))
+	}
+
+	if s.statusCode != statusUnset {
+		span.Status = map[string]any{"code": s.statusCode, "message": s.statusMessage}
+	}
+
+	return span
+}
+
+func (t *Tracer) send(batch []*Span) {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{
+					otlpAttribute("service.name", t.serviceName),
+					otlpAttribute("service.version", t.version),
+				},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/zimmra/omada-to-ntfy/tracing"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		t.logger.Error("Could not encode trace spans", "error", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.logger.Error("Could not create trace export request", "error", err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.logger.Warn("Could not export trace spans", "error", err, "spans", len(batch))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		t.logger.Warn("Trace collector returned non-success status code", "status", resp.StatusCode, "spans", len(batch))
+	}
+}
+
+// EOF
@@ -0,0 +1,239 @@
+// Package tracing records trace spans for the journey of a webhook through
+// the bridge and exports them to an OpenTelemetry collector with OTLP over
+// HTTP (JSON encoded), without depending on the OpenTelemetry SDK.
+//
+// Spans are carried in the context. Starting a span from a context without
+// one gives a nil *Span, on which every method is a no-op, so code can be
+// traced unconditionally.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// SpanKind tells what role the span plays, with the values OTLP uses.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Status codes with the values OTLP uses.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Span is a single timed operation within a trace.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    SpanKind
+	start   time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attributes    []attribute
+	statusCode    int
+	statusMessage string
+	ended         bool
+}
+
+// SetAttributes adds attributes to the span from alternating keys and values,
+// like slog does; values can be strings, bools, integers or floats.
+func (s *Span) SetAttributes(keyValues ...any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		s.attributes = append(s.attributes, attribute{fmt.Sprint(keyValues[i]), keyValues[i+1]})
+	}
+}
+
+// SetError marks the span as failed with the error, if there is one.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statusCode = statusError
+	s.statusMessage = err.Error()
+}
+
+// End finishes the span and hands it to the exporter. Only the first call
+// has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.export(s)
+}
+
+// TraceID returns the hex encoded ID of the trace the span is part of.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// traceparent formats the W3C Trace Context header identifying the span, see
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+type spanKey struct{}
+type remoteParentKey struct{}
+
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// SpanFromContext returns the span carried by the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+var traceparentRe = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// Extract returns a copy of the context carrying the parent span given by
+// the `traceparent` header of an incoming request, if there is a valid one,
+// so the trace started by whatever is in front of the bridge is continued.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	m := traceparentRe.FindStringSubmatch(header.Get("traceparent"))
+	if m == nil {
+		return ctx
+	}
+
+	var p remoteParent
+	hex.Decode(p.traceID[:], []byte(m[1]))
+	hex.Decode(p.spanID[:], []byte(m[2]))
+
+	if p.traceID == [16]byte{} || p.spanID == [8]byte{} {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteParentKey{}, p)
+}
+
+// Start starts a new span as a child of the span in the context, using the
+// same tracer. Without a span in the context nothing is traced.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return SpanFromContext(ctx).tracerOrNil().Start(ctx, name, kind)
+}
+
+func (s *Span) tracerOrNil() *Tracer {
+	if s == nil {
+		return nil
+	}
+	return s.tracer
+}
+
+// Start starts a new span, as a child of the span in the context if there is
+// one, or else of the remote parent from Extract, or else in a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+		s.traceID, s.parent = remote.traceID, remote.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+type transport struct {
+	next      http.RoundTripper
+	propagate bool
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(req.Context(), "HTTP "+req.Method, KindClient)
+	if span == nil {
+		return t.next.RoundTrip(req)
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		"http.request.method", req.Method,
+		"server.address", req.URL.Hostname(),
+		"url.scheme", req.URL.Scheme,
+	)
+
+	// Let the receiving end continue the trace, if it knows how
+	req = req.Clone(ctx)
+	if t.propagate {
+		req.Header.Set("traceparent", span.traceparent())
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return resp, err
+	}
+
+	span.SetAttributes("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		span.SetError(fmt.Errorf("status code %d", resp.StatusCode))
+	}
+
+	return resp, nil
+}
+
+// Transport wraps an HTTP transport (nil for the default) to trace every
+// outgoing request as a client span. With propagate the trace is passed on in
+// a `traceparent` header; leave that to services that are your own.
+func Transport(next http.RoundTripper, propagate bool) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &transport{next: next, propagate: propagate}
+}
+
+// EOF
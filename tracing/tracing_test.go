@@ -0,0 +1,232 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zimmra/omada-to-ntfy/tracing"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector, keeping the spans it
+// receives by name.
+type collector struct {
+	mu      sync.Mutex
+	spans   map[string]map[string]any
+	headers http.Header
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{spans: map[string]map[string]any{}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []map[string]any `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []map[string]any `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Collector received invalid JSON: %v", err)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.headers = r.Header.Clone()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					c.spans[s["name"].(string)] = s
+				}
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return c, srv
+}
+
+func (c *collector) span(name string) map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans[name]
+}
+
+func attribute(span map[string]any, key string) any {
+	attributes, _ := span["attributes"].([]any)
+	for _, a := range attributes {
+		a := a.(map[string]any)
+		if a["key"] == key {
+			for _, v := range a["value"].(map[string]any) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	c, srv := newCollector(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tracer := tracing.New(srv.URL+"/v1/traces", map[string]string{"Authorization": "Bearer abc"}, "omada-to-ntfy", "test", logger)
+
+	// Continue a trace started in front of the bridge
+	header := http.Header{}
+	header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx := tracing.Extract(context.Background(), header)
+
+	ctx, server := tracer.Start(ctx, "webhook.request", tracing.KindServer)
+	server.SetAttributes("request_id", "abc123", "http.response.status_code", 200)
+
+	_, deliver := tracing.Start(ctx, "notifier.deliver", tracing.KindInternal)
+	deliver.SetError(errors.New("ntfy is down"))
+	deliver.End()
+	server.End()
+	server.End() // Ending twice only exports once
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown() returned an unexpected error: %v", err)
+	}
+
+	s := c.span("webhook.request")
+	d := c.span("notifier.deliver")
+	if s == nil || d == nil {
+		t.Fatalf("Collector didn't receive both spans: %v", c.spans)
+	}
+
+	if s["traceId"] != "0af7651916cd43dd8448eb211c80319c" || s["parentSpanId"] != "b7ad6b7169203331" {
+		t.Errorf("Server span didn't continue the incoming trace: %v", s)
+	}
+
+	if d["traceId"] != s["traceId"] || d["parentSpanId"] != s["spanId"] {
+		t.Errorf("Delivery span isn't a child of the server span: %v", d)
+	}
+
+	if s["kind"] != float64(tracing.KindServer) || attribute(s, "request_id") != "abc123" || attribute(s, "http.response.status_code") != "200" {
+		t.Errorf("Server span has unexpected kind or attributes: %v", s)
+	}
+
+	status, _ := d["status"].(map[string]any)
+	if status["code"] != float64(2) || status["message"] != "ntfy is down" {
+		t.Errorf("Delivery span doesn't have the error status: %v", d)
+	}
+
+	if c.headers.Get("Authorization") != "Bearer abc" || c.headers.Get("Content-Type") != "application/json" {
+		t.Errorf("Export request is missing headers: %v", c.headers)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tests := map[string]string{
+		"missing":      "",
+		"garbage":      "not-a-traceparent",
+		"zero trace":   "00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"zero span":    "00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"uppercase ID": "00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("traceparent", value)
+
+			ctx := context.Background()
+			if got := tracing.Extract(ctx, header); got != ctx {
+				t.Errorf("Extract() accepted an invalid traceparent `%v`", value)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var traceparent string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: tracing.Transport(nil, true)}
+
+	t.Run("Untraced requests are passed on as they are", func(t *testing.T) {
+		traceparent = ""
+
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if traceparent != "" {
+			t.Errorf("Untraced request has a traceparent header: %v", traceparent)
+		}
+	})
+
+	t.Run("Traced requests carry the trace on", func(t *testing.T) {
+		tracer := tracing.New("http://127.0.0.1:0/v1/traces", nil, "omada-to-ntfy", "test", slog.New(slog.NewTextHandler(io.Discard, nil)))
+		defer tracer.Shutdown(context.Background())
+
+		ctx, span := tracer.Start(context.Background(), "test", tracing.KindInternal)
+		defer span.End()
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if !strings.HasPrefix(traceparent, "00-"+span.TraceID()+"-") {
+			t.Errorf("Expected a traceparent in trace %v, got `%v`", span.TraceID(), traceparent)
+		}
+
+		traceparent = ""
+		private := &http.Client{Transport: tracing.Transport(nil, false)}
+		resp, err = private.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if traceparent != "" {
+			t.Errorf("Expected no traceparent without propagation, got `%v`", traceparent)
+		}
+	})
+}
+
+func TestNilSafety(t *testing.T) {
+	var tracer *tracing.Tracer
+
+	ctx, span := tracer.Start(context.Background(), "nothing", tracing.KindServer)
+	if span != nil || tracing.SpanFromContext(ctx) != nil {
+		t.Fatalf("A nil tracer started a span")
+	}
+
+	span.SetAttributes("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() of a nil tracer returned an error: %v", err)
+	}
+}
+
+// EOF
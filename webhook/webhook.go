@@ -1,49 +1,257 @@
 package webhook
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
+	"time"
 
-	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/access"
+	"github.com/zimmra/omada-to-ntfy/capture"
+	"github.com/zimmra/omada-to-ntfy/heartbeat"
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/metrics"
+	"github.com/zimmra/omada-to-ntfy/notifier"
 	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+	"github.com/zimmra/omada-to-ntfy/state"
+	"github.com/zimmra/omada-to-ntfy/tracing"
 )
 
 type WebhookServer struct {
-	NtfyClient   ntfy.NtfyClient
-	SharedSecret string
-	Logger       *log.Logger
+	Notifier        notifier.Notifier
+	SharedSecret    string
+	PreviousSecrets []string            // Also accepted, while the secret is being changed
+	AllowedIPs      *access.Allowlist   // Optional; where webhooks are accepted from
+	TrustedProxies  []netip.Prefix      // Proxies whose X-Forwarded-For is believed
+	Lockout         *access.Lockout     // Optional; refuses addresses that keep failing
+	Replays         *access.ReplayGuard // Optional; rejects stale and repeated webhooks
+	LogPayloads     bool                // Log the (sanitised) body of every request
+	MaxBodySize     int64               // The largest body accepted in bytes; any size when 0
+	Metrics         *metrics.Metrics    // Optional
+	Tracer          *tracing.Tracer     // Optional
+	Capture         *capture.Recorder   // Optional; records every authorised request
+	History         *history.Store      // Optional; keeps every event and its delivery
+	RedactHistory   *redact.Redactor    // Optional; redacts the events before they're kept
+	State           *state.Tracker      // Optional; tracks which devices are online
+	Heartbeat       *heartbeat.Monitor  // Optional; notices controllers going silent
+	Watchdog        *notifier.Watchdog  // Optional; watches the deliveries of Notifier
+	Logger          *slog.Logger
+}
+
+// requestID returns the ID for the request: the one set by a proxy in front
+// in the X-Request-ID header when it looks sensible, a new one otherwise.
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 64 {
+		return logging.NewRequestID()
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return logging.NewRequestID()
+		}
+	}
+
+	return id
+}
+
+// authorized reports whether the request carries the shared secret, or one
+// of the previous ones.
+func (ws *WebhookServer) authorized(r *http.Request) bool {
+	token := r.Header["Access_token"]
+	if len(token) == 0 {
+		return false
+	}
+
+	return access.SecretMatches(token[0], append([]string{ws.SharedSecret}, ws.PreviousSecrets...)...)
 }
 
 func (ws *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The delivery should go ahead even if Omada hangs up on us, so the
+	// context keeps the request ID but isn't cancelled with the request;
+	// every delivery has a timeout of its own instead.
+	id := requestID(r)
+	ctx := logging.WithRequestID(context.WithoutCancel(r.Context()), id)
+	w.Header().Set("X-Request-ID", id)
+
+	ctx, span := ws.Tracer.Start(tracing.Extract(ctx, r.Header), "webhook.request", tracing.KindServer)
+	defer span.End()
+	span.SetAttributes("request_id", id, "http.request.method", r.Method, "url.path", r.URL.Path)
+
+	status := http.StatusOK
+	defer func() {
+		span.SetAttributes("http.response.status_code", status)
+		if status >= 400 {
+			span.SetError(fmt.Errorf("responded with %d %v", status, http.StatusText(status)))
+		}
+	}()
+
+	// Checked before reading the body, so nobody without the secret can
+	// keep the server busy with one
+	clientIP := access.ClientIP(r, ws.TrustedProxies)
+
+	if ws.Lockout.Locked(clientIP, time.Now()) {
+		// Not logged, or a client guessing away would flood the logs
+		ws.Metrics.AuthFailure("lockout")
+		status = http.StatusTooManyRequests
+		http.Error(w, "Too Many Requests", status)
+		return
+	}
+
+	if !ws.AllowedIPs.Allows(clientIP) {
+		ws.Logger.WarnContext(ctx, "Webhook request from an address that isn't allowed", "client_ip", clientIP, "remote_addr", r.RemoteAddr)
+		ws.Metrics.AuthFailure("address")
+		status = http.StatusForbidden
+		http.Error(w, "Not authorized", status)
+		return
+	}
+
+	if !ws.authorized(r) {
+		ws.Logger.WarnContext(ctx, "Webhook request not authorized", "client_ip", clientIP, "remote_addr", r.RemoteAddr)
+		ws.Metrics.AuthFailure("secret")
+
+		if ws.Lockout.Fail(clientIP, time.Now()) {
+			ws.Logger.WarnContext(ctx, "Locked out after failing to authorize repeatedly", "client_ip", clientIP, "duration", ws.Lockout.Duration.String())
+		}
+
+		status = http.StatusForbidden
+		http.Error(w, "Not authorized", status)
+		return
+	}
+
+	ws.Lockout.Succeed(clientIP)
+
+	if ws.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, ws.MaxBodySize)
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ws.Logger.WarnContext(ctx, "Request body too large", "limit", tooLarge.Limit)
+			status = http.StatusRequestEntityTooLarge
+			http.Error(w, "Request Entity Too Large", status)
+			return
+		}
+
+		ws.Logger.ErrorContext(ctx, "Error reading request body", "error", err)
+		status = http.StatusBadRequest
+		http.Error(w, "Bad Request", status)
 		return
 	}
 
 	defer r.Body.Close()
 
-	if r.Header["Access_token"] == nil || r.Header["Access_token"][0] != ws.SharedSecret {
-		http.Error(w, "Not authorized", http.StatusForbidden)
-		return
+	_, parseSpan := tracing.Start(ctx, "omada.parse", tracing.KindInternal)
+	omadaMessage, err := omada.ParseOmadaMessage(ctx, ws.Logger, body, ws.LogPayloads)
+
+	if cerr := ws.Capture.Record(capture.NewRecord(r, id, body, omadaMessage, err)); cerr != nil {
+		ws.Logger.WarnContext(ctx, "Could not capture the request", "error", cerr)
 	}
 
-	omadaMessage, err := omada.ParseOmadaMessage(ws.Logger, body)
 	if err != nil || omadaMessage == nil {
-		ws.Logger.Printf("Error parsing Omada notification message: %v", err)
-		http.Error(w, "Internal message parsing error", http.StatusInternalServerError)
+		parseSpan.SetError(err)
+		parseSpan.End()
+		ws.Logger.ErrorContext(ctx, "Error parsing Omada notification message", "error", err)
+		ws.Metrics.ParseError()
+		status = http.StatusInternalServerError
+		http.Error(w, "Internal message parsing error", status)
+		return
+	}
+
+	// Omada's test messages don't name the controller, but the webhook URL
+	// configured in it can, e.g. `http://bridge:8080/?controller=Home`
+	if omadaMessage.Controller == "" {
+		omadaMessage.Controller = r.URL.Query().Get("controller")
+	}
+
+	if !ws.AllowedIPs.AllowsController(omadaMessage.Controller, clientIP) {
+		parseSpan.End()
+		ws.Logger.WarnContext(ctx, "Webhook request from an address that isn't allowed for the controller", "controller", omadaMessage.Controller, "client_ip", clientIP)
+		ws.Metrics.AuthFailure("address")
+		status = http.StatusForbidden
+		http.Error(w, "Not authorized", status)
+		return
+	}
+
+	// Test messages come without a timestamp; any other message needs one
+	// to tell whether it's fresh
+	var sent time.Time
+	if omadaMessage.Timestamp > 0 {
+		sent = omadaMessage.Date()
+	} else if ws.Replays != nil && omadaMessage.Type() != omada.OmadaTestMessage {
+		parseSpan.End()
+		ws.Logger.WarnContext(ctx, "Webhook request without a timestamp rejected", "client_ip", clientIP)
+		ws.Metrics.SuppressedEvent("all", "stale")
+		status = http.StatusForbidden
+		http.Error(w, "Stale request", status)
+		return
+	}
+
+	switch err := ws.Replays.Check(body, sent, time.Now()); {
+	case errors.Is(err, access.ErrStale):
+		parseSpan.End()
+		ws.Logger.WarnContext(ctx, "Stale webhook request rejected", "client_ip", clientIP, "sent", sent)
+		ws.Metrics.SuppressedEvent("all", "stale")
+		status = http.StatusForbidden
+		http.Error(w, "Stale request", status)
+		return
+
+	case errors.Is(err, access.ErrReplayed):
+		// Could be the controller trying again, so it's told all is well
+		parseSpan.End()
+		ws.Logger.WarnContext(ctx, "Webhook request received before, not delivered again", "client_ip", clientIP)
+		ws.Metrics.SuppressedEvent("all", "dedup")
+		fmt.Fprintln(w, "Already received")
 		return
 	}
 
-	// Send the message to ntfy
-	err = ws.NtfyClient.Send(omadaMessage)
+	ws.Heartbeat.Seen(omadaMessage.Controller, time.Now())
+
+	parseSpan.SetAttributes(
+		"omada.controller", omadaMessage.Controller,
+		"omada.site", omadaMessage.Site,
+		"omada.type", omadaMessage.Type().String(),
+		"omada.priority", omadaMessage.Priority(),
+	)
+	parseSpan.End()
+
+	ws.Metrics.WebhookReceived(omadaMessage.Controller, omadaMessage.Site, omadaMessage.Type().String())
+
+	// Send the message to the configured notifier(s)
+	err = ws.Notifier.Send(ctx, omadaMessage)
+
+	// Only the history is redacted; the state goes by the actual device
+	entry := history.NewEntry(id, omadaMessage, err)
+	kept := entry
+	kept.Event = ws.RedactHistory.Event(entry.Event)
+
+	kept, herr := ws.History.Add(kept)
+	if herr != nil {
+		ws.Logger.WarnContext(ctx, "Could not add the event to the history", "error", herr)
+	}
+	entry.ID = kept.ID
+
+	if before, after, changed, serr := ws.State.Update(entry); serr != nil {
+		ws.Logger.WarnContext(ctx, "Could not save the device state", "error", serr)
+	} else if changed {
+		ws.Logger.InfoContext(ctx, "Device state changed", "device", after.Device, "interface", after.Interface, "from", before.State, "to", after.State)
+	}
 
 	if err != nil {
-		ws.Logger.Printf("Error sending message to ntfy: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		// So it's delivered when the controller tries again
+		ws.Replays.Forget(body)
+
+		ws.Logger.ErrorContext(ctx, "Error sending notification", "error", err)
+		status = http.StatusInternalServerError
+		http.Error(w, "Internal server error", status)
 		return
 	}
 
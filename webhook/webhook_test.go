@@ -2,15 +2,23 @@ package webhook_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/zimmra/omada-to-ntfy/ntfy"
+	"github.com/zimmra/omada-to-ntfy/access"
+	"github.com/zimmra/omada-to-ntfy/history"
+	"github.com/zimmra/omada-to-ntfy/logging"
+	"github.com/zimmra/omada-to-ntfy/metrics"
 	"github.com/zimmra/omada-to-ntfy/omada"
+	"github.com/zimmra/omada-to-ntfy/redact"
+	"github.com/zimmra/omada-to-ntfy/state"
 	"github.com/zimmra/omada-to-ntfy/webhook"
 )
 
@@ -18,11 +26,13 @@ import (
 
 type NtfyClientMock struct {
 	Calls       int
+	RequestID   string
 	returnError error
 }
 
-func (mock *NtfyClientMock) Send(payload *omada.OmadaMessage) error {
+func (mock *NtfyClientMock) Send(ctx context.Context, payload *omada.OmadaMessage) error {
 	mock.Calls += 1
+	mock.RequestID = logging.RequestID(ctx)
 	return mock.returnError
 }
 
@@ -39,23 +49,18 @@ func (errReader) Read(p []byte) (n int, err error) {
 func TestWebhookServer(t *testing.T) {
 
 	var (
-		buf    bytes.Buffer
-		logger = log.New(&buf, "logger: ", log.Lshortfile)
+		buf       bytes.Buffer
+		logger, _ = logging.New(&buf, "text", "info")
 	)
 
 	const sharedSecret = "vewySecwet"
 
-	ntfyClient := ntfy.NtfyClient{
-		NtfyURL:  "https://ntfy.sh",
-		Topic:    "test_topic",
-		Username: "",
-		Password: "",
-		Logger:   logger,
-	}
+	ntfyClient := &NtfyClientMock{}
 
 	server := &webhook.WebhookServer{
-		NtfyClient:   ntfyClient,
+		Notifier:     ntfyClient,
 		SharedSecret: sharedSecret,
+		Metrics:      metrics.New(),
 		Logger:       logger,
 	}
 
@@ -163,4 +168,299 @@ func TestWebhookServer(t *testing.T) {
 			t.Errorf("Got %q, want %q", got, want)
 		}
 	})
+
+	validJSON := []byte(`{"Site":"Some site","description":"This is a webhook message from Omada Controller","text":["[gateway:98-03-8E-3A-8D-53]: The online detection result of [2.5G WAN1] was online.\r"],"Controller":"Omada Controller_347044","timestamp":1758852934790}`)
+
+	t.Run("Authenticated and delivered through the notifier", func(t *testing.T) {
+		ntfyClient.Calls = 0
+		ntfyClient.returnError = nil
+
+		request, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(validJSON))
+		request.Header.Set("Access_token", server.SharedSecret)
+
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		got := response.Result().Status
+		want := "200 OK"
+
+		if got != want {
+			t.Errorf("Expected status code to be `%s`, but got `%s`", want, got)
+		}
+
+		if ntfyClient.Calls != 1 {
+			t.Errorf("Expected the notifier to be called once, but it was called %d times", ntfyClient.Calls)
+		}
+	})
+
+	t.Run("Requests are counted in the metrics", func(t *testing.T) {
+		if got := server.Metrics.AuthFailures.Value("secret"); got != float64(len(notAuthorizedTests)) {
+			t.Errorf("Expected %d auth failures, got %v", len(notAuthorizedTests), got)
+		}
+
+		if got := server.Metrics.ParseErrors.Value(); got != 1 {
+			t.Errorf("Expected 1 parse error, got %v", got)
+		}
+
+		if got := server.Metrics.WebhooksReceived.Value("Omada Controller_347044", "Some site", "online"); got != 1 {
+			t.Errorf("Expected 1 online message received, got %v", got)
+		}
+	})
+
+	t.Run("Not authenticated without reading the body", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/", errReader(0))
+
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		if got, want := response.Result().Status, "403 Forbidden"; got != want {
+			t.Errorf("Expected status code to be `%s`, but got `%s`", want, got)
+		}
+	})
+
+	t.Run("Body larger than the limit", func(t *testing.T) {
+		server.MaxBodySize = 16
+		defer func() { server.MaxBodySize = 0 }()
+
+		request, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(`{"Site":"Some site","Controller":"Omada Controller_347044"}`))
+
+		request.Header.Set("Access_token", server.SharedSecret) // CORRECT
+
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		if got, want := response.Result().Status, "413 Request Entity Too Large"; got != want {
+			t.Errorf("Expected status code to be `%s`, but got `%s`", want, got)
+		}
+	})
+
+	t.Run("Authenticated but the notifier fails", func(t *testing.T) {
+		ntfyClient.Calls = 0
+		ntfyClient.returnError = errors.New("delivery failed")
+
+		request, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(validJSON))
+		request.Header.Set("Access_token", server.SharedSecret)
+
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		got := response.Result().Status
+		want := "500 Internal Server Error"
+
+		if got != want {
+			t.Errorf("Expected status code to be `%s`, but got `%s`", want, got)
+		}
+
+		if ntfyClient.Calls != 1 {
+			t.Errorf("Expected the notifier to be called once, but it was called %d times", ntfyClient.Calls)
+		}
+	})
+
+	t.Run("The request ID is carried through to delivery and the logs", func(t *testing.T) {
+		buf.Reset()
+		ntfyClient.returnError = errors.New("delivery failed")
+
+		request, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(validJSON))
+		request.Header.Set("Access_token", server.SharedSecret)
+		request.Header.Set("X-Request-ID", "abc-123")
+
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		if got := response.Header().Get("X-Request-ID"); got != "abc-123" {
+			t.Errorf("Expected the X-Request-ID response header to be `abc-123`, but got `%s`", got)
+		}
+
+		if ntfyClient.RequestID != "abc-123" {
+			t.Errorf("Expected the notifier to get request ID `abc-123`, but got `%s`", ntfyClient.RequestID)
+		}
+
+		if logged := buf.String(); !strings.Contains(logged, `msg="Error sending notification" error="delivery failed" request_id=abc-123`) {
+			t.Errorf("Expected the delivery error to be logged with the request ID; log is `%s`", logged)
+		}
+
+		if logged := buf.String(); strings.Contains(logged, "payload=") {
+			t.Errorf("Expected the payload not to be logged; log is `%s`", logged)
+		}
+	})
+}
+
+func TestWebhookAccess(t *testing.T) {
+	logger, _ := logging.New(io.Discard, "text", "info")
+	allowed, _ := access.ParseAllowlist("192.168.1.0/24, Office=203.0.113.7")
+	trusted, _ := access.ParsePrefixes("10.0.0.1")
+
+	ntfyClient := &NtfyClientMock{}
+	server := &webhook.WebhookServer{
+		Notifier:        ntfyClient,
+		SharedSecret:    "new-secret",
+		PreviousSecrets: []string{"old-secret"},
+		AllowedIPs:      allowed,
+		TrustedProxies:  trusted,
+		Lockout:         &access.Lockout{Failures: 2, Window: time.Minute, Duration: time.Minute},
+		Metrics:         metrics.New(),
+		Logger:          logger,
+	}
+
+	send := func(remoteAddr, forwardedFor, secret, controller string) int {
+		body := `{"Site":"Some site","description":"This is a webhook test message. Please ignore this","Controller":"` + controller + `","timestamp":1758852934790}`
+		request, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Access_token", secret)
+		if forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		secret       string
+		controller   string
+		want         int
+	}{
+		{"The current secret", "192.168.1.10:40000", "", "new-secret", "Home", http.StatusOK},
+		{"The previous secret", "192.168.1.10:40000", "", "old-secret", "Home", http.StatusOK},
+		{"An address that isn't allowed", "198.51.100.1:40000", "", "new-secret", "Home", http.StatusForbidden},
+		{"A controller from its own address", "203.0.113.7:40000", "", "new-secret", "Office", http.StatusOK},
+		{"A controller from another's address", "203.0.113.7:40000", "", "new-secret", "Home", http.StatusForbidden},
+		{"A controller from an address for others", "192.168.1.10:40000", "", "new-secret", "Office", http.StatusForbidden},
+		{"Behind a trusted proxy", "10.0.0.1:40000", "203.0.113.7", "new-secret", "Office", http.StatusOK},
+		{"Forwarded by an untrusted proxy", "192.168.1.10:40000", "203.0.113.7", "new-secret", "Office", http.StatusForbidden},
+		{"The wrong secret", "192.168.1.20:40000", "", "guess", "Home", http.StatusForbidden},
+		{"The wrong secret again, locking out", "192.168.1.20:40000", "", "guess", "Home", http.StatusForbidden},
+		{"The right secret while locked out", "192.168.1.20:40000", "", "new-secret", "Home", http.StatusTooManyRequests},
+		{"Another address while one is locked out", "192.168.1.10:40000", "", "new-secret", "Home", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := send(tt.remoteAddr, tt.forwardedFor, tt.secret, tt.controller); got != tt.want {
+				t.Errorf("Expected status code %d, but got %d", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Rejections are counted by reason", func(t *testing.T) {
+		for reason, want := range map[string]float64{"address": 4, "secret": 2, "lockout": 1} {
+			if got := server.Metrics.AuthFailures.Value(reason); got != want {
+				t.Errorf("Expected %v auth failures for the %v, got %v", want, reason, got)
+			}
+		}
+	})
+}
+
+func TestWebhookReplays(t *testing.T) {
+	logger, _ := logging.New(io.Discard, "text", "info")
+
+	ntfyClient := &NtfyClientMock{}
+	server := &webhook.WebhookServer{
+		Notifier:     ntfyClient,
+		SharedSecret: "secret",
+		Replays:      &access.ReplayGuard{MaxSkew: 5 * time.Minute},
+		Logger:       logger,
+	}
+
+	offline := func(sent time.Time) string {
+		timestamp := ""
+		if !sent.IsZero() {
+			timestamp = fmt.Sprintf(`,"timestamp":%d`, sent.UnixMilli())
+		}
+		return `{"Controller":"Home","Site":"Some site","text":["[gateway:00-00-5E-00-53-01]: The online detection result of [WAN1] was offline."]` + timestamp + `}`
+	}
+	fresh := offline(time.Now().Add(-time.Minute))
+
+	undelivered := offline(time.Now().Add(-2 * time.Minute))
+
+	tests := []struct {
+		name  string
+		body  string
+		err   error
+		want  int
+		calls int
+	}{
+		{"A fresh webhook", fresh, nil, http.StatusOK, 1},
+		{"The same webhook again", fresh, nil, http.StatusOK, 0},
+		{"An old webhook", offline(time.Now().Add(-time.Hour)), nil, http.StatusForbidden, 0},
+		{"A webhook from the future", offline(time.Now().Add(time.Hour)), nil, http.StatusForbidden, 0},
+		{"A webhook without a timestamp", offline(time.Time{}), nil, http.StatusForbidden, 0},
+		{"A test message without a timestamp", `{"Site":"Some site","description":"This is a webhook test message. Please ignore this"}`, nil, http.StatusOK, 1},
+		{"A webhook that can't be delivered", undelivered, errors.New("unreachable"), http.StatusInternalServerError, 1},
+		{"The controller trying it again", undelivered, nil, http.StatusOK, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			request.Header.Set("Access_token", "secret")
+			ntfyClient.returnError = tt.err
+
+			calls := ntfyClient.Calls
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			if response.Code != tt.want {
+				t.Errorf("Expected status code %d, but got %d", tt.want, response.Code)
+			}
+			if got := ntfyClient.Calls - calls; got != tt.calls {
+				t.Errorf("Expected %d deliveries, but got %d", tt.calls, got)
+			}
+		})
+	}
+}
+
+func TestWebhookRedactsHistory(t *testing.T) {
+	logger, _ := logging.New(io.Discard, "text", "info")
+	store, _ := history.Open("", 0, 0)
+	tracker, _ := state.Open("")
+	detectors, _ := redact.Builtin("mac")
+
+	ntfyClient := &NtfyClientMock{}
+	server := &webhook.WebhookServer{
+		Notifier:      ntfyClient,
+		SharedSecret:  "secret",
+		History:       store,
+		RedactHistory: &redact.Redactor{Detectors: detectors, Mode: redact.ModeHash, Key: []byte("key")},
+		State:         tracker,
+		Logger:        logger,
+	}
+
+	body := `{"Controller":"Home","Site":"Some site","text":["[gateway:00-00-5E-00-53-01]: The online detection result of [WAN1] was offline."],"timestamp":1758852934790}`
+	request, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	request.Header.Set("Access_token", "secret")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	if ntfyClient.Calls != 1 {
+		t.Fatalf("Expected the message to be delivered, got %d deliveries", ntfyClient.Calls)
+	}
+
+	entries, _ := store.Find(history.Query{})
+	if len(entries) != 1 {
+		t.Fatalf("Expected the event in the history, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if strings.Contains(e.Body, "53-01") || !strings.HasPrefix(e.DeviceMAC, "mac-") || e.Type != "offline" {
+		t.Errorf("Expected the event to be kept redacted, got %+v", e.Event)
+	}
+
+	if found, _ := store.Find(history.Query{DeviceMAC: e.DeviceMAC}); len(found) != 1 {
+		t.Errorf("Expected the event to be found by the pseudonym of its device")
+	}
+
+	// The state goes by the actual device, so it can be told apart
+	states := tracker.List(state.Filter{DeviceMAC: "00:00:5e:00:53:01"})
+	if len(states) != 1 || states[0].Device != "gateway:00-00-5E-00-53-01" || states[0].Event.ID != e.ID {
+		t.Errorf("Expected the state of the actual device, got %+v", states)
+	}
 }